@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/haileyok/peruse/peruse"
+	"github.com/urfave/cli/v2"
+)
+
+var backfillCommand = &cli.Command{
+	Name:  "backfill",
+	Usage: "fill a topic feed from posts that were stored before it was added",
+	Flags: append(append(clickhouseFlags(false), runFlags...),
+		&cli.StringFlag{
+			Name:     "feed",
+			Usage:    "name of the wikidata or rule feed to backfill",
+			Required: true,
+		},
+		&cli.DurationFlag{
+			Name:  "since",
+			Usage: "how far back to backfill from. ignored when resuming",
+			Value: peruse.DefaultBackfillSince,
+		},
+		&cli.Float64Flag{
+			Name:  "rate",
+			Usage: "most posts per second to run through NER and the feed's rules. 0 for no limit",
+			Value: peruse.DefaultBackfillRate,
+		},
+		&cli.IntFlag{
+			Name:  "batch-size",
+			Usage: "posts to read from clickhouse at a time. progress is saved after each batch",
+			Value: peruse.DefaultBackfillBatchSize,
+		},
+		&cli.StringFlag{
+			Name:  "state-file",
+			Usage: "file to save progress to and resume from. defaults to backfill-<feed>.json",
+		},
+	),
+	Action: func(cmd *cli.Context) error {
+		ctx, cancel := signal.NotifyContext(cmd.Context, os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+		args, err := serverArgs(cmd, logger)
+		if err != nil {
+			return err
+		}
+
+		server, err := peruse.NewServer(args)
+		if err != nil {
+			return err
+		}
+
+		stateFile := cmd.String("state-file")
+		if stateFile == "" {
+			stateFile = fmt.Sprintf("backfill-%s.json", cmd.String("feed"))
+		}
+
+		processed, err := server.Backfill(ctx, peruse.BackfillArgs{
+			Feed:      cmd.String("feed"),
+			Since:     cmd.Duration("since"),
+			Rate:      cmd.Float64("rate"),
+			BatchSize: cmd.Int("batch-size"),
+			StateFile: stateFile,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				fmt.Printf("interrupted after %d posts, run again to resume from %s\n", processed, stateFile)
+				return nil
+			}
+			return err
+		}
+
+		fmt.Printf("backfilled %s from %d posts\n", cmd.String("feed"), processed)
+		return nil
+	},
+}
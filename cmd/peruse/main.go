@@ -2,12 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/haileyok/peruse/peruse"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli/v2"
 
 	"net/http"
@@ -18,89 +24,334 @@ import (
 
 func main() {
 	app := cli.App{
-		Name: "peruse",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:    "http-addr",
-				EnvVars: []string{"PERUSE_HTTP_ADDR"},
-			},
-			&cli.StringFlag{
-				Name:     "clickhouse-addr",
-				EnvVars:  []string{"PERUSE_CLICKHOUSE_ADDR"},
-				Required: true,
-			},
-			&cli.StringFlag{
-				Name:     "clickhouse-database",
-				EnvVars:  []string{"PERUSE_CLICKHOUSE_DATABASE"},
-				Required: true,
-			},
-			&cli.StringFlag{
-				Name:     "clickhouse-user",
-				EnvVars:  []string{"PERUSE_CLICKHOUSE_USER"},
-				Required: true,
-			},
-			&cli.StringFlag{
-				Name:     "clickhouse-pass",
-				EnvVars:  []string{"PERUSE_CLICKHOUSE_PASS"},
-				Required: true,
-			},
-			&cli.StringFlag{
-				Name:    "pprof-addr",
-				EnvVars: []string{"PERUSE_PPROF_ADDR"},
-				Value:   ":10390",
-			},
-			&cli.StringFlag{
-				Name:     "feed-owner-did",
-				EnvVars:  []string{"PERUSE_FEED_OWNER_DID"},
-				Required: true,
-			},
-			&cli.StringFlag{
-				Name:     "service-did",
-				EnvVars:  []string{"PERUSE_SERVICE_DID"},
-				Required: true,
-			},
-			&cli.StringFlag{
-				Name:     "service-endpoint",
-				EnvVars:  []string{"PERUSE_SERVICE_ENDPOINT"},
-				Required: true,
-			},
-			&cli.StringFlag{
-				Name:     "chrono-feed-rkey",
-				EnvVars:  []string{"PERUSE_CHRONO_FEED_RKEY"},
-				Required: true,
-			},
-			&cli.StringFlag{
-				Name:     "suggested-follows-rkey",
-				EnvVars:  []string{"PERUSE_SUGGESTED_FOLLOWS_RKEY"},
-				Required: true,
-			},
-			&cli.StringFlag{
-				Name:     "nervana-endpoint",
-				EnvVars:  []string{"PERUSE_NERVANA_ENDPOINT"},
-				Required: true,
-			},
-			&cli.StringFlag{
-				Name:     "nervana-api-key",
-				EnvVars:  []string{"PERUSE_NERVANA_API_KEY"},
-				Required: true,
-			},
-			&cli.StringFlag{
-				Name:    "relay-host",
-				EnvVars: []string{"PERUSE_RELAY_HOST"},
-				Value:   "wss://bsky.network",
-			},
-			&cli.StringFlag{
-				Name:     "cursor-file",
-				EnvVars:  []string{"PERUSE_CURSOR_FILE"},
-				Required: true,
+		Name:           "peruse",
+		DefaultCommand: "run",
+		Commands: []*cli.Command{
+			{
+				Name:   "run",
+				Usage:  "run the feed generator",
+				Flags:  append(clickhouseFlags(false), runFlags...),
+				Action: run,
 			},
+			moderationCommand,
+			recordCommand,
+			migrateCommand,
+			backfillCommand,
 		},
-		Action: run,
 	}
 
 	app.Run(os.Args)
 }
 
+// clickhouseFlags are the connection flags for commands that use clickhouse. run only needs them with the clickhouse
+// store, which the server checks itself.
+func clickhouseFlags(required bool) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "clickhouse-addr",
+			EnvVars:  []string{"PERUSE_CLICKHOUSE_ADDR"},
+			Required: required,
+		},
+		&cli.StringFlag{
+			Name:     "clickhouse-database",
+			EnvVars:  []string{"PERUSE_CLICKHOUSE_DATABASE"},
+			Required: required,
+		},
+		&cli.StringFlag{
+			Name:     "clickhouse-user",
+			EnvVars:  []string{"PERUSE_CLICKHOUSE_USER"},
+			Required: required,
+		},
+		&cli.StringFlag{
+			Name:     "clickhouse-pass",
+			EnvVars:  []string{"PERUSE_CLICKHOUSE_PASS"},
+			Required: required,
+		},
+	}
+}
+
+var runFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "http-addr",
+		EnvVars: []string{"PERUSE_HTTP_ADDR"},
+	},
+	&cli.StringFlag{
+		Name:    "pprof-addr",
+		Usage:   "address to serve pprof and prometheus metrics (at /metrics) on",
+		EnvVars: []string{"PERUSE_PPROF_ADDR"},
+		Value:   ":10390",
+	},
+	&cli.StringFlag{
+		Name:     "feed-owner-did",
+		EnvVars:  []string{"PERUSE_FEED_OWNER_DID"},
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:     "service-did",
+		EnvVars:  []string{"PERUSE_SERVICE_DID"},
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:     "service-endpoint",
+		EnvVars:  []string{"PERUSE_SERVICE_ENDPOINT"},
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:     "chrono-feed-rkey",
+		EnvVars:  []string{"PERUSE_CHRONO_FEED_RKEY"},
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:     "suggested-follows-rkey",
+		EnvVars:  []string{"PERUSE_SUGGESTED_FOLLOWS_RKEY"},
+		Required: true,
+	},
+	&cli.BoolFlag{
+		Name:    "chrono-feed-include-reposts",
+		EnvVars: []string{"PERUSE_CHRONO_FEED_INCLUDE_REPOSTS"},
+	},
+	&cli.StringFlag{
+		Name:    "close-by-ranked-rkey",
+		EnvVars: []string{"PERUSE_CLOSE_BY_RANKED_RKEY"},
+	},
+	&cli.BoolFlag{
+		Name:    "suggested-follows-page",
+		Usage:   "serve the html suggested follows page at /api/getSuggestedFollows",
+		EnvVars: []string{"PERUSE_SUGGESTED_FOLLOWS_PAGE"},
+		Value:   true,
+	},
+	&cli.StringFlag{
+		Name:     "nervana-endpoint",
+		EnvVars:  []string{"PERUSE_NERVANA_ENDPOINT"},
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:     "nervana-api-key",
+		EnvVars:  []string{"PERUSE_NERVANA_API_KEY"},
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:    "relay-host",
+		EnvVars: []string{"PERUSE_RELAY_HOST"},
+		Value:   "wss://bsky.network",
+	},
+	&cli.StringFlag{
+		Name:    "plc-url",
+		EnvVars: []string{"PERUSE_PLC_URL"},
+		Value:   peruse.DefaultPlcUrl,
+	},
+	&cli.Float64Flag{
+		Name:    "plc-rate-limit",
+		Usage:   "maximum requests per second made to the plc directory",
+		EnvVars: []string{"PERUSE_PLC_RATE_LIMIT"},
+		Value:   peruse.DefaultPlcRateLimit,
+	},
+	&cli.DurationFlag{
+		Name:    "identity-timeout",
+		Usage:   "timeout for did and handle resolution requests",
+		EnvVars: []string{"PERUSE_IDENTITY_TIMEOUT"},
+		Value:   5 * time.Second,
+	},
+	&cli.DurationFlag{
+		Name:    "jwt-leeway",
+		Usage:   "allowed clock skew when validating service auth token expiry",
+		EnvVars: []string{"PERUSE_JWT_LEEWAY"},
+		Value:   peruse.DefaultJwtLeeway,
+	},
+	&cli.BoolFlag{
+		Name:    "jwt-replay-protection",
+		Usage:   "reject service auth tokens whose jti has already been seen",
+		EnvVars: []string{"PERUSE_JWT_REPLAY_PROTECTION"},
+	},
+	&cli.DurationFlag{
+		Name:    "key-cache-ttl",
+		Usage:   "how long service auth signing keys are cached before being looked up again",
+		EnvVars: []string{"PERUSE_KEY_CACHE_TTL"},
+		Value:   peruse.DefaultKeyCacheTTL,
+	},
+	&cli.StringSliceFlag{
+		Name:    "rate-limit",
+		Usage:   "override a route's rate limit budget, as route=rate:burst (e.g. getFeedSkeleton=5:20)",
+		EnvVars: []string{"PERUSE_RATE_LIMITS"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "trusted-proxies",
+		Usage:   "addresses or cidr ranges of proxies whose X-Forwarded-For header is trusted for the client ip that anonymous requests are rate limited by",
+		EnvVars: []string{"PERUSE_TRUSTED_PROXIES"},
+	},
+	&cli.StringFlag{
+		Name:    "admin-addr",
+		Usage:   "address to serve the admin api on. the admin api is disabled if unset",
+		EnvVars: []string{"PERUSE_ADMIN_ADDR"},
+	},
+	&cli.StringFlag{
+		Name:    "admin-token",
+		Usage:   "bearer token required for the admin api",
+		EnvVars: []string{"PERUSE_ADMIN_TOKEN"},
+	},
+	&cli.StringFlag{
+		Name:    "labeler-host",
+		Usage:   "labeler to subscribe to for labels that exclude content from feeds, e.g. wss://mod.bsky.app. labels are ignored if unset",
+		EnvVars: []string{"PERUSE_LABELER_HOST"},
+	},
+	&cli.StringFlag{
+		Name:    "labeler-did",
+		Usage:   "did of the labeler. labels from any other source are dropped",
+		EnvVars: []string{"PERUSE_LABELER_DID"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "excluded-labels",
+		Usage:   "labels that exclude a post or its author from feeds without their own policy",
+		EnvVars: []string{"PERUSE_EXCLUDED_LABELS"},
+		Value:   cli.NewStringSlice(peruse.DefaultExcludedLabels...),
+	},
+	&cli.IntFlag{
+		Name:    "max-label-subjects",
+		Usage:   "maximum number of labeled posts and accounts kept in memory. labels for others are dropped once reached",
+		EnvVars: []string{"PERUSE_MAX_LABEL_SUBJECTS"},
+		Value:   peruse.DefaultMaxLabelSubjects,
+	},
+	&cli.StringSliceFlag{
+		Name:    "feed-languages",
+		Usage:   "restrict a feed to posts in the given languages, as feed=lang|lang (e.g. seattle=en|es)",
+		EnvVars: []string{"PERUSE_FEED_LANGUAGES"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "feed-post-options",
+		Usage:   "which replies and quotes a feed considers, as feed=key:value,... with keys replies (none, root or all), min-root-likes and quotes (e.g. seattle=replies:root,min-root-likes:10)",
+		EnvVars: []string{"PERUSE_FEED_POST_OPTIONS"},
+	},
+	&cli.BoolFlag{
+		Name:    "ner-on-replies",
+		Usage:   "send replies to nervana as well as top level posts. required for feeds that include replies",
+		EnvVars: []string{"PERUSE_NER_ON_REPLIES"},
+	},
+	&cli.StringFlag{
+		Name:    "rule-feeds-file",
+		Usage:   "path to a json file with an array of rule feed definitions ({name, table, hashtags, domains, mentions, patterns})",
+		EnvVars: []string{"PERUSE_RULE_FEEDS_FILE"},
+	},
+	&cli.StringFlag{
+		Name:    "composite-feeds-file",
+		Usage:   "path to a json file with an array of composite feed definitions ({name, expr}), e.g. {\"name\": \"pnw\", \"expr\": \"seattle union (software intersect seattle)\"}",
+		EnvVars: []string{"PERUSE_COMPOSITE_FEEDS_FILE"},
+	},
+	&cli.StringFlag{
+		Name:    "trending-backend",
+		Usage:   "where entity mentions are counted for /api/trending: clickhouse, memory (an approximate in memory sketch) or none. defaults to clickhouse with the clickhouse store and memory otherwise",
+		EnvVars: []string{"PERUSE_TRENDING_BACKEND"},
+	},
+	&cli.StringFlag{
+		Name:    "store",
+		Usage:   "where feeds, moderation and labels are kept, and posts and the social graph are read from: clickhouse, or memory for small instances without clickhouse",
+		EnvVars: []string{"PERUSE_STORE"},
+		Value:   peruse.StoreBackendClickhouse,
+	},
+	&cli.DurationFlag{
+		Name:    "memory-store-retention",
+		Usage:   "how long the memory store keeps posts, interactions and follows",
+		EnvVars: []string{"PERUSE_MEMORY_STORE_RETENTION"},
+		Value:   peruse.DefaultMemoryStoreRetention,
+	},
+	&cli.IntFlag{
+		Name:    "memory-store-max-records",
+		Usage:   "how many rows the memory store keeps, across posts, interactions, follows, feed posts and labels, before it drops new ones until old ones are pruned",
+		EnvVars: []string{"PERUSE_MEMORY_STORE_MAX_RECORDS"},
+		Value:   peruse.DefaultMemoryStoreMaxRecords,
+	},
+	&cli.IntFlag{
+		Name:    "feed-insert-batch-size",
+		Usage:   "how many feed posts, across all feeds, are queued before they are written to clickhouse early",
+		EnvVars: []string{"PERUSE_FEED_INSERT_BATCH_SIZE"},
+		Value:   peruse.DefaultFeedInsertBatchSize,
+	},
+	&cli.DurationFlag{
+		Name:    "feed-insert-flush-interval",
+		Usage:   "the longest a feed post waits to be written to clickhouse",
+		EnvVars: []string{"PERUSE_FEED_INSERT_FLUSH_INTERVAL"},
+		Value:   peruse.DefaultFeedInsertFlushInterval,
+	},
+	&cli.DurationFlag{
+		Name:    "feed-insert-flush-timeout",
+		Usage:   "how long a write of queued feed posts to clickhouse may take before it is given up on",
+		EnvVars: []string{"PERUSE_FEED_INSERT_FLUSH_TIMEOUT"},
+		Value:   peruse.DefaultFeedInsertFlushTimeout,
+	},
+	&cli.IntFlag{
+		Name:    "feed-insert-max-queued",
+		Usage:   "how many feed posts may wait to be written to clickhouse before new ones are dropped",
+		EnvVars: []string{"PERUSE_FEED_INSERT_MAX_QUEUED"},
+		Value:   peruse.DefaultFeedInsertMaxQueued,
+	},
+	&cli.IntFlag{
+		Name:    "entity-feed-min-posts",
+		Usage:   "how many ranked posts an entity needs before its entity-<id> feed is served",
+		EnvVars: []string{"PERUSE_ENTITY_FEED_MIN_POSTS"},
+		Value:   peruse.DefaultEntityFeedMinPosts,
+	},
+	&cli.StringSliceFlag{
+		Name:    "feed-excluded-labels",
+		Usage:   "override the excluded labels for a feed, as feed=label|label (e.g. software=spam|!hide)",
+		EnvVars: []string{"PERUSE_FEED_EXCLUDED_LABELS"},
+	},
+	&cli.StringFlag{
+		Name:     "cursor-file",
+		EnvVars:  []string{"PERUSE_CURSOR_FILE"},
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:    "replay-file",
+		Usage:   "consume a recording made with `peruse record` instead of the relay",
+		EnvVars: []string{"PERUSE_REPLAY_FILE"},
+	},
+	&cli.Float64Flag{
+		Name:    "replay-speed",
+		Usage:   "how much faster than recorded to replay. 0 replays as fast as possible",
+		EnvVars: []string{"PERUSE_REPLAY_SPEED"},
+		Value:   0,
+	},
+	&cli.StringFlag{
+		Name:    "ner-responses",
+		Usage:   "answer ner requests from a json file of recorded nervana responses keyed by text, instead of calling nervana",
+		EnvVars: []string{"PERUSE_NER_RESPONSES"},
+	},
+	&cli.Uint64Flag{
+		Name:    "close-by-existing-connection-weight",
+		EnvVars: []string{"PERUSE_CLOSE_BY_EXISTING_CONNECTION_WEIGHT"},
+		Value:   peruse.CloseByExistingConnectionWeight,
+	},
+	&cli.Uint64Flag{
+		Name:    "close-by-new-discovery-weight",
+		EnvVars: []string{"PERUSE_CLOSE_BY_NEW_DISCOVERY_WEIGHT"},
+		Value:   peruse.NewDiscoveryWeight,
+	},
+	&cli.Uint64Flag{
+		Name:    "close-by-top-mutual-limit",
+		EnvVars: []string{"PERUSE_CLOSE_BY_TOP_MUTUAL_LIMIT"},
+		Value:   peruse.TopMutualLimit,
+	},
+	&cli.DurationFlag{
+		Name:    "close-by-timeframe",
+		EnvVars: []string{"PERUSE_CLOSE_BY_TIMEFRAME"},
+		Value:   peruse.CloseByTimeframe,
+	},
+	&cli.IntFlag{
+		Name:    "close-by-mix-posts-per-author",
+		EnvVars: []string{"PERUSE_CLOSE_BY_MIX_POSTS_PER_AUTHOR"},
+		Value:   peruse.CloseByMixPostsPerAuthor,
+	},
+	&cli.IntFlag{
+		Name:    "close-by-mix-existing-ratio",
+		EnvVars: []string{"PERUSE_CLOSE_BY_MIX_EXISTING_RATIO"},
+		Value:   peruse.CloseByMixExistingRatio,
+	},
+	&cli.IntFlag{
+		Name:    "close-by-mix-discovery-ratio",
+		EnvVars: []string{"PERUSE_CLOSE_BY_MIX_DISCOVERY_RATIO"},
+		Value:   peruse.CloseByMixDiscoveryRatio,
+	},
+}
+
 var run = func(cmd *cli.Context) error {
 	ctx := cmd.Context
 	ctx, cancel := context.WithCancel(ctx)
@@ -110,23 +361,12 @@ var run = func(cmd *cli.Context) error {
 		Level: slog.LevelDebug,
 	}))
 
-	server, err := peruse.NewServer(peruse.ServerArgs{
-		HttpAddr:             cmd.String("http-addr"),
-		ClickhouseAddr:       cmd.String("clickhouse-addr"),
-		ClickhouseDatabase:   cmd.String("clickhouse-database"),
-		ClickhouseUser:       cmd.String("clickhouse-user"),
-		ClickhousePass:       cmd.String("clickhouse-pass"),
-		Logger:               logger,
-		FeedOwnerDid:         cmd.String("feed-owner-did"),
-		ServiceDid:           cmd.String("service-did"),
-		ServiceEndpoint:      cmd.String("service-endpoint"),
-		ChronoFeedRkey:       cmd.String("chrono-feed-rkey"),
-		SuggestedFollowsRkey: cmd.String("suggested-follows-rkey"),
-		NervanaEndpoint:      cmd.String("nervana-endpoint"),
-		NervanaApiKey:        cmd.String("nervana-api-key"),
-		RelayHost:            cmd.String("relay-host"),
-		CursorFile:           cmd.String("cursor-file"),
-	})
+	args, err := serverArgs(cmd, logger)
+	if err != nil {
+		return err
+	}
+
+	server, err := peruse.NewServer(args)
 	if err != nil {
 		logger.Error("error creating server", "error", err)
 		return err
@@ -142,6 +382,8 @@ var run = func(cmd *cli.Context) error {
 		cancel()
 	}()
 
+	http.Handle("/metrics", promhttp.Handler())
+
 	go func() {
 		if err := http.ListenAndServe(cmd.String("pprof-addr"), nil); err != nil {
 			logger.Error("error starting pprof", "error", err)
@@ -154,3 +396,152 @@ var run = func(cmd *cli.Context) error {
 
 	return nil
 }
+
+// serverArgs builds the server's args from runFlags, for the commands that create a server
+func serverArgs(cmd *cli.Context, logger *slog.Logger) (peruse.ServerArgs, error) {
+	rateLimits := map[string]peruse.RateLimit{}
+	for _, override := range cmd.StringSlice("rate-limit") {
+		route, rl, err := peruse.ParseRateLimitOverride(override)
+		if err != nil {
+			return peruse.ServerArgs{}, err
+		}
+		rateLimits[route] = rl
+	}
+
+	feedExcludedLabels := map[string][]string{}
+	for _, policy := range cmd.StringSlice("feed-excluded-labels") {
+		feed, labels, err := peruse.ParseFeedExcludedLabels(policy)
+		if err != nil {
+			return peruse.ServerArgs{}, err
+		}
+		feedExcludedLabels[feed] = labels
+	}
+
+	feedLanguages := map[string][]string{}
+	for _, list := range cmd.StringSlice("feed-languages") {
+		feed, langs, err := peruse.ParseFeedLanguages(list)
+		if err != nil {
+			return peruse.ServerArgs{}, err
+		}
+		feedLanguages[feed] = langs
+	}
+
+	feedPostOptions := map[string]peruse.FeedPostOptions{}
+	for _, opts := range cmd.StringSlice("feed-post-options") {
+		feed, postOptions, err := peruse.ParseFeedPostOptions(opts)
+		if err != nil {
+			return peruse.ServerArgs{}, err
+		}
+		feedPostOptions[feed] = postOptions
+	}
+
+	ruleFeeds, err := loadRuleFeeds(cmd.String("rule-feeds-file"))
+	if err != nil {
+		return peruse.ServerArgs{}, err
+	}
+
+	var compositeFeeds []peruse.CompositeFeedConfig
+	if path := cmd.String("composite-feeds-file"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return peruse.ServerArgs{}, fmt.Errorf("failed to read composite feeds file: %w", err)
+		}
+		if err := json.Unmarshal(b, &compositeFeeds); err != nil {
+			return peruse.ServerArgs{}, fmt.Errorf("failed to parse composite feeds file: %w", err)
+		}
+	}
+
+	return peruse.ServerArgs{
+		HttpAddr:                 cmd.String("http-addr"),
+		ClickhouseAddr:           cmd.String("clickhouse-addr"),
+		ClickhouseDatabase:       cmd.String("clickhouse-database"),
+		ClickhouseUser:           cmd.String("clickhouse-user"),
+		ClickhousePass:           cmd.String("clickhouse-pass"),
+		Logger:                   logger,
+		FeedOwnerDid:             cmd.String("feed-owner-did"),
+		ServiceDid:               cmd.String("service-did"),
+		ServiceEndpoint:          cmd.String("service-endpoint"),
+		ChronoFeedRkey:           cmd.String("chrono-feed-rkey"),
+		SuggestedFollowsRkey:     cmd.String("suggested-follows-rkey"),
+		CloseByRankedRkey:        cmd.String("close-by-ranked-rkey"),
+		ChronoFeedIncludeReposts: cmd.Bool("chrono-feed-include-reposts"),
+		SuggestedFollowsPage:     cmd.Bool("suggested-follows-page"),
+		NervanaEndpoint:          cmd.String("nervana-endpoint"),
+		NervanaApiKey:            cmd.String("nervana-api-key"),
+		RelayHost:                cmd.String("relay-host"),
+		CursorFile:               cmd.String("cursor-file"),
+		CloseByParams: peruse.CloseByParams{
+			ExistingConnectionWeight: cmd.Uint64("close-by-existing-connection-weight"),
+			NewDiscoveryWeight:       cmd.Uint64("close-by-new-discovery-weight"),
+			TopMutualLimit:           cmd.Uint64("close-by-top-mutual-limit"),
+			Timeframe:                cmd.Duration("close-by-timeframe"),
+		},
+		CloseByMixParams: peruse.CloseByMixParams{
+			PostsPerAuthor: cmd.Int("close-by-mix-posts-per-author"),
+			ExistingRatio:  cmd.Int("close-by-mix-existing-ratio"),
+			DiscoveryRatio: cmd.Int("close-by-mix-discovery-ratio"),
+		},
+		PlcUrl:                cmd.String("plc-url"),
+		PlcRateLimit:          cmd.Float64("plc-rate-limit"),
+		IdentityTimeout:       cmd.Duration("identity-timeout"),
+		JwtLeeway:             cmd.Duration("jwt-leeway"),
+		JwtReplayProtection:   cmd.Bool("jwt-replay-protection"),
+		KeyCacheTTL:           cmd.Duration("key-cache-ttl"),
+		RateLimits:            rateLimits,
+		TrustedProxies:        cmd.StringSlice("trusted-proxies"),
+		AdminAddr:             cmd.String("admin-addr"),
+		AdminToken:            cmd.String("admin-token"),
+		LabelerHost:           cmd.String("labeler-host"),
+		LabelerDid:            cmd.String("labeler-did"),
+		MaxLabelSubjects:      cmd.Int("max-label-subjects"),
+		ExcludedLabels:        cmd.StringSlice("excluded-labels"),
+		FeedExcludedLabels:    feedExcludedLabels,
+		FeedLanguages:         feedLanguages,
+		FeedPostOptions:       feedPostOptions,
+		NerOnReplies:          cmd.Bool("ner-on-replies"),
+		RuleFeeds:             ruleFeeds,
+		CompositeFeeds:        compositeFeeds,
+		TrendingBackend:       cmd.String("trending-backend"),
+		EntityFeedMinPosts:    cmd.Int("entity-feed-min-posts"),
+		ReplayFile:            cmd.String("replay-file"),
+		ReplaySpeed:           cmd.Float64("replay-speed"),
+		NerResponsesFile:      cmd.String("ner-responses"),
+		StoreBackend:          cmd.String("store"),
+		MemoryStoreRetention:  cmd.Duration("memory-store-retention"),
+		MemoryStoreMaxRecords: cmd.Int("memory-store-max-records"),
+		FeedInsert: peruse.FeedInsertConfig{
+			BatchSize:     cmd.Int("feed-insert-batch-size"),
+			FlushInterval: cmd.Duration("feed-insert-flush-interval"),
+			FlushTimeout:  cmd.Duration("feed-insert-flush-timeout"),
+			MaxQueued:     cmd.Int("feed-insert-max-queued"),
+		},
+	}, nil
+}
+
+func loadRuleFeeds(path string) ([]peruse.RuleFeedConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rule feeds file: %w", err)
+	}
+
+	var ruleFeeds []peruse.RuleFeedConfig
+	if err := json.Unmarshal(b, &ruleFeeds); err != nil {
+		return nil, fmt.Errorf("failed to parse rule feeds file: %w", err)
+	}
+	return ruleFeeds, nil
+}
+
+func openClickhouse(cmd *cli.Context) (driver.Conn, error) {
+	return clickhouse.Open(&clickhouse.Options{
+		Addr: []string{cmd.String("clickhouse-addr")},
+		Auth: clickhouse.Auth{
+			Database: cmd.String("clickhouse-database"),
+			Username: cmd.String("clickhouse-user"),
+			Password: cmd.String("clickhouse-pass"),
+		},
+	})
+}
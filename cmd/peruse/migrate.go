@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/haileyok/peruse/peruse"
+	"github.com/urfave/cli/v2"
+)
+
+var migrateCommand = &cli.Command{
+	Name:  "migrate",
+	Usage: "create and update the clickhouse tables peruse writes to, including each feed's table",
+	Flags: append(clickhouseFlags(true),
+		&cli.StringFlag{
+			Name:    "rule-feeds-file",
+			Usage:   "rule feeds file the server runs with, so that their tables are migrated too",
+			EnvVars: []string{"PERUSE_RULE_FEEDS_FILE"},
+		},
+		&cli.BoolFlag{
+			Name:  "status",
+			Usage: "list pending migrations without applying them",
+		},
+	),
+	Action: func(cmd *cli.Context) error {
+		ruleFeeds, err := loadRuleFeeds(cmd.String("rule-feeds-file"))
+		if err != nil {
+			return err
+		}
+
+		conn, err := openClickhouse(cmd)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		m := peruse.NewMigrator(conn, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+		feedTables := peruse.FeedTables(ruleFeeds)
+
+		if !cmd.Bool("status") {
+			n, err := m.Migrate(cmd.Context, feedTables)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("applied %d migrations\n", n)
+			return nil
+		}
+
+		scopes := map[string][]peruse.Migration{"": peruse.Migrations}
+		order := []string{""}
+		for _, table := range feedTables {
+			migrations, err := peruse.FeedTableMigrations(table)
+			if err != nil {
+				return err
+			}
+			scopes[table] = migrations
+			order = append(order, table)
+		}
+
+		total := 0
+		for _, scope := range order {
+			pending, err := m.Pending(cmd.Context, scope, scopes[scope])
+			if err != nil {
+				return err
+			}
+			name := scope
+			if name == "" {
+				name = "shared tables"
+			}
+			for _, mig := range pending {
+				fmt.Printf("%s: %d %s\n", name, mig.Version, mig.Name)
+			}
+			total += len(pending)
+		}
+
+		fmt.Printf("%d pending migrations\n", total)
+		return nil
+	},
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/haileyok/peruse/peruse"
+	"github.com/urfave/cli/v2"
+)
+
+var moderationCommand = &cli.Command{
+	Name:  "moderation",
+	Usage: "manage banned dids and post uris",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "ban",
+			Usage:     "ban a did or post uri from a feed, or from every feed",
+			ArgsUsage: "<did|at-uri>",
+			Flags: append(clickhouseFlags(true),
+				&cli.StringFlag{
+					Name:  "feed",
+					Usage: "feed to ban the subject from. bans from every feed if unset",
+				},
+				&cli.StringFlag{
+					Name:  "reason",
+					Usage: "why the subject is being banned",
+				},
+			),
+			Action: func(cmd *cli.Context) error {
+				if cmd.Args().Len() != 1 {
+					return fmt.Errorf("expected a single did or at-uri to ban")
+				}
+
+				ms, err := newModerationStore(cmd)
+				if err != nil {
+					return err
+				}
+
+				entry, err := ms.Ban(cmd.Context, cmd.Args().First(), cmd.String("feed"), cmd.String("reason"))
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("banned %s from %s\n", entry.Subject, feedDisplayName(entry.Feed))
+				return nil
+			},
+		},
+		{
+			Name:      "unban",
+			Usage:     "remove a ban",
+			ArgsUsage: "<did|at-uri>",
+			Flags: append(clickhouseFlags(true),
+				&cli.StringFlag{
+					Name:  "feed",
+					Usage: "feed the subject was banned from. leave unset for global bans",
+				},
+			),
+			Action: func(cmd *cli.Context) error {
+				if cmd.Args().Len() != 1 {
+					return fmt.Errorf("expected a single did or at-uri to unban")
+				}
+
+				ms, err := newModerationStore(cmd)
+				if err != nil {
+					return err
+				}
+
+				if err := ms.Unban(cmd.Context, cmd.Args().First(), cmd.String("feed")); err != nil {
+					return err
+				}
+
+				fmt.Printf("unbanned %s from %s\n", cmd.Args().First(), feedDisplayName(cmd.String("feed")))
+				return nil
+			},
+		},
+		{
+			Name:  "list",
+			Usage: "list current bans",
+			Flags: clickhouseFlags(true),
+			Action: func(cmd *cli.Context) error {
+				ms, err := newModerationStore(cmd)
+				if err != nil {
+					return err
+				}
+
+				for _, e := range ms.List() {
+					fmt.Printf("%s\t%s\t%s\t%s\n", feedDisplayName(e.Feed), e.Subject, e.CreatedAt.Format("2006-01-02 15:04:05"), e.Reason)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+func newModerationStore(cmd *cli.Context) (*peruse.ModerationStore, error) {
+	conn, err := openClickhouse(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	store := peruse.NewClickhouseStore(conn, logger, peruse.FeedInsertConfig{})
+	if err := store.Init(cmd.Context); err != nil {
+		return nil, err
+	}
+
+	ms := peruse.NewModerationStore(store, logger)
+	if err := ms.Init(cmd.Context); err != nil {
+		return nil, err
+	}
+
+	return ms, nil
+}
+
+func feedDisplayName(feed string) string {
+	if feed == "" {
+		return "all feeds"
+	}
+	return feed
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/haileyok/peruse/peruse"
+	"github.com/urfave/cli/v2"
+)
+
+var recordCommand = &cli.Command{
+	Name:      "record",
+	Usage:     "record firehose commits to a file that can be replayed with run --replay-file",
+	ArgsUsage: "<out-file>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "relay-host",
+			EnvVars: []string{"PERUSE_RELAY_HOST"},
+			Value:   "wss://bsky.network",
+		},
+		&cli.StringFlag{
+			Name:  "cursor",
+			Usage: "sequence number to start recording from. starts from the live tip if unset",
+		},
+		&cli.DurationFlag{
+			Name:  "duration",
+			Usage: "stop recording after this long",
+		},
+		&cli.IntFlag{
+			Name:  "max-commits",
+			Usage: "stop recording after this many commits",
+		},
+	},
+	Action: func(cmd *cli.Context) error {
+		if cmd.Args().Len() != 1 {
+			return fmt.Errorf("expected a single file to record to")
+		}
+
+		if cmd.Duration("duration") == 0 && cmd.Int("max-commits") == 0 {
+			fmt.Println("recording until interrupted")
+		}
+
+		ctx, cancel := signal.NotifyContext(cmd.Context, os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		frames, err := peruse.RecordFirehose(ctx, peruse.RecordFirehoseArgs{
+			RelayHost: cmd.String("relay-host"),
+			Cursor:    cmd.String("cursor"),
+			Out:       cmd.Args().First(),
+			Duration:  cmd.Duration("duration"),
+			MaxFrames: cmd.Int("max-commits"),
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("recorded %d commits to %s\n", frames, cmd.Args().First())
+		return nil
+	},
+}
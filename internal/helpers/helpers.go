@@ -29,3 +29,31 @@ func ServerError(e echo.Context, error, msg string) error {
 
 	return e.JSON(500, resp)
 }
+
+func UnauthorizedError(e echo.Context, error, msg string) error {
+	if error == "" {
+		return e.NoContent(401)
+	}
+
+	resp := map[string]string{}
+	resp["error"] = error
+	if msg != "" {
+		resp["message"] = msg
+	}
+
+	return e.JSON(401, resp)
+}
+
+func RateLimitError(e echo.Context, error, msg string) error {
+	if error == "" {
+		return e.NoContent(429)
+	}
+
+	resp := map[string]string{}
+	resp["error"] = error
+	if msg != "" {
+		resp["message"] = msg
+	}
+
+	return e.JSON(429, resp)
+}
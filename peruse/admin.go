@@ -0,0 +1,53 @@
+package peruse
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/haileyok/peruse/internal/helpers"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	slogecho "github.com/samber/slog-echo"
+)
+
+// newAdminServer sets up the admin router on its own listener, so that it can be kept off the public interface
+func (s *Server) newAdminServer() *http.Server {
+	e := echo.New()
+	e.Use(middleware.RemoveTrailingSlash())
+	e.Use(slogecho.New(s.logger.With("component", "admin")))
+	e.Use(middleware.Recover())
+
+	g := e.Group("/admin", s.handleAdminAuthMiddleware)
+	g.GET("/feeds", s.handleAdminListFeeds)
+	g.POST("/feeds/:feed/refresh", s.handleAdminRefreshFeed)
+	g.GET("/firehose", s.handleAdminGetFirehose)
+	g.POST("/firehose/pause", s.handleAdminPauseFirehose)
+	g.POST("/firehose/resume", s.handleAdminResumeFirehose)
+	g.DELETE("/users/:did", s.handleAdminEvictUser)
+	g.PUT("/users/:did/closeByParams", s.handleAdminSetCloseByParams)
+	g.GET("/closeBy", s.handleGetCloseBy)
+	g.GET("/moderation", s.handleAdminListModeration)
+	g.POST("/moderation", s.handleAdminBan)
+	g.DELETE("/moderation", s.handleAdminUnban)
+	g.GET("/entityAliases", s.handleAdminListEntityAliases)
+	g.PUT("/entityAliases/:alias", s.handleAdminSetEntityAlias)
+	g.DELETE("/entityAliases/:alias", s.handleAdminDeleteEntityAlias)
+
+	return &http.Server{
+		Addr:    s.args.AdminAddr,
+		Handler: e,
+	}
+}
+
+func (s *Server) handleAdminAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(e echo.Context) error {
+		auth := e.Request().Header.Get("authorization")
+		tok, ok := strings.CutPrefix(auth, "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(tok), []byte(s.args.AdminToken)) != 1 {
+			return helpers.UnauthorizedError(e, "AuthRequired", "")
+		}
+
+		return next(e)
+	}
+}
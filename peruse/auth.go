@@ -5,6 +5,7 @@ import (
 	"crypto"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	atcrypto "github.com/bluesky-social/indigo/atproto/crypto"
@@ -21,7 +22,14 @@ func (s *Server) getKeyForDid(ctx context.Context, did syntax.DID) (crypto.Publi
 	return ident.PublicKey()
 }
 
-func (s *Server) fetchKeyFunc(ctx context.Context) func(tok *jwt.Token) (any, error) {
+// errKeyRefreshSkipped is returned by the key func when a refresh isn't allowed, so that the original signature error
+// is reported instead
+var errKeyRefreshSkipped = errors.New("signing key refresh skipped")
+
+// fetchKeyFunc returns the issuer's signing key, preferring the key cache, and reports through cached whether the key
+// came from the cache. When refresh is set, both the key cache and the directory's cached identity are purged first so
+// that a freshly rotated key is picked up.
+func (s *Server) fetchKeyFunc(ctx context.Context, refresh bool, cached *bool) func(tok *jwt.Token) (any, error) {
 	return func(tok *jwt.Token) (any, error) {
 		issuer, ok := tok.Claims.(jwt.MapClaims)["iss"].(string)
 		if !ok {
@@ -32,9 +40,24 @@ func (s *Server) fetchKeyFunc(ctx context.Context) func(tok *jwt.Token) (any, er
 			return nil, fmt.Errorf("invalid DID in 'iss' field from auth header JWT")
 		}
 
-		val, ok := s.keyCache.Get(did.String())
-		if ok {
-			return val, nil
+		if refresh {
+			if !s.allowKeyRefresh(did.String()) {
+				return nil, errKeyRefreshSkipped
+			}
+			s.keyCache.Remove(did.String())
+			if err := s.directory.Purge(ctx, did.AtIdentifier()); err != nil {
+				return nil, fmt.Errorf("failed to purge identity for DID (%q): %w", did, err)
+			}
+		} else {
+			val, ok := s.keyCache.Get(did.String())
+			if ok {
+				authKeyCacheLookups.WithLabelValues("hit").Inc()
+				if cached != nil {
+					*cached = true
+				}
+				return val, nil
+			}
+			authKeyCacheLookups.WithLabelValues("miss").Inc()
 		}
 
 		k, err := s.getKeyForDid(ctx, did)
@@ -46,18 +69,69 @@ func (s *Server) fetchKeyFunc(ctx context.Context) func(tok *jwt.Token) (any, er
 	}
 }
 
-func (s *Server) checkJwt(ctx context.Context, tok string) (string, error) {
+// allowKeyRefresh limits each did to one key refresh per KeyRefreshInterval. Anyone can send a token with a bad
+// signature and an arbitrary issuer, and each refresh is a plc lookup against the shared rate limit.
+func (s *Server) allowKeyRefresh(did string) bool {
+	s.keyRefreshMu.Lock()
+	defer s.keyRefreshMu.Unlock()
+
+	if s.keyRefreshes.Contains(did) {
+		return false
+	}
+	s.keyRefreshes.Add(did, struct{}{})
+	return true
+}
+
+const (
+	DefaultJwtLeeway   = 30 * time.Second
+	DefaultKeyCacheTTL = 6 * time.Hour
+	KeyRefreshInterval = time.Minute
+)
+
+// Errors returned when a service auth token is valid but not meant for us
+var (
+	ErrInvalidAudience = errors.New("service auth token has an invalid audience")
+	ErrInvalidLxm      = errors.New("service auth token has an invalid lexicon method")
+	ErrMissingJti      = errors.New("service auth token is missing a jti")
+	ErrReplayedJti     = errors.New("service auth token has already been used")
+)
+
+func (s *Server) checkJwt(ctx context.Context, tok string, lxm string) (string, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 
-	return s.checkJwtConfig(ctx, tok)
+	return s.checkJwtConfig(ctx, tok, lxm)
 }
 
-func (s *Server) checkJwtConfig(ctx context.Context, tok string, config ...jwt.ParserOption) (string, error) {
+// checkJwtConfig verifies a service auth token's signature against the issuer's signing key, and then checks that it
+// was minted for this service and the lexicon method being called. Tokens must carry an expiry, which is checked with
+// the configured leeway for clock skew.
+func (s *Server) checkJwtConfig(ctx context.Context, tok string, lxm string, config ...jwt.ParserOption) (string, error) {
 	validMethods := []string{SigningMethodES256K.Alg(), SigningMethodES256.Alg()}
-	config = append(config, jwt.WithValidMethods(validMethods))
+	config = append(config,
+		jwt.WithValidMethods(validMethods),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(s.args.JwtLeeway),
+	)
 	p := jwt.NewParser(config...)
-	t, err := p.Parse(tok, s.fetchKeyFunc(ctx))
+	var cached bool
+	t, err := p.Parse(tok, s.fetchKeyFunc(ctx, false, &cached))
+	if errors.Is(err, jwt.ErrTokenSignatureInvalid) && cached {
+		// the issuer may have rotated their signing key since we cached it, so try once more with a fresh key. keys that
+		// were just looked up are already fresh, so there is nothing to refresh.
+		refreshed, refreshErr := p.Parse(tok, s.fetchKeyFunc(ctx, true, nil))
+		switch {
+		case errors.Is(refreshErr, errKeyRefreshSkipped):
+			authKeyRefreshes.WithLabelValues("throttled").Inc()
+		case refreshErr != nil:
+			authKeyRefreshes.WithLabelValues("failed").Inc()
+			err = refreshErr
+		default:
+			authKeyRefreshes.WithLabelValues("ok").Inc()
+			t, err = refreshed, nil
+		}
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to parse auth header jwt: %w", err)
 	}
@@ -72,9 +146,55 @@ func (s *Server) checkJwtConfig(ctx context.Context, tok string, config ...jwt.P
 		return "", fmt.Errorf("no issuer present in returned claims")
 	}
 
+	if !s.isValidAudience(clms) {
+		return "", ErrInvalidAudience
+	}
+
+	if lxm != "" {
+		tokLxm, ok := clms["lxm"].(string)
+		if !ok || tokLxm != lxm {
+			return "", ErrInvalidLxm
+		}
+	}
+
+	if s.jtiCache != nil {
+		jti, ok := clms["jti"].(string)
+		if !ok || jti == "" {
+			return "", ErrMissingJti
+		}
+
+		exp, err := clms.GetExpirationTime()
+		if err != nil || exp == nil {
+			return "", fmt.Errorf("invalid expiry in auth header jwt")
+		}
+
+		// keep the jti around until the token could no longer be accepted anyway
+		seenUntil := exp.Add(s.args.JwtLeeway)
+		if prevUntil, seen, _ := s.jtiCache.PeekOrAdd(did+"::"+jti, seenUntil); seen && time.Now().Before(prevUntil) {
+			return "", ErrReplayedJti
+		}
+	}
+
 	return did, nil
 }
 
+// isValidAudience checks that the token's audience is our service did, optionally with a service fragment such as
+// `#bsky_fg` appended
+func (s *Server) isValidAudience(clms jwt.MapClaims) bool {
+	aud, err := clms.GetAudience()
+	if err != nil {
+		return false
+	}
+
+	for _, a := range aud {
+		if a == s.args.ServiceDid || strings.HasPrefix(a, s.args.ServiceDid+"#") {
+			return true
+		}
+	}
+
+	return false
+}
+
 // copied from Jaz's https://github.com/ericvolp12/jwt-go-secp256k1
 
 var (
@@ -0,0 +1,270 @@
+package peruse
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	atcrypto "github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/golang-jwt/jwt/v5"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+const (
+	testServiceDid = "did:web:feeds.example.com"
+	testIssuerDid  = "did:plc:testissuer0000000000000"
+	testLxm        = "app.bsky.feed.getFeedSkeleton"
+)
+
+type testSigner struct {
+	alg string
+	key atcrypto.PrivateKey
+}
+
+func newTestSigners(t *testing.T) []testSigner {
+	t.Helper()
+
+	p256, err := atcrypto.GeneratePrivateKeyP256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k256, err := atcrypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []testSigner{
+		{alg: SigningMethodES256.Alg(), key: p256},
+		{alg: SigningMethodES256K.Alg(), key: k256},
+	}
+}
+
+// sign builds a compact jwt by hand, since the atproto signing methods only verify
+func (ts testSigner) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	signingString := enc(map[string]string{"alg": ts.alg, "typ": "JWT"}) + "." + enc(claims)
+	sig, err := ts.key.HashAndSign([]byte(signingString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingString + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newTestAuthServer(t *testing.T, key atcrypto.PrivateKey, replayProtection bool) *Server {
+	t.Helper()
+
+	pub, err := key.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:    syntax.DID(testIssuerDid),
+		Handle: syntax.HandleInvalid,
+		Keys: map[string]identity.VerificationMethod{
+			"atproto": {Type: "Multikey", PublicKeyMultibase: pub.Multibase()},
+		},
+	})
+
+	s := &Server{
+		args: &ServerArgs{
+			ServiceDid: testServiceDid,
+			JwtLeeway:  DefaultJwtLeeway,
+		},
+		keyCache:     expirable.NewLRU[string, crypto.PublicKey](100, nil, time.Hour),
+		keyRefreshes: expirable.NewLRU[string, struct{}](100, nil, KeyRefreshInterval),
+		directory:    &countingDirectory{Directory: &dir},
+	}
+	if replayProtection {
+		s.jtiCache, _ = lru.New[string, time.Time](100)
+	}
+	return s
+}
+
+func validClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss": testIssuerDid,
+		"aud": testServiceDid,
+		"lxm": testLxm,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Minute).Unix(),
+		"jti": "abc123",
+	}
+}
+
+func TestCheckJwtConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims func(c jwt.MapClaims)
+		// wantErr is nil for tokens that should be accepted. anyErr accepts any error.
+		wantErr error
+		anyErr  bool
+	}{
+		{name: "valid", claims: func(c jwt.MapClaims) {}},
+		{name: "aud with fragment", claims: func(c jwt.MapClaims) { c["aud"] = testServiceDid + "#bsky_fg" }},
+		{name: "aud of another service", claims: func(c jwt.MapClaims) { c["aud"] = "did:web:other.example.com" }, wantErr: ErrInvalidAudience},
+		{name: "aud sharing a prefix", claims: func(c jwt.MapClaims) { c["aud"] = testServiceDid + ".evil" }, wantErr: ErrInvalidAudience},
+		{name: "missing aud", claims: func(c jwt.MapClaims) { delete(c, "aud") }, wantErr: ErrInvalidAudience},
+		{name: "lxm mismatch", claims: func(c jwt.MapClaims) { c["lxm"] = "app.bsky.feed.getTimeline" }, wantErr: ErrInvalidLxm},
+		{name: "missing lxm", claims: func(c jwt.MapClaims) { delete(c, "lxm") }, wantErr: ErrInvalidLxm},
+		{name: "missing exp", claims: func(c jwt.MapClaims) { delete(c, "exp") }, wantErr: jwt.ErrTokenRequiredClaimMissing},
+		{name: "expired", claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, wantErr: jwt.ErrTokenExpired},
+		{name: "expired within leeway", claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-DefaultJwtLeeway / 2).Unix() }},
+		{name: "expired just past leeway", claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-2 * DefaultJwtLeeway).Unix() }, wantErr: jwt.ErrTokenExpired},
+		{name: "issued in the future", claims: func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Hour).Unix() }, wantErr: jwt.ErrTokenUsedBeforeIssued},
+		{name: "missing iss", claims: func(c jwt.MapClaims) { delete(c, "iss") }, anyErr: true},
+	}
+
+	for _, signer := range newTestSigners(t) {
+		for _, tt := range tests {
+			t.Run(signer.alg+"/"+tt.name, func(t *testing.T) {
+				s := newTestAuthServer(t, signer.key, false)
+
+				claims := validClaims()
+				tt.claims(claims)
+
+				did, err := s.checkJwtConfig(context.Background(), signer.sign(t, claims), testLxm)
+				switch {
+				case tt.anyErr:
+					if err == nil {
+						t.Fatal("expected an error")
+					}
+				case tt.wantErr != nil:
+					if !errors.Is(err, tt.wantErr) {
+						t.Fatalf("expected %v, got %v", tt.wantErr, err)
+					}
+				default:
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					if did != testIssuerDid {
+						t.Fatalf("expected did %s, got %s", testIssuerDid, did)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCheckJwtConfigWrongKey(t *testing.T) {
+	signers := newTestSigners(t)
+	for i, signer := range signers {
+		t.Run(signer.alg, func(t *testing.T) {
+			// the directory only knows the other signer's key, so the signature can never verify
+			s := newTestAuthServer(t, signers[(i+1)%len(signers)].key, false)
+
+			if _, err := s.checkJwtConfig(context.Background(), signer.sign(t, validClaims()), testLxm); err == nil {
+				t.Fatal("expected a token signed with the wrong key to be rejected")
+			}
+		})
+	}
+}
+
+func TestCheckJwtConfigReplay(t *testing.T) {
+	for _, signer := range newTestSigners(t) {
+		t.Run(signer.alg, func(t *testing.T) {
+			s := newTestAuthServer(t, signer.key, true)
+			ctx := context.Background()
+
+			tok := signer.sign(t, validClaims())
+			if _, err := s.checkJwtConfig(ctx, tok, testLxm); err != nil {
+				t.Fatalf("unexpected error on first use: %v", err)
+			}
+			if _, err := s.checkJwtConfig(ctx, tok, testLxm); !errors.Is(err, ErrReplayedJti) {
+				t.Fatalf("expected %v on replay, got %v", ErrReplayedJti, err)
+			}
+
+			other := validClaims()
+			other["jti"] = "def456"
+			if _, err := s.checkJwtConfig(ctx, signer.sign(t, other), testLxm); err != nil {
+				t.Fatalf("unexpected error for a different jti: %v", err)
+			}
+
+			missing := validClaims()
+			delete(missing, "jti")
+			if _, err := s.checkJwtConfig(ctx, signer.sign(t, missing), testLxm); !errors.Is(err, ErrMissingJti) {
+				t.Fatalf("expected %v, got %v", ErrMissingJti, err)
+			}
+		})
+	}
+}
+
+// countingDirectory counts did lookups, which are plc requests in production
+type countingDirectory struct {
+	identity.Directory
+	lookups int
+}
+
+func (d *countingDirectory) LookupDID(ctx context.Context, did syntax.DID) (*identity.Identity, error) {
+	d.lookups++
+	return d.Directory.LookupDID(ctx, did)
+}
+
+func TestCheckJwtConfigKeyRefresh(t *testing.T) {
+	signers := newTestSigners(t)
+	for i, signer := range signers {
+		t.Run(signer.alg, func(t *testing.T) {
+			ctx := context.Background()
+			s := newTestAuthServer(t, signer.key, false)
+			dir := s.directory.(*countingDirectory)
+
+			// a stale key from before the issuer rotated is cached, so the first failure refreshes it
+			stale, err := signers[(i+1)%len(signers)].key.PublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.keyCache.Add(testIssuerDid, stale)
+
+			if _, err := s.checkJwtConfig(ctx, signer.sign(t, validClaims()), testLxm); err != nil {
+				t.Fatalf("expected the token to verify after refreshing the key, got %v", err)
+			}
+			if dir.lookups != 1 {
+				t.Fatalf("expected 1 lookup, got %d", dir.lookups)
+			}
+
+			// a forged token for the same issuer can't force another refresh within the interval
+			forger := testSigner{alg: signer.alg, key: signers[(i+1)%len(signers)].key}
+			for range 3 {
+				if _, err := s.checkJwtConfig(ctx, forger.sign(t, validClaims()), testLxm); err == nil {
+					t.Fatal("expected the forged token to be rejected")
+				}
+			}
+			if dir.lookups != 1 {
+				t.Fatalf("expected refreshes to be throttled, got %d lookups", dir.lookups)
+			}
+		})
+	}
+}
+
+func TestCheckJwtConfigNoRefreshForUncachedKey(t *testing.T) {
+	signers := newTestSigners(t)
+	s := newTestAuthServer(t, signers[0].key, false)
+	dir := s.directory.(*countingDirectory)
+
+	// the key isn't cached, so the first lookup is already fresh and a bad signature doesn't trigger a second one
+	forger := testSigner{alg: signers[0].alg, key: signers[1].key}
+	if _, err := s.checkJwtConfig(context.Background(), forger.sign(t, validClaims()), testLxm); err == nil {
+		t.Fatal("expected the forged token to be rejected")
+	}
+	if dir.lookups != 1 {
+		t.Fatalf("expected 1 lookup, got %d", dir.lookups)
+	}
+}
@@ -0,0 +1,267 @@
+package peruse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/haileyok/peruse/wikidata"
+	"github.com/haileyok/photocopy/models"
+	"golang.org/x/time/rate"
+)
+
+const (
+	DefaultBackfillSince     = 48 * time.Hour
+	DefaultBackfillRate      = 20
+	DefaultBackfillBatchSize = 500
+)
+
+type BackfillArgs struct {
+	Feed string
+	// Since is how far back from now to start. It is ignored when resuming, so that a resumed backfill covers the same
+	// range it started with.
+	Since time.Duration
+	// Rate is the most posts per second that are run through the feed, which bounds the load on nervana. Zero means no
+	// limit.
+	Rate      float64
+	BatchSize int
+	// StateFile is where progress is saved after every batch. A backfill that finds a state file for the same feed
+	// resumes from it, and the file is removed once the backfill finishes.
+	StateFile string
+}
+
+// BackfillCursor is the last post a backfill got through. Posts are read in created_at and then uri order.
+type BackfillCursor struct {
+	CreatedAt time.Time `json:"createdAt"`
+	Uri       string    `json:"uri"`
+}
+
+type backfillState struct {
+	Feed      string         `json:"feed"`
+	Since     time.Time      `json:"since"`
+	Until     time.Time      `json:"until"`
+	Cursor    BackfillCursor `json:"cursor"`
+	Processed int            `json:"processed"`
+}
+
+// Backfill fills a topic feed from the top level posts photocopy has already stored, running each one through NER and
+// the feed's rules as if it had just come off the firehose. Matches are inserted with their original created_at. The
+// backfill stops at the feed's oldest post so that it doesn't overlap with what the live feed already inserted.
+// It returns how many posts were processed.
+func (s *Server) Backfill(ctx context.Context, args BackfillArgs) (int, error) {
+	cs, ok := s.store.(*ClickhouseStore)
+	if !ok {
+		return 0, fmt.Errorf("backfilling requires the clickhouse store")
+	}
+	defer s.close()
+
+	if args.BatchSize <= 0 {
+		args.BatchSize = DefaultBackfillBatchSize
+	}
+
+	// posts must be written before the state file says they were, so they wait for room rather than being dropped
+	cs.feedInsertConfig.BlockWhenFull = true
+
+	if err := s.setup(ctx); err != nil {
+		return 0, err
+	}
+
+	var feed Feed
+	var table string
+	var needsNer bool
+	switch f := s.feeds[args.Feed].(type) {
+	case *WikidataFeed:
+		feed, table, needsNer = f, f.tableName, true
+	case *RuleFeed:
+		feed, table = f, f.tableName
+	case nil:
+		return 0, fmt.Errorf("unknown feed %s", args.Feed)
+	default:
+		return 0, fmt.Errorf("feed %s isn't a topic feed and can't be backfilled", args.Feed)
+	}
+
+	state, err := loadBackfillState(args.StateFile, args.Feed)
+	if err != nil {
+		return 0, err
+	}
+	if state != nil {
+		s.logger.Info("resuming backfill", "feed", args.Feed, "cursor", state.Cursor.CreatedAt, "processed", state.Processed)
+	} else {
+		now := time.Now()
+		state = &backfillState{
+			Feed:  args.Feed,
+			Since: now.Add(-args.Since),
+			Until: now,
+		}
+
+		earliest, ok, err := cs.EarliestFeedPost(ctx, table)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get feed's earliest post: %w", err)
+		}
+		if ok && earliest.Before(state.Until) {
+			state.Until = earliest
+		}
+		state.Cursor.CreatedAt = state.Since
+	}
+
+	if !state.Until.After(state.Since) {
+		s.logger.Info("nothing to backfill, the feed already covers the range", "feed", args.Feed)
+		return 0, removeBackfillState(args.StateFile)
+	}
+
+	var limiter *rate.Limiter
+	if args.Rate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(args.Rate), 1)
+	}
+
+	s.logger.Info("starting backfill", "feed", args.Feed, "since", state.Since, "until", state.Until)
+
+	start := time.Now()
+	processedAtStart := state.Processed
+	for {
+		posts, err := cs.HistoricalPosts(ctx, state.Cursor, state.Until, args.BatchSize)
+		if err != nil {
+			return state.Processed, fmt.Errorf("failed to get historical posts: %w", err)
+		}
+		if len(posts) == 0 {
+			break
+		}
+
+		for _, p := range posts {
+			if limiter != nil {
+				if err := limiter.Wait(ctx); err != nil {
+					return state.Processed, err
+				}
+			}
+
+			post := backfillPost(p)
+
+			var nerItems []wikidata.EntityMatch
+			if needsNer {
+				nerItems = s.nerForPost(ctx, post)
+			}
+
+			if err := feed.OnPost(ctx, post, p.Uri, p.Did, p.Rkey, "", p.CreatedAt, nerItems); err != nil {
+				return state.Processed, fmt.Errorf("failed to backfill post %s: %w", p.Uri, err)
+			}
+
+			state.Cursor = BackfillCursor{CreatedAt: p.CreatedAt, Uri: p.Uri}
+			state.Processed++
+		}
+
+		if err := s.store.FlushFeedPosts(ctx); err != nil {
+			return state.Processed, fmt.Errorf("failed to write backfilled posts: %w", err)
+		}
+
+		if err := saveBackfillState(args.StateFile, state); err != nil {
+			return state.Processed, err
+		}
+
+		elapsed := time.Since(start)
+		s.logger.Info("backfill progress",
+			"feed", args.Feed,
+			"processed", state.Processed,
+			"cursor", state.Cursor.CreatedAt,
+			"percent", fmt.Sprintf("%.1f", 100*state.Cursor.CreatedAt.Sub(state.Since).Seconds()/state.Until.Sub(state.Since).Seconds()),
+			"posts_per_second", fmt.Sprintf("%.1f", float64(state.Processed-processedAtStart)/elapsed.Seconds()),
+		)
+	}
+
+	s.logger.Info("backfill finished", "feed", args.Feed, "processed", state.Processed, "took", time.Since(start))
+
+	return state.Processed, removeBackfillState(args.StateFile)
+}
+
+func loadBackfillState(path, feed string) (*backfillState, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backfill state: %w", err)
+	}
+
+	var state backfillState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse backfill state: %w", err)
+	}
+	if state.Feed != feed {
+		return nil, fmt.Errorf("backfill state file %s is for feed %s, not %s", path, state.Feed, feed)
+	}
+	return &state, nil
+}
+
+func saveBackfillState(path string, state *backfillState) error {
+	if path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// written to a temporary file first so that a backfill killed mid write can still be resumed
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("failed to write backfill state: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func removeBackfillState(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+var backfillHashtagRegex = regexp.MustCompile(`(?:^|\s)#([\p{L}\p{N}_]+)`)
+
+// backfillPost rebuilds as much of a post as photocopy keeps. Hashtag facets are parsed back out of the text, but
+// links, mentions and media aren't stored, so rule feeds only match historical posts by hashtag or pattern.
+func backfillPost(p models.Post) *bsky.FeedPost {
+	post := &bsky.FeedPost{
+		Text:      p.Text,
+		CreatedAt: p.CreatedAt.Format(time.RFC3339Nano),
+	}
+
+	if p.Lang != "" {
+		post.Langs = []string{p.Lang}
+	}
+
+	for _, loc := range backfillHashtagRegex.FindAllStringSubmatchIndex(p.Text, -1) {
+		post.Facets = append(post.Facets, &bsky.RichtextFacet{
+			Index: &bsky.RichtextFacet_ByteSlice{
+				ByteStart: int64(loc[2] - 1),
+				ByteEnd:   int64(loc[3]),
+			},
+			Features: []*bsky.RichtextFacet_Features_Elem{
+				{RichtextFacet_Tag: &bsky.RichtextFacet_Tag{Tag: p.Text[loc[2]:loc[3]]}},
+			},
+		})
+	}
+
+	if p.QuoteUri != "" {
+		post.Embed = &bsky.FeedPost_Embed{
+			EmbedRecord: &bsky.EmbedRecord{
+				Record: &atproto.RepoStrongRef{Uri: p.QuoteUri},
+			},
+		}
+	}
+
+	return post
+}
@@ -0,0 +1,160 @@
+package peruse
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+const (
+	// MaxCloseByTopMutualLimit and MaxCloseByTimeframe bound the params that users and the debug endpoint may ask
+	// for, since both make the close by query more expensive
+	MaxCloseByTopMutualLimit = 2000
+	MaxCloseByTimeframe      = 180 * 24 * time.Hour
+)
+
+// UserCloseByParams is a user's own close by params, as kept in the peruse_close_by_params table
+type UserCloseByParams struct {
+	Did                      string    `ch:"did"`
+	ExistingConnectionWeight uint64    `ch:"existing_connection_weight"`
+	NewDiscoveryWeight       uint64    `ch:"new_discovery_weight"`
+	TopMutualLimit           uint64    `ch:"top_mutual_limit"`
+	TimeframeSeconds         int64     `ch:"timeframe_seconds"`
+	UpdatedAt                time.Time `ch:"updated_at"`
+	Deleted                  uint8     `ch:"deleted"`
+}
+
+func (r UserCloseByParams) params() CloseByParams {
+	return CloseByParams{
+		ExistingConnectionWeight: r.ExistingConnectionWeight,
+		NewDiscoveryWeight:       r.NewDiscoveryWeight,
+		TopMutualLimit:           r.TopMutualLimit,
+		Timeframe:                time.Duration(r.TimeframeSeconds) * time.Second,
+	}
+}
+
+// clamped keeps the limit and timeframe within what a single user may ask for
+func (p CloseByParams) clamped() CloseByParams {
+	if p.TopMutualLimit > MaxCloseByTopMutualLimit {
+		p.TopMutualLimit = MaxCloseByTopMutualLimit
+	}
+	if p.Timeframe > MaxCloseByTimeframe {
+		p.Timeframe = MaxCloseByTimeframe
+	}
+	return p
+}
+
+// SetCloseByParamsRequest changes some of a user's close by params, leaving the rest at the server's configured
+// params
+type SetCloseByParamsRequest struct {
+	ExistingConnectionWeight *uint64 `json:"existingConnectionWeight"`
+	NewDiscoveryWeight       *uint64 `json:"newDiscoveryWeight"`
+	TopMutualLimit           *uint64 `json:"topMutualLimit"`
+	Timeframe                string  `json:"timeframe"`
+	// Reset clears the user's params so that the server's configured params are used again
+	Reset bool `json:"reset"`
+}
+
+func (req SetCloseByParamsRequest) apply(params CloseByParams) (CloseByParams, error) {
+	if req.ExistingConnectionWeight != nil {
+		params.ExistingConnectionWeight = *req.ExistingConnectionWeight
+	}
+	if req.NewDiscoveryWeight != nil {
+		params.NewDiscoveryWeight = *req.NewDiscoveryWeight
+	}
+	if req.TopMutualLimit != nil {
+		params.TopMutualLimit = *req.TopMutualLimit
+	}
+	if req.Timeframe != "" {
+		tf, err := time.ParseDuration(req.Timeframe)
+		if err != nil {
+			return params, fmt.Errorf("invalid timeframe: %w", err)
+		}
+		params.Timeframe = tf
+	}
+	return params.clamped(), nil
+}
+
+const (
+	maxCachedCloseByParams = 50_000
+	// closeByParamsTTL is how long a user's params are cached, so that changes made through other instances are
+	// picked up
+	closeByParamsTTL = time.Minute
+)
+
+// cachedCloseByParams is a user's params as last read from the store. Users without their own params are cached too,
+// since most users never set any.
+type cachedCloseByParams struct {
+	params CloseByParams
+	ok     bool
+}
+
+// CloseByParamsStore reads users' own close by params from the store on demand, so that they survive restarts and the
+// user cache, and keeps the ones in use in a bounded cache
+type CloseByParamsStore struct {
+	store  Store
+	logger *slog.Logger
+	cache  *expirable.LRU[string, cachedCloseByParams]
+}
+
+func NewCloseByParamsStore(store Store, logger *slog.Logger) *CloseByParamsStore {
+	return &CloseByParamsStore{
+		store:  store,
+		logger: logger.With("component", "close_by_params"),
+		cache:  expirable.NewLRU[string, cachedCloseByParams](maxCachedCloseByParams, nil, closeByParamsTTL),
+	}
+}
+
+// Get returns the user's own params, and whether they have set any
+func (cs *CloseByParamsStore) Get(ctx context.Context, did string) (CloseByParams, bool, error) {
+	if cached, ok := cs.cache.Get(did); ok {
+		observeCacheLookup("close_by_params", true)
+		return cached.params, cached.ok, nil
+	}
+	observeCacheLookup("close_by_params", false)
+
+	row, err := cs.store.UserCloseByParams(ctx, did)
+	if err != nil {
+		return CloseByParams{}, false, fmt.Errorf("failed to load close by params: %w", err)
+	}
+
+	var cached cachedCloseByParams
+	if row != nil {
+		cached = cachedCloseByParams{params: row.params(), ok: true}
+	}
+	cs.cache.Add(did, cached)
+
+	return cached.params, cached.ok, nil
+}
+
+func (cs *CloseByParamsStore) Set(ctx context.Context, did string, p CloseByParams) error {
+	return cs.write(ctx, did, p, false)
+}
+
+func (cs *CloseByParamsStore) Reset(ctx context.Context, did string) error {
+	return cs.write(ctx, did, CloseByParams{}, true)
+}
+
+func (cs *CloseByParamsStore) write(ctx context.Context, did string, p CloseByParams, deleted bool) error {
+	row := UserCloseByParams{
+		Did:                      did,
+		ExistingConnectionWeight: p.ExistingConnectionWeight,
+		NewDiscoveryWeight:       p.NewDiscoveryWeight,
+		TopMutualLimit:           p.TopMutualLimit,
+		TimeframeSeconds:         int64(p.Timeframe.Seconds()),
+		UpdatedAt:                time.Now(),
+	}
+	if deleted {
+		row.Deleted = 1
+	}
+
+	if err := cs.store.WriteUserCloseByParams(ctx, row); err != nil {
+		return err
+	}
+
+	cs.cache.Remove(did)
+	return nil
+}
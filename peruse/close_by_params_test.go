@@ -0,0 +1,36 @@
+package peruse
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestCloseByParamsStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(0, 0)
+	cs := NewCloseByParamsStore(store, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	const did = "did:plc:viewer"
+	if _, ok, err := cs.Get(ctx, did); err != nil || ok {
+		t.Fatalf("expected no params, got ok=%v err=%v", ok, err)
+	}
+
+	want := CloseByParams{ExistingConnectionWeight: 1, NewDiscoveryWeight: 3, TopMutualLimit: 50, Timeframe: 24 * time.Hour}
+	if err := cs.Set(ctx, did, want); err != nil {
+		t.Fatal(err)
+	}
+	// setting params replaces the cached lookup that found none
+	if got, ok, err := cs.Get(ctx, did); err != nil || !ok || got != want {
+		t.Fatalf("expected %v, got %v ok=%v err=%v", want, got, ok, err)
+	}
+
+	if err := cs.Reset(ctx, did); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := cs.Get(ctx, did); err != nil || ok {
+		t.Fatalf("expected the params to be reset, got ok=%v err=%v", ok, err)
+	}
+}
@@ -0,0 +1,342 @@
+package peruse
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// compositeNode is a parsed composite feed expression
+type compositeNode interface {
+	eval(ctx context.Context, feeds map[string]Feed) ([]RankedFeedPost, error)
+	feedNames() []string
+}
+
+type compositeFeedNode struct {
+	name string
+}
+
+func (n *compositeFeedNode) eval(ctx context.Context, feeds map[string]Feed) ([]RankedFeedPost, error) {
+	f, ok := feeds[n.name].(RankedSource)
+	if !ok {
+		return nil, fmt.Errorf("feed %s is not a ranked feed", n.name)
+	}
+	return f.RankedPosts(ctx)
+}
+
+func (n *compositeFeedNode) feedNames() []string {
+	return []string{n.name}
+}
+
+type compositeOp string
+
+const (
+	compositeOpUnion     compositeOp = "union"
+	compositeOpIntersect compositeOp = "intersect"
+	compositeOpExcept    compositeOp = "except"
+)
+
+type compositeSetNode struct {
+	op          compositeOp
+	left, right compositeNode
+}
+
+func (n *compositeSetNode) eval(ctx context.Context, feeds map[string]Feed) ([]RankedFeedPost, error) {
+	left, err := n.left.eval(ctx, feeds)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(ctx, feeds)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case compositeOpUnion:
+		return unionPosts(left, right), nil
+	case compositeOpIntersect:
+		return filterPostsByMembership(left, right, true), nil
+	default:
+		return filterPostsByMembership(left, right, false), nil
+	}
+}
+
+func (n *compositeSetNode) feedNames() []string {
+	return append(n.left.feedNames(), n.right.feedNames()...)
+}
+
+type compositeInterleaveNode struct {
+	children []compositeNode
+	weights  []int
+}
+
+// eval takes weight posts from each child in turn, skipping posts that an earlier child already contributed
+func (n *compositeInterleaveNode) eval(ctx context.Context, feeds map[string]Feed) ([]RankedFeedPost, error) {
+	lists := make([][]RankedFeedPost, len(n.children))
+	total := 0
+	for i, c := range n.children {
+		posts, err := c.eval(ctx, feeds)
+		if err != nil {
+			return nil, err
+		}
+		lists[i] = posts
+		total += len(posts)
+	}
+
+	seen := map[string]struct{}{}
+	interleaved := make([]RankedFeedPost, 0, total)
+	positions := make([]int, len(lists))
+	for {
+		progressed := false
+		for i, posts := range lists {
+			taken := 0
+			for taken < n.weights[i] && positions[i] < len(posts) {
+				p := posts[positions[i]]
+				positions[i]++
+				progressed = true
+				if _, ok := seen[p.Uri]; ok {
+					continue
+				}
+				seen[p.Uri] = struct{}{}
+				interleaved = append(interleaved, p)
+				taken++
+			}
+		}
+		if !progressed {
+			return interleaved, nil
+		}
+	}
+}
+
+func (n *compositeInterleaveNode) feedNames() []string {
+	var names []string
+	for _, c := range n.children {
+		names = append(names, c.feedNames()...)
+	}
+	return names
+}
+
+// unionPosts merges two ranked lists, keeping the higher score for posts in both, and re-ranks by score
+func unionPosts(a, b []RankedFeedPost) []RankedFeedPost {
+	byUri := make(map[string]RankedFeedPost, len(a)+len(b))
+	for _, list := range [][]RankedFeedPost{a, b} {
+		for _, p := range list {
+			if existing, ok := byUri[p.Uri]; ok && existing.DecayScore >= p.DecayScore {
+				continue
+			}
+			byUri[p.Uri] = p
+		}
+	}
+
+	merged := make([]RankedFeedPost, 0, len(byUri))
+	for _, p := range byUri {
+		merged = append(merged, p)
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].DecayScore != merged[j].DecayScore {
+			return merged[i].DecayScore > merged[j].DecayScore
+		}
+		if !merged[i].CreatedAt.Equal(merged[j].CreatedAt) {
+			return merged[i].CreatedAt.After(merged[j].CreatedAt)
+		}
+		return merged[i].Uri < merged[j].Uri
+	})
+
+	return merged
+}
+
+// filterPostsByMembership keeps the posts of a, in a's order, that are (or are not) also in b
+func filterPostsByMembership(a, b []RankedFeedPost, keepMembers bool) []RankedFeedPost {
+	inB := make(map[string]struct{}, len(b))
+	for _, p := range b {
+		inB[p.Uri] = struct{}{}
+	}
+
+	filtered := make([]RankedFeedPost, 0, len(a))
+	for _, p := range a {
+		if _, ok := inB[p.Uri]; ok == keepMembers {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
+
+// parseCompositeExpr parses a composite feed expression. Feeds are referenced by name and combined with union,
+// intersect and except, where intersect binds tighter like it does in SQL, and with interleave(feed:weight, ...).
+// Parentheses group as usual. For example:
+//
+//	seattle union (software intersect seattle)
+//	seattle except baseball
+//	interleave(seattle:2, software:1)
+func parseCompositeExpr(expr string) (compositeNode, error) {
+	p := &compositeParser{tokens: tokenizeCompositeExpr(expr)}
+	n, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("unexpected %q in composite expression", tok)
+	}
+	return n, nil
+}
+
+func tokenizeCompositeExpr(expr string) []string {
+	var tokens []string
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+
+	for _, r := range expr {
+		switch {
+		case unicode.IsSpace(r):
+			flush()
+		case strings.ContainsRune("(),:", r):
+			flush()
+			tokens = append(tokens, string(r))
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+type compositeParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *compositeParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *compositeParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *compositeParser) expect(tok string) error {
+	if got := p.next(); got != tok {
+		if got == "" {
+			return fmt.Errorf("expected %q but the composite expression ended", tok)
+		}
+		return fmt.Errorf("expected %q but found %q in composite expression", tok, got)
+	}
+	return nil
+}
+
+func (p *compositeParser) parseExpr() (compositeNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := compositeOp(strings.ToLower(p.peek()))
+		if op != compositeOpUnion && op != compositeOpExcept {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &compositeSetNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *compositeParser) parseTerm() (compositeNode, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+
+	for compositeOp(strings.ToLower(p.peek())) == compositeOpIntersect {
+		p.next()
+
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &compositeSetNode{op: compositeOpIntersect, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *compositeParser) parseFactor() (compositeNode, error) {
+	tok := p.next()
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("composite expression ended early")
+	case tok == "(":
+		n, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case strings.EqualFold(tok, "interleave") && p.peek() == "(":
+		p.next()
+		return p.parseInterleave()
+	case strings.ContainsAny(tok, "),:"):
+		return nil, fmt.Errorf("unexpected %q in composite expression", tok)
+	default:
+		switch compositeOp(strings.ToLower(tok)) {
+		case compositeOpUnion, compositeOpIntersect, compositeOpExcept:
+			return nil, fmt.Errorf("expected a feed before %q in composite expression", tok)
+		}
+		return &compositeFeedNode{name: tok}, nil
+	}
+}
+
+func (p *compositeParser) parseInterleave() (compositeNode, error) {
+	n := &compositeInterleaveNode{}
+	for {
+		child, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		weight := 1
+		if p.peek() == ":" {
+			p.next()
+			w, err := strconv.Atoi(p.next())
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("interleave weights must be positive integers")
+			}
+			weight = w
+		}
+
+		n.children = append(n.children, child)
+		n.weights = append(n.weights, weight)
+
+		switch tok := p.next(); tok {
+		case ",":
+			continue
+		case ")":
+			if len(n.children) < 2 {
+				return nil, fmt.Errorf("interleave needs at least two feeds")
+			}
+			return n, nil
+		default:
+			return nil, fmt.Errorf("expected \",\" or \")\" in interleave but found %q", tok)
+		}
+	}
+}
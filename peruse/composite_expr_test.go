@@ -0,0 +1,132 @@
+package peruse
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// testRankedFeed serves a fixed ranking. Only the methods composite feeds use are implemented.
+type testRankedFeed struct {
+	Feed
+	name  string
+	posts []RankedFeedPost
+}
+
+func (f *testRankedFeed) Name() string {
+	return f.name
+}
+
+func (f *testRankedFeed) RankedPosts(ctx context.Context) ([]RankedFeedPost, error) {
+	return f.posts, nil
+}
+
+// testPlainFeed is a feed without a ranking, which can't be combined
+type testPlainFeed struct {
+	Feed
+}
+
+func testCompositeFeeds() map[string]Feed {
+	ranked := func(name string, scores ...any) Feed {
+		f := &testRankedFeed{name: name}
+		for i := 0; i < len(scores); i += 2 {
+			f.posts = append(f.posts, RankedFeedPost{Uri: scores[i].(string), DecayScore: scores[i+1].(float64)})
+		}
+		return f
+	}
+
+	return map[string]Feed{
+		"a":     ranked("a", "a1", 5.0, "s1", 4.0, "a2", 1.0),
+		"b":     ranked("b", "s1", 4.5, "b1", 2.0),
+		"c":     ranked("c", "s1", 3.0, "c1", 6.0),
+		"plain": &testPlainFeed{},
+	}
+}
+
+func TestCompositeExpr(t *testing.T) {
+	feeds := testCompositeFeeds()
+
+	tests := []struct {
+		expr    string
+		want    []string
+		wantErr bool
+	}{
+		{expr: "a", want: []string{"a1", "s1", "a2"}},
+		// posts in both keep the higher score
+		{expr: "a union b", want: []string{"a1", "s1", "b1", "a2"}},
+		{expr: "a UNION b", want: []string{"a1", "s1", "b1", "a2"}},
+		{expr: "a intersect b", want: []string{"s1"}},
+		{expr: "a except b", want: []string{"a1", "a2"}},
+		// intersect binds tighter than union and except
+		{expr: "a union b intersect c", want: []string{"a1", "s1", "a2"}},
+		{expr: "a union (b intersect c)", want: []string{"a1", "s1", "a2"}},
+		{expr: "(a union b) intersect c", want: []string{"s1"}},
+		{expr: "c intersect a union b", want: []string{"s1", "b1"}},
+		// union and except are left associative
+		{expr: "a except b except c", want: []string{"a1", "a2"}},
+		{expr: "a except (b except c)", want: []string{"a1", "s1", "a2"}},
+		// each feed gives its weight in new posts per turn, skipping posts already taken
+		{expr: "interleave(a:2, b:1)", want: []string{"a1", "s1", "b1", "a2"}},
+		{expr: "interleave(c, a)", want: []string{"s1", "a1", "c1", "a2"}},
+		{expr: "interleave(a intersect b, c:2)", want: []string{"s1", "c1"}},
+		{expr: "interleave(a, b) except c", want: []string{"a1", "a2", "b1"}},
+
+		{expr: "", wantErr: true},
+		{expr: "a union", wantErr: true},
+		{expr: "union a", wantErr: true},
+		{expr: "a b", wantErr: true},
+		{expr: "a)", wantErr: true},
+		{expr: "(a union b", wantErr: true},
+		{expr: "a union ()", wantErr: true},
+		{expr: "interleave(a)", wantErr: true},
+		{expr: "interleave(a b)", wantErr: true},
+		{expr: "interleave(a:0, b)", wantErr: true},
+		{expr: "interleave(a:x, b)", wantErr: true},
+		{expr: "interleave(a, b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			n, err := parseCompositeExpr(tt.expr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected %q to be rejected", tt.expr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			posts, err := n.eval(context.Background(), feeds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range posts {
+				got = append(got, p.Uri)
+			}
+			if !equalStrings(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCompositeFeedOperands(t *testing.T) {
+	s := &Server{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		feeds:  testCompositeFeeds(),
+	}
+
+	for _, expr := range []string{"a union missing", "interleave(a, plain)"} {
+		if _, err := NewCompositeFeed(s, CompositeFeedConfig{Name: "combined", Expr: expr}); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+
+	if _, err := NewCompositeFeed(s, CompositeFeedConfig{Name: "combined", Expr: "a union b"}); err != nil {
+		t.Errorf("expected a valid expression to be accepted, got %v", err)
+	}
+}
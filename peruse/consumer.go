@@ -7,8 +7,11 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/araddon/dateparse"
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/bluesky-social/indigo/events"
@@ -19,7 +22,72 @@ import (
 	"github.com/ipfs/go-cid"
 )
 
+// firehoseState tracks the consumer's progress and whether it has been paused by an operator
+type firehoseState struct {
+	mu          sync.Mutex
+	paused      bool
+	resumed     chan struct{}
+	stopStream  context.CancelFunc
+	lastEvtTime atomic.Int64
+}
+
+func newFirehoseState() *firehoseState {
+	return &firehoseState{
+		resumed: make(chan struct{}),
+	}
+}
+
+// pause disconnects from the relay. The cursor is kept, so resuming picks up where the stream left off.
+func (fs *firehoseState) pause() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.paused {
+		return
+	}
+	fs.paused = true
+	fs.resumed = make(chan struct{})
+	if fs.stopStream != nil {
+		fs.stopStream()
+	}
+}
+
+func (fs *firehoseState) resume() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.paused {
+		return
+	}
+	fs.paused = false
+	close(fs.resumed)
+}
+
+func (fs *firehoseState) isPaused() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.paused
+}
+
+// lag returns how far behind the most recently processed commit's time we are, or zero if nothing has been processed
+func (fs *firehoseState) lag() time.Duration {
+	t := fs.lastEvtTime.Load()
+	if t == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, t))
+}
+
 func (s *Server) startConsumer(ctx context.Context, cancel context.CancelFunc) error {
+	// a replay leaves the cursor file alone, and keeps serving once it's done so that the feeds it built can be read
+	if s.args.ReplayFile != "" {
+		if err := s.replayFirehose(ctx); err != nil {
+			cancel()
+			return err
+		}
+		return nil
+	}
+
 	defer cancel()
 
 	go func() {
@@ -34,12 +102,6 @@ func (s *Server) startConsumer(ctx context.Context, cancel context.CancelFunc) e
 		}
 	}()
 
-	u, err := url.Parse(s.args.RelayHost)
-	if err != nil {
-		return err
-	}
-	u.Path = "/xrpc/com.atproto.sync.subscribeRepos"
-
 	prevCursor, err := s.loadCursor()
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -49,8 +111,50 @@ func (s *Server) startConsumer(ctx context.Context, cancel context.CancelFunc) e
 		s.cursor = prevCursor
 	}
 
-	if prevCursor != "" {
-		u.RawQuery = "cursor=" + prevCursor
+	for {
+		s.firehose.mu.Lock()
+		paused, resumed := s.firehose.paused, s.firehose.resumed
+		streamCtx, stopStream := context.WithCancel(ctx)
+		s.firehose.stopStream = stopStream
+		s.firehose.mu.Unlock()
+
+		if paused {
+			stopStream()
+			s.logger.Info("firehose consumer paused")
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-resumed:
+				s.logger.Info("firehose consumer resumed")
+				continue
+			}
+		}
+
+		err := s.consumeStream(ctx, streamCtx)
+		stopStream()
+		if err != nil {
+			return err
+		}
+
+		// the stream only ends on its own when something went wrong, in which case we shut down like before. if it
+		// was ended by a pause, wait to be resumed instead
+		if ctx.Err() != nil || !s.firehose.isPaused() {
+			return nil
+		}
+	}
+}
+
+// consumeStream connects to the relay from the current cursor and handles events until the stream ends. Events are
+// processed with the server's context rather than the stream's so that in flight commits finish when paused.
+func (s *Server) consumeStream(ctx context.Context, streamCtx context.Context) error {
+	u, err := url.Parse(s.args.RelayHost)
+	if err != nil {
+		return err
+	}
+	u.Path = "/xrpc/com.atproto.sync.subscribeRepos"
+
+	if s.cursor != "" {
+		u.RawQuery = "cursor=" + s.cursor
 	}
 
 	rsc := events.RepoStreamCallbacks{
@@ -73,7 +177,7 @@ func (s *Server) startConsumer(ctx context.Context, cancel context.CancelFunc) e
 
 	scheduler := parallel.NewScheduler(400, 10, con.RemoteAddr().String(), rsc.EventHandler)
 
-	if err := events.HandleRepoStream(ctx, con, scheduler, s.logger); err != nil {
+	if err := events.HandleRepoStream(streamCtx, con, scheduler, s.logger); err != nil {
 		s.logger.Error("repo stream failed", "error", err)
 	}
 
@@ -85,6 +189,11 @@ func (s *Server) startConsumer(ctx context.Context, cancel context.CancelFunc) e
 func (s *Server) repoCommit(ctx context.Context, evt *atproto.SyncSubscribeRepos_Commit) {
 	s.cursor = fmt.Sprintf("%d", evt.Seq)
 
+	if evtTime, err := dateparse.ParseAny(evt.Time); err == nil {
+		s.firehose.lastEvtTime.Store(evtTime.UnixNano())
+		firehoseCommitLag.Set(time.Since(evtTime).Seconds())
+	}
+
 	if evt.TooBig {
 		s.logger.Warn("commit too big", "repo", evt.Repo, "seq", evt.Seq)
 		return
@@ -0,0 +1,303 @@
+package peruse
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/haileyok/peruse/internal/helpers"
+	"github.com/haileyok/peruse/wikidata"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// EntityFeedRkeyPrefix marks the rkeys of entity feeds. The rest of the rkey is a wikidata id such as Q5 or an
+	// approved alias such as climate-pledge-arena.
+	EntityFeedRkeyPrefix = "entity-"
+	// EntityFeedsName is the feed name that moderation, label policy and metrics for every entity feed use
+	EntityFeedsName = "entity"
+
+	DefaultEntityFeedMinPosts = 20
+
+	// an entity feed stays live for as long as it keeps being requested, up to maxLiveEntityFeeds feeds
+	entityFeedLiveTTL  = 7 * 24 * time.Hour
+	maxLiveEntityFeeds = 10_000
+)
+
+var entityIdRegex = regexp.MustCompile(`^Q[0-9]+$`)
+var entityAliasRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,80}$`)
+
+type EntityPostRow struct {
+	EntityId  string    `ch:"entity_id"`
+	Uri       string    `ch:"uri"`
+	CreatedAt time.Time `ch:"created_at"`
+	Lang      string    `ch:"lang"`
+}
+
+type EntityAlias struct {
+	Alias     string    `ch:"alias" json:"alias"`
+	EntityId  string    `ch:"entity_id" json:"entityId"`
+	CreatedAt time.Time `ch:"created_at" json:"createdAt"`
+	Deleted   uint8     `ch:"deleted" json:"-"`
+}
+
+// EntityFeeds serves a feed for any single entity in one of the configured entity sets. Posts mentioning a known
+// entity are written to the store at ingest, and each entity's feed is ranked and cached like the topic feeds
+// the first time it is requested. An entity's feed only goes live once it has enough posts to be worth following.
+type EntityFeeds struct {
+	s        *Server
+	store    Store
+	logger   *slog.Logger
+	known    map[string]struct{}
+	minPosts int
+
+	feedsMu sync.Mutex
+	feeds   *expirable.LRU[string, *rankedFeed]
+
+	mu      sync.RWMutex
+	aliases map[string]EntityAlias
+
+	live *expirable.LRU[string, struct{}]
+}
+
+// NewEntityFeeds covers every entity known to the server's wikidata feeds, so it must be created after they are added
+func NewEntityFeeds(ctx context.Context, s *Server) (*EntityFeeds, error) {
+	known := map[string]struct{}{}
+	for _, f := range s.feeds {
+		if wf, ok := f.(*WikidataFeed); ok {
+			for id := range wf.entities {
+				known[id] = struct{}{}
+			}
+		}
+	}
+
+	minPosts := s.args.EntityFeedMinPosts
+	if minPosts <= 0 {
+		minPosts = DefaultEntityFeedMinPosts
+	}
+
+	ef := &EntityFeeds{
+		s:        s,
+		store:    s.store,
+		logger:   s.logger.With("component", "entity-feeds"),
+		known:    known,
+		minPosts: minPosts,
+		feeds:    expirable.NewLRU[string, *rankedFeed](1_000, nil, time.Hour),
+		aliases:  map[string]EntityAlias{},
+		live:     expirable.NewLRU[string, struct{}](maxLiveEntityFeeds, nil, entityFeedLiveTTL),
+	}
+
+	if err := ef.loadAliases(ctx); err != nil {
+		return nil, err
+	}
+
+	return ef, nil
+}
+
+// Run periodically reloads aliases so that changes made by other instances are picked up
+func (ef *EntityFeeds) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ef.loadAliases(ctx); err != nil {
+				ef.logger.Error("error reloading entity aliases", "error", err)
+			}
+		}
+	}
+}
+
+func (ef *EntityFeeds) loadAliases(ctx context.Context) error {
+	rows, err := ef.store.EntityAliases(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load entity aliases: %w", err)
+	}
+
+	aliases := make(map[string]EntityAlias, len(rows))
+	for _, r := range rows {
+		aliases[r.Alias] = r
+	}
+
+	ef.mu.Lock()
+	ef.aliases = aliases
+	ef.mu.Unlock()
+
+	return nil
+}
+
+// OnPost records the known entities a post mentions. Like the topic feeds' defaults, only top level posts are used.
+func (ef *EntityFeeds) OnPost(ctx context.Context, post *bsky.FeedPost, uri, did string, indexedAt time.Time, nerItems []wikidata.EntityMatch) error {
+	if post.Reply != nil || len(nerItems) == 0 {
+		return nil
+	}
+
+	var mentions []EntityMention
+	for _, m := range entityMentions(nerItems) {
+		if _, ok := ef.known[m.EntityId]; ok {
+			mentions = append(mentions, m)
+		}
+	}
+	if len(mentions) == 0 {
+		return nil
+	}
+
+	if ef.s.isExcluded(EntityFeedsName, did, uri) {
+		return nil
+	}
+
+	lang := postLang(post)
+	for _, m := range mentions {
+		if err := ef.store.InsertEntityPost(ctx, EntityPostRow{
+			EntityId:  m.EntityId,
+			Uri:       uri,
+			CreatedAt: indexedAt,
+			Lang:      lang,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolve returns the entity id for the part of an entity feed's rkey after the prefix
+func (ef *EntityFeeds) resolve(key string) (string, bool) {
+	if entityIdRegex.MatchString(key) {
+		_, ok := ef.known[key]
+		return key, ok
+	}
+
+	ef.mu.RLock()
+	alias, ok := ef.aliases[key]
+	ef.mu.RUnlock()
+	if !ok {
+		return "", false
+	}
+
+	_, ok = ef.known[alias.EntityId]
+	return alias.EntityId, ok
+}
+
+func (ef *EntityFeeds) feedFor(entityId string) *rankedFeed {
+	// held so that two requests can't create the same feed and split its cache
+	ef.feedsMu.Lock()
+	defer ef.feedsMu.Unlock()
+
+	if f, ok := ef.feeds.Get(entityId); ok {
+		return f
+	}
+
+	// every entity feed shares the moderation and label policy of EntityFeedsName
+	f := &rankedFeed{
+		store:      ef.store,
+		logger:     ef.logger.With("entity", entityId),
+		isExcluded: ef.s.isExcluded,
+		feedName:   EntityFeedsName,
+		rank: func(ctx context.Context) ([]RankedFeedPost, error) {
+			return ef.store.RankedEntityPosts(ctx, entityId)
+		},
+		queryName: "feed_posts_entity",
+	}
+	ef.feeds.Add(entityId, f)
+
+	return f
+}
+
+// FeedSkeleton serves the entity feed for rkey, if the entity is known and its feed has gone live. Checking whether a
+// feed can go live ranks its posts, so requests for feeds that aren't live yet are rate limited.
+func (ef *EntityFeeds) FeedSkeleton(e echo.Context, req FeedSkeletonRequest, rkey string) error {
+	entityId, ok := ef.resolve(strings.TrimPrefix(rkey, EntityFeedRkeyPrefix))
+	if !ok {
+		return helpers.InputError(e, "FeedNotFound", "")
+	}
+
+	if _, live := ef.live.Get(entityId); live {
+		// requests keep a live feed live, so that it doesn't disappear for followers during a quiet day
+		ef.live.Add(entityId, struct{}{})
+		return ef.feedFor(entityId).FeedSkeleton(e, req)
+	}
+
+	return ef.s.applyRateLimit(e, RateLimitEntityFeedCreate, rateLimitKey(e), func(e echo.Context) error {
+		f := ef.feedFor(entityId)
+
+		posts, err := f.RankedPosts(e.Request().Context())
+		if err != nil {
+			ef.logger.Error("error getting entity feed posts", "entity", entityId, "error", err)
+			return helpers.ServerError(e, "FeedError", "Unable to get posts for feed")
+		}
+		if len(posts) < ef.minPosts {
+			return helpers.InputError(e, "FeedNotAvailable", "There aren't enough posts about this entity for a feed yet")
+		}
+
+		ef.live.Add(entityId, struct{}{})
+
+		return f.FeedSkeleton(e, req)
+	})
+}
+
+func (ef *EntityFeeds) ListAliases() []EntityAlias {
+	ef.mu.RLock()
+	defer ef.mu.RUnlock()
+
+	aliases := make([]EntityAlias, 0, len(ef.aliases))
+	for _, a := range ef.aliases {
+		aliases = append(aliases, a)
+	}
+	sort.Slice(aliases, func(i, j int) bool {
+		return aliases[i].Alias < aliases[j].Alias
+	})
+	return aliases
+}
+
+// SetAlias approves an alias for an entity, so that its feed can be served at entity-<alias>
+func (ef *EntityFeeds) SetAlias(ctx context.Context, alias, entityId string) (*EntityAlias, error) {
+	if !entityAliasRegex.MatchString(alias) || entityIdRegex.MatchString(strings.ToUpper(alias)) {
+		return nil, fmt.Errorf("aliases must be lowercase letters, numbers and dashes, and can't look like an entity id")
+	}
+	if _, ok := ef.known[entityId]; !ok {
+		return nil, fmt.Errorf("entity %s is not in any configured entity set", entityId)
+	}
+	return ef.writeAlias(ctx, alias, entityId, false)
+}
+
+func (ef *EntityFeeds) DeleteAlias(ctx context.Context, alias string) error {
+	_, err := ef.writeAlias(ctx, alias, "", true)
+	return err
+}
+
+func (ef *EntityFeeds) writeAlias(ctx context.Context, alias, entityId string, deleted bool) (*EntityAlias, error) {
+	row := EntityAlias{
+		Alias:     alias,
+		EntityId:  entityId,
+		CreatedAt: time.Now(),
+	}
+	if deleted {
+		row.Deleted = 1
+	}
+
+	if err := ef.store.WriteEntityAlias(ctx, row); err != nil {
+		return nil, err
+	}
+
+	ef.mu.Lock()
+	defer ef.mu.Unlock()
+
+	if deleted {
+		delete(ef.aliases, alias)
+	} else {
+		ef.aliases[alias] = row
+	}
+
+	return &row, nil
+}
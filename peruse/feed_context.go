@@ -0,0 +1,51 @@
+package peruse
+
+import "fmt"
+
+func pluralize(n uint64, singular, plural string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, singular)
+	}
+	return fmt.Sprintf("%d %s", n, plural)
+}
+
+func suggestedFollowFeedContext(sf SuggestedFollow) string {
+	return "followed by " + pluralize(sf.FollowedByCount, "person", "people") + " you interact with"
+}
+
+func closeByFeedContext(cb CloseBy) string {
+	if cb.ConnectionType == "existing_connection" {
+		return "someone you interact with"
+	}
+	return "liked by " + pluralize(cb.InteractedByCount, "person", "people") + " you interact with"
+}
+
+// suggestedFollowsContextFunc returns a lookup of feed context strings by author did
+func suggestedFollowsContextFunc(suggs []SuggestedFollow) func(did string) *string {
+	contexts := map[string]string{}
+	for _, sugg := range suggs {
+		contexts[sugg.SuggestedDid] = suggestedFollowFeedContext(sugg)
+	}
+	return func(did string) *string {
+		c, ok := contexts[did]
+		if !ok {
+			return nil
+		}
+		return &c
+	}
+}
+
+// closeByContextFunc returns a lookup of feed context strings by author did
+func closeByContextFunc(closeBy []CloseBy) func(did string) *string {
+	contexts := map[string]string{}
+	for _, cb := range closeBy {
+		contexts[cb.SuggestedDid] = closeByFeedContext(cb)
+	}
+	return func(did string) *string {
+		c, ok := contexts[did]
+		if !ok {
+			return nil
+		}
+		return &c
+	}
+}
@@ -0,0 +1,236 @@
+package peruse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+const (
+	DefaultFeedInsertBatchSize     = 500
+	DefaultFeedInsertFlushInterval = 5 * time.Second
+	DefaultFeedInsertFlushTimeout  = 30 * time.Second
+	DefaultFeedInsertMaxQueued     = 50_000
+)
+
+// ErrFeedInsertDropped is returned for a feed post that was dropped rather than queued because too many posts were
+// already waiting to be written. Live ingest can ignore it, since the drop is logged and counted.
+var ErrFeedInsertDropped = errors.New("feed insert queue is full")
+
+// FeedInsertConfig tunes the feed inserter. Zero values use the defaults.
+type FeedInsertConfig struct {
+	// BatchSize is how many rows, across all feeds, are queued before they are flushed early
+	BatchSize int
+	// FlushInterval is the longest a row waits to be written
+	FlushInterval time.Duration
+	// FlushTimeout is how long a flush may take before its remaining batches are given up on
+	FlushTimeout time.Duration
+	// MaxQueued is how many rows may wait for a flush. Rows past it are dropped while clickhouse is slow.
+	MaxQueued int
+	// BlockWhenFull makes inserts wait for a flush instead of dropping rows once MaxQueued rows are waiting, for
+	// backfills that can't lose posts
+	BlockWhenFull bool
+}
+
+// feedInserter queues the rows of every feed table and writes them together, either once BatchSize rows are queued or
+// every FlushInterval. Each flush sends one batch per table that has rows, so a burst of posts to one feed turns into a
+// handful of inserts instead of one per post. Inserting never waits on clickhouse: each flush has FlushTimeout to
+// finish, and once MaxQueued rows are waiting new rows are dropped with ErrFeedInsertDropped.
+type feedInserter struct {
+	conn   driver.Conn
+	logger *slog.Logger
+	cfg    FeedInsertConfig
+
+	mu      sync.Mutex
+	pending map[string][]FeedDatabaseItem // table -> rows
+	queued  int
+	closed  bool
+	// dropLogged is set once a drop has been logged, so that a full queue is logged once between flushes
+	dropLogged bool
+	// drained is signalled whenever a flush takes the queued rows, for inserts waiting for room
+	drained *sync.Cond
+
+	flushNow chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+
+	// flushMu keeps flushes in order, so that the final flush on close waits for one that is already running
+	flushMu sync.Mutex
+}
+
+func newFeedInserter(conn driver.Conn, logger *slog.Logger, cfg FeedInsertConfig) *feedInserter {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultFeedInsertBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFeedInsertFlushInterval
+	}
+	if cfg.FlushTimeout <= 0 {
+		cfg.FlushTimeout = DefaultFeedInsertFlushTimeout
+	}
+	if cfg.MaxQueued <= 0 {
+		cfg.MaxQueued = DefaultFeedInsertMaxQueued
+	}
+
+	fi := &feedInserter{
+		conn:     conn,
+		logger:   logger.With("component", "feed_inserter"),
+		cfg:      cfg,
+		pending:  map[string][]FeedDatabaseItem{},
+		flushNow: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	fi.drained = sync.NewCond(&fi.mu)
+	go fi.run()
+	return fi
+}
+
+func (fi *feedInserter) Insert(table string, item FeedDatabaseItem) error {
+	fi.mu.Lock()
+	for fi.cfg.BlockWhenFull && fi.queued >= fi.cfg.MaxQueued && !fi.closed {
+		fi.requestFlush()
+		fi.drained.Wait()
+	}
+	if fi.closed {
+		fi.mu.Unlock()
+		return fmt.Errorf("feed inserter is closed")
+	}
+	if fi.queued >= fi.cfg.MaxQueued {
+		logDrop := !fi.dropLogged
+		fi.dropLogged = true
+		fi.mu.Unlock()
+
+		feedInsertRows.WithLabelValues(table, "dropped").Inc()
+		if logDrop {
+			fi.logger.Warn("feed insert queue is full, dropping feed posts until the next flush", "table", table, "max_queued", fi.cfg.MaxQueued)
+		}
+		return ErrFeedInsertDropped
+	}
+	fi.pending[table] = append(fi.pending[table], item)
+	fi.queued++
+	full := fi.queued >= fi.cfg.BatchSize
+	fi.mu.Unlock()
+
+	feedInsertQueued.Inc()
+
+	if full {
+		fi.requestFlush()
+	}
+
+	return nil
+}
+
+func (fi *feedInserter) requestFlush() {
+	select {
+	case fi.flushNow <- struct{}{}:
+	default:
+	}
+}
+
+func (fi *feedInserter) run() {
+	defer close(fi.stopped)
+
+	ticker := time.NewTicker(fi.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fi.done:
+			return
+		case <-ticker.C:
+			fi.flushWithTimeout("interval")
+		case <-fi.flushNow:
+			fi.flushWithTimeout("size")
+		}
+	}
+}
+
+func (fi *feedInserter) flushWithTimeout(reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), fi.cfg.FlushTimeout)
+	defer cancel()
+	fi.flush(ctx, reason)
+}
+
+// Flush writes everything that is queued before returning, and returns the errors of any batches that failed
+func (fi *feedInserter) Flush(ctx context.Context) error {
+	return fi.flush(ctx, "sync")
+}
+
+// flush writes everything that is queued. Rows in a batch that fails are dropped rather than retried, so that a
+// clickhouse outage doesn't grow the queue without bound. The flush loop only logs failures, but callers that need
+// the rows stored get the errors back.
+func (fi *feedInserter) flush(ctx context.Context, reason string) error {
+	fi.flushMu.Lock()
+	defer fi.flushMu.Unlock()
+
+	fi.mu.Lock()
+	pending := fi.pending
+	queued := fi.queued
+	fi.pending = map[string][]FeedDatabaseItem{}
+	fi.queued = 0
+	fi.dropLogged = false
+	fi.drained.Broadcast()
+	fi.mu.Unlock()
+
+	if queued == 0 {
+		return nil
+	}
+
+	feedInsertQueued.Sub(float64(queued))
+	feedInsertFlushes.WithLabelValues(reason).Inc()
+
+	start := time.Now()
+	defer func() {
+		clickhouseInsertDuration.WithLabelValues("feed_posts").Observe(time.Since(start).Seconds())
+	}()
+
+	var errs []error
+	for table, rows := range pending {
+		status := "ok"
+		if err := fi.send(ctx, table, rows); err != nil {
+			fi.logger.Error("failed to insert feed posts", "table", table, "rows", len(rows), "error", err)
+			errs = append(errs, fmt.Errorf("failed to insert %d feed posts into %s: %w", len(rows), table, err))
+			status = "failed"
+		}
+		feedInsertRows.WithLabelValues(table, status).Add(float64(len(rows)))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (fi *feedInserter) send(ctx context.Context, table string, rows []FeedDatabaseItem) error {
+	batch, err := fi.conn.PrepareBatch(ctx, fmt.Sprintf("INSERT INTO %s (uri, created_at, lang)", table))
+	if err != nil {
+		return err
+	}
+	for i := range rows {
+		if err := batch.AppendStruct(&rows[i]); err != nil {
+			batch.Abort()
+			return err
+		}
+	}
+	return batch.Send()
+}
+
+// Close stops the flush loop and writes whatever is still queued
+func (fi *feedInserter) Close(ctx context.Context) {
+	fi.mu.Lock()
+	if fi.closed {
+		fi.mu.Unlock()
+		return
+	}
+	fi.closed = true
+	fi.drained.Broadcast()
+	fi.mu.Unlock()
+
+	close(fi.done)
+	<-fi.stopped
+
+	fi.flush(ctx, "close")
+}
@@ -0,0 +1,130 @@
+package peruse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// fakeInsertConn records the rows sent in feed table batches. Only batch inserts are implemented.
+type fakeInsertConn struct {
+	driver.Conn
+
+	mu   sync.Mutex
+	rows map[string][]string // table -> uris
+	fail error
+}
+
+func (c *fakeInsertConn) PrepareBatch(ctx context.Context, query string, opts ...driver.PrepareBatchOption) (driver.Batch, error) {
+	var table string
+	if _, err := fmt.Sscanf(query, "INSERT INTO %s", &table); err != nil {
+		return nil, err
+	}
+	return &fakeInsertBatch{conn: c, table: table}, nil
+}
+
+func (c *fakeInsertConn) uris(table string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rows[table]
+}
+
+type fakeInsertBatch struct {
+	driver.Batch
+	conn  *fakeInsertConn
+	table string
+	uris  []string
+}
+
+func (b *fakeInsertBatch) AppendStruct(v any) error {
+	b.uris = append(b.uris, v.(*FeedDatabaseItem).Uri)
+	return nil
+}
+
+func (b *fakeInsertBatch) Abort() error {
+	return nil
+}
+
+func (b *fakeInsertBatch) Send() error {
+	b.conn.mu.Lock()
+	defer b.conn.mu.Unlock()
+	if b.conn.fail != nil {
+		return b.conn.fail
+	}
+	b.conn.rows[b.table] = append(b.conn.rows[b.table], b.uris...)
+	return nil
+}
+
+func newTestFeedInserter(conn driver.Conn, maxQueued int) *feedInserter {
+	return newFeedInserter(conn, slog.New(slog.NewTextHandler(io.Discard, nil)), FeedInsertConfig{
+		BatchSize:     100,
+		FlushInterval: time.Hour,
+		MaxQueued:     maxQueued,
+	})
+}
+
+func TestFeedInserterDropsPastMaxQueued(t *testing.T) {
+	conn := &fakeInsertConn{rows: map[string][]string{}}
+	fi := newTestFeedInserter(conn, 2)
+
+	for i := range 3 {
+		err := fi.Insert("seattle_post", FeedDatabaseItem{Uri: fmt.Sprintf("at://did:plc:a/app.bsky.feed.post/%d", i)})
+		if i < 2 && err != nil {
+			t.Fatalf("expected post %d to be queued, got %v", i, err)
+		}
+		if i == 2 && !errors.Is(err, ErrFeedInsertDropped) {
+			t.Fatalf("expected the post past the cap to be dropped, got %v", err)
+		}
+	}
+
+	fi.Close(context.Background())
+
+	if got := conn.uris("seattle_post"); len(got) != 2 {
+		t.Errorf("expected the 2 queued posts to be written on close, got %v", got)
+	}
+}
+
+func TestFeedInserterBlocksWhenFull(t *testing.T) {
+	conn := &fakeInsertConn{rows: map[string][]string{}}
+	fi := newFeedInserter(conn, slog.New(slog.NewTextHandler(io.Discard, nil)), FeedInsertConfig{
+		BatchSize:     100,
+		FlushInterval: time.Hour,
+		MaxQueued:     2,
+		BlockWhenFull: true,
+	})
+	defer fi.Close(context.Background())
+
+	// the third post waits for the first two to be flushed rather than being dropped
+	for i := range 3 {
+		if err := fi.Insert("seattle_post", FeedDatabaseItem{Uri: fmt.Sprintf("at://did:plc:a/app.bsky.feed.post/%d", i)}); err != nil {
+			t.Fatalf("expected post %d to be queued, got %v", i, err)
+		}
+	}
+
+	if err := fi.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.uris("seattle_post"); len(got) != 3 {
+		t.Errorf("expected all 3 posts to be written, got %v", got)
+	}
+}
+
+func TestFeedInserterFlushReturnsErrors(t *testing.T) {
+	conn := &fakeInsertConn{rows: map[string][]string{}, fail: errors.New("clickhouse is down")}
+	fi := newTestFeedInserter(conn, 10)
+	defer fi.Close(context.Background())
+
+	if err := fi.Insert("seattle_post", FeedDatabaseItem{Uri: "at://did:plc:a/app.bsky.feed.post/1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fi.Flush(context.Background()); !errors.Is(err, conn.fail) {
+		t.Errorf("expected the failed batch's error, got %v", err)
+	}
+}
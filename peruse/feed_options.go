@@ -0,0 +1,121 @@
+package peruse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+type ReplyPolicy string
+
+const (
+	// ReplyPolicyNone keeps replies out of the feed, which is the default
+	ReplyPolicyNone ReplyPolicy = "none"
+	// ReplyPolicyRoot only allows direct replies to the root of a thread, so that top level discussion can qualify
+	// without pulling in deep back and forths
+	ReplyPolicyRoot ReplyPolicy = "root"
+	ReplyPolicyAll  ReplyPolicy = "all"
+)
+
+// FeedPostOptions controls which kinds of posts a topic feed will consider. Replies only have entities to match when
+// the server is running NER on replies.
+type FeedPostOptions struct {
+	Replies ReplyPolicy
+	// MinRootLikes is the number of likes a thread's root post needs before replies in the thread are included
+	MinRootLikes uint64
+	Quotes       bool
+}
+
+func DefaultFeedPostOptions() FeedPostOptions {
+	return FeedPostOptions{
+		Replies: ReplyPolicyNone,
+		Quotes:  true,
+	}
+}
+
+// ParseFeedPostOptions parses a feed's post options given as feed=key:value,key:value. Recognized keys are replies
+// (none, root or all), min-root-likes and quotes (true or false). Unset keys keep their defaults.
+func ParseFeedPostOptions(s string) (string, FeedPostOptions, error) {
+	opts := DefaultFeedPostOptions()
+
+	feed, list, ok := strings.Cut(s, "=")
+	if !ok || feed == "" {
+		return "", opts, fmt.Errorf("invalid post options %q, expected feed=key:value,key:value", s)
+	}
+
+	for _, kv := range strings.Split(list, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(kv, ":")
+		if !ok {
+			return "", opts, fmt.Errorf("invalid post option %q in %q, expected key:value", kv, s)
+		}
+
+		switch k {
+		case "replies":
+			switch p := ReplyPolicy(v); p {
+			case ReplyPolicyNone, ReplyPolicyRoot, ReplyPolicyAll:
+				opts.Replies = p
+			default:
+				return "", opts, fmt.Errorf("invalid reply policy %q in %q, expected none, root or all", v, s)
+			}
+		case "min-root-likes":
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return "", opts, fmt.Errorf("invalid min-root-likes in %q: %w", s, err)
+			}
+			opts.MinRootLikes = n
+		case "quotes":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return "", opts, fmt.Errorf("invalid quotes in %q: %w", s, err)
+			}
+			opts.Quotes = b
+		default:
+			return "", opts, fmt.Errorf("unknown post option %q in %q", k, s)
+		}
+	}
+
+	return feed, opts, nil
+}
+
+func (o FeedPostOptions) allowsReply(reply *bsky.FeedPost_ReplyRef) bool {
+	switch o.Replies {
+	case ReplyPolicyAll:
+		return true
+	case ReplyPolicyRoot:
+		return reply.Root != nil && reply.Parent != nil && reply.Parent.Uri == reply.Root.Uri
+	default:
+		return false
+	}
+}
+
+func (s *Server) feedPostOptions(feedName string) FeedPostOptions {
+	if opts, ok := s.args.FeedPostOptions[feedName]; ok {
+		return opts
+	}
+	return DefaultFeedPostOptions()
+}
+
+// repliesWanted reports whether any wikidata feed will consider replies, and so whether replies are worth sending to
+// nervana. Rule feeds match replies without entities, so they don't need them.
+func (s *Server) repliesWanted() bool {
+	for _, cfg := range WikidataFeeds {
+		if s.feedPostOptions(cfg.Name).Replies != ReplyPolicyNone {
+			return true
+		}
+	}
+	return false
+}
+
+func isQuotePost(post *bsky.FeedPost) bool {
+	if post.Embed == nil {
+		return false
+	}
+	return post.Embed.EmbedRecord != nil || post.Embed.EmbedRecordWithMedia != nil
+}
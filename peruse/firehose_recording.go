@@ -0,0 +1,305 @@
+package peruse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/araddon/dateparse"
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A firehose recording is a zstd stream of commit frames, each written as a uvarint length followed by the commit's
+// CBOR encoding. Frames are in the order they were received from the relay.
+
+// maxRecordedFrameSize bounds the frames a reader will allocate for, well above the relay's own limit on commit size
+const maxRecordedFrameSize = 16 << 20
+
+type FirehoseRecorder struct {
+	mu     sync.Mutex
+	f      *os.File
+	zw     *zstd.Encoder
+	buf    bytes.Buffer
+	frames int
+}
+
+func NewFirehoseRecorder(path string) (*FirehoseRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	zw, err := zstd.NewWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &FirehoseRecorder{
+		f:  f,
+		zw: zw,
+	}, nil
+}
+
+func (r *FirehoseRecorder) Write(evt *atproto.SyncSubscribeRepos_Commit) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buf.Reset()
+	if err := evt.MarshalCBOR(&r.buf); err != nil {
+		return fmt.Errorf("failed to encode commit: %w", err)
+	}
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(r.buf.Len()))
+	if _, err := r.zw.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	if _, err := r.zw.Write(r.buf.Bytes()); err != nil {
+		return err
+	}
+
+	r.frames++
+	return nil
+}
+
+// Frames returns how many commits have been written so far
+func (r *FirehoseRecorder) Frames() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.frames
+}
+
+func (r *FirehoseRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.zw.Close(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+type FirehoseReader struct {
+	f  *os.File
+	zr *zstd.Decoder
+	br *bufio.Reader
+}
+
+func OpenFirehoseRecording(path string) (*FirehoseReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &FirehoseReader{
+		f:  f,
+		zr: zr,
+		br: bufio.NewReader(zr),
+	}, nil
+}
+
+// Next returns the next commit in the recording, or io.EOF once there are none left
+func (r *FirehoseReader) Next() (*atproto.SyncSubscribeRepos_Commit, error) {
+	size, err := binary.ReadUvarint(r.br)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxRecordedFrameSize {
+		return nil, fmt.Errorf("recorded frame of %d bytes is too large", size)
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r.br, b); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read recorded frame: %w", err)
+	}
+
+	var evt atproto.SyncSubscribeRepos_Commit
+	if err := evt.UnmarshalCBOR(bytes.NewReader(b)); err != nil {
+		return nil, fmt.Errorf("failed to decode recorded commit: %w", err)
+	}
+
+	return &evt, nil
+}
+
+func (r *FirehoseReader) Close() error {
+	r.zr.Close()
+	return r.f.Close()
+}
+
+type RecordFirehoseArgs struct {
+	Logger    *slog.Logger
+	RelayHost string
+	// Cursor to start the subscription from. Recording starts at the live tip when empty.
+	Cursor string
+	Out    string
+	// Recording stops after Duration or once MaxFrames commits have been written, whichever comes first. Zero means
+	// no limit.
+	Duration  time.Duration
+	MaxFrames int
+}
+
+// RecordFirehose writes the relay's commits to a recording until ctx is done or one of the limits in args is reached,
+// and returns how many commits were written
+func RecordFirehose(ctx context.Context, args RecordFirehoseArgs) (int, error) {
+	logger := args.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	if args.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, args.Duration)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	u, err := url.Parse(args.RelayHost)
+	if err != nil {
+		return 0, err
+	}
+	u.Path = "/xrpc/com.atproto.sync.subscribeRepos"
+	if args.Cursor != "" {
+		u.RawQuery = "cursor=" + args.Cursor
+	}
+
+	rec, err := NewFirehoseRecorder(args.Out)
+	if err != nil {
+		return 0, err
+	}
+
+	var writeErr error
+	rsc := events.RepoStreamCallbacks{
+		RepoCommit: func(evt *atproto.SyncSubscribeRepos_Commit) error {
+			if err := rec.Write(evt); err != nil {
+				writeErr = err
+				cancel()
+				return err
+			}
+			if args.MaxFrames > 0 && rec.Frames() >= args.MaxFrames {
+				cancel()
+			}
+			return nil
+		},
+	}
+
+	logger.Info("connecting to relay", "url", u.String())
+
+	con, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{
+		"user-agent": []string{"peruse/0.0.0"},
+	})
+	if err != nil {
+		rec.Close()
+		return 0, fmt.Errorf("failed to connect to relay: %w", err)
+	}
+
+	// commits are handled one at a time so that they are recorded in the order the relay sent them
+	scheduler := sequential.NewScheduler(con.RemoteAddr().String(), rsc.EventHandler)
+
+	if err := events.HandleRepoStream(ctx, con, scheduler, logger); err != nil && ctx.Err() == nil {
+		logger.Error("repo stream failed", "error", err)
+	}
+
+	if err := rec.Close(); err != nil {
+		return rec.Frames(), fmt.Errorf("failed to finish recording: %w", err)
+	}
+
+	return rec.Frames(), writeErr
+}
+
+// replayFirehose feeds a recording through the same pipeline as the live firehose. Commits are handled one at a
+// time, in recorded order, and are spaced out by their commit times divided by ReplaySpeed. A speed of zero replays
+// as fast as the commits can be handled.
+func (s *Server) replayFirehose(ctx context.Context) error {
+	r, err := OpenFirehoseRecording(s.args.ReplayFile)
+	if err != nil {
+		return fmt.Errorf("failed to open firehose recording: %w", err)
+	}
+	defer r.Close()
+
+	s.logger.Info("replaying firehose recording", "file", s.args.ReplayFile, "speed", s.args.ReplaySpeed)
+
+	var firstEvtTime, replayStart time.Time
+	var frames int
+	for {
+		if err := s.waitWhilePaused(ctx); err != nil {
+			return nil
+		}
+
+		evt, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if s.args.ReplaySpeed > 0 {
+			if evtTime, err := dateparse.ParseAny(evt.Time); err == nil {
+				if firstEvtTime.IsZero() {
+					firstEvtTime, replayStart = evtTime, time.Now()
+				}
+				due := replayStart.Add(time.Duration(float64(evtTime.Sub(firstEvtTime)) / s.args.ReplaySpeed))
+				if wait := time.Until(due); wait > 0 {
+					select {
+					case <-ctx.Done():
+						return nil
+					case <-time.After(wait):
+					}
+				}
+			}
+		}
+
+		s.repoCommit(ctx, evt)
+		frames++
+	}
+
+	s.feedWork.Wait()
+
+	s.logger.Info("finished replaying firehose recording", "file", s.args.ReplayFile, "commits", frames)
+
+	return nil
+}
+
+// waitWhilePaused blocks until the firehose is resumed, and returns an error if ctx is done first
+func (s *Server) waitWhilePaused(ctx context.Context) error {
+	s.firehose.mu.Lock()
+	paused, resumed := s.firehose.paused, s.firehose.resumed
+	s.firehose.mu.Unlock()
+
+	if !paused {
+		return ctx.Err()
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
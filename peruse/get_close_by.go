@@ -6,38 +6,93 @@ import (
 )
 
 type CloseBy struct {
-	SuggestedDid      string `ch:"suggested_did"`
-	BskyUrl           string `ch:"bsky_url"`
-	InteractionScore  uint64 `ch:"interaction_score"`
-	InteractedByCount uint64 `ch:"interacted_by_count"`
-	ConnectionType    string `ch:"connection_type"`
-	BlendedScore      uint64 `ch:"blended_score"`
+	SuggestedDid      string `ch:"suggested_did" json:"suggestedDid"`
+	BskyUrl           string `ch:"bsky_url" json:"bskyUrl"`
+	InteractionScore  uint64 `ch:"interaction_score" json:"interactionScore"`
+	InteractedByCount uint64 `ch:"interacted_by_count" json:"interactedByCount"`
+	ConnectionType    string `ch:"connection_type" json:"connectionType"`
+	BlendedScore      uint64 `ch:"blended_score" json:"blendedScore"`
 }
 
 const (
 	CloseByExistingConnectionWeight = 1
 	NewDiscoveryWeight              = 1
 	TopMutualLimit                  = 500
+	CloseByTimeframe                = 90 * 24 * time.Hour
 )
 
-func (u *User) getCloseBy(ctx context.Context, s *Server) ([]CloseBy, error) {
+// CloseByParams controls how getCloseByQuery weighs accounts you already interact with against new
+// discoveries, and how far back it looks for interactions.
+type CloseByParams struct {
+	ExistingConnectionWeight uint64
+	NewDiscoveryWeight       uint64
+	TopMutualLimit           uint64
+	Timeframe                time.Duration
+}
+
+func DefaultCloseByParams() CloseByParams {
+	return CloseByParams{
+		ExistingConnectionWeight: CloseByExistingConnectionWeight,
+		NewDiscoveryWeight:       NewDiscoveryWeight,
+		TopMutualLimit:           TopMutualLimit,
+		Timeframe:                CloseByTimeframe,
+	}
+}
+
+// withDefaults fills any unset fields from the supplied defaults. Weights may legitimately be zero, so only the
+// limit and timeframe are treated as unset when zero.
+func (p CloseByParams) withDefaults(def CloseByParams) CloseByParams {
+	if p.TopMutualLimit == 0 {
+		p.TopMutualLimit = def.TopMutualLimit
+	}
+	if p.Timeframe <= 0 {
+		p.Timeframe = def.Timeframe
+	}
+	return p
+}
+
+// closeByParamsForUser returns the user's own params if they have set any, otherwise the server's configured params.
+// The user's cached close by is refetched when their params change, since it is keyed by the params it was fetched
+// with. If the user's params can't be read, the configured params are used.
+func (s *Server) closeByParamsForUser(ctx context.Context, u *User) CloseByParams {
+	p, ok, err := s.closeByParams.Get(ctx, u.did)
+	if err != nil {
+		s.logger.Error("error getting close by params for user", "user", u.did, "error", err)
+		return s.args.CloseByParams
+	}
+	if ok {
+		return p.withDefaults(s.args.CloseByParams)
+	}
+
+	return s.args.CloseByParams
+}
+
+func (u *User) getCloseBy(ctx context.Context, s *Server, params CloseByParams) ([]CloseBy, error) {
 	// TODO: this "if you have more than 10" feels a little bit too low?
-	if !time.Now().After(u.closeByExpiresAt) && len(u.following) > 10 {
+	if !time.Now().After(u.closeByExpiresAt) && len(u.following) > 10 && u.closeByFetchedWith == params {
+		observeCacheLookup("close_by", true)
 		return u.closeBy, nil
 	}
 
 	u.mu.Lock()
 	defer u.mu.Unlock()
 
-	if !time.Now().After(u.closeByExpiresAt) && len(u.following) > 10 {
+	if !time.Now().After(u.closeByExpiresAt) && len(u.following) > 10 && u.closeByFetchedWith == params {
+		observeCacheLookup("close_by", true)
 		return u.closeBy, nil
 	}
 
-	var closeBy []CloseBy
-	if err := s.conn.Select(ctx, &closeBy, getCloseByQuery, u.did, CloseByExistingConnectionWeight, NewDiscoveryWeight, TopMutualLimit); err != nil {
+	observeCacheLookup("close_by", false)
+
+	start := time.Now()
+	closeBy, err := s.store.CloseBy(ctx, u.did, params)
+	observeQuery("close_by", start, err)
+	if err != nil {
 		return nil, err
 	}
 
+	u.closeBy = closeBy
+	u.closeByFetchedWith = params
 	u.closeByExpiresAt = time.Now().Add(1 * time.Hour)
 
 	return closeBy, nil
@@ -45,7 +100,7 @@ func (u *User) getCloseBy(ctx context.Context, s *Server) ([]CloseBy, error) {
 
 var getCloseByQuery = `
 WITH ? as your_did,
-    now() - interval 90 day AS timeframe,
+    now() - toIntervalSecond(?) AS timeframe,
     ? as existing_connection_weight,
     ? as new_discovery_weight,
     ? as top_mutual_limit
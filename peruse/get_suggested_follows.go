@@ -13,6 +13,7 @@ type SuggestedFollow struct {
 
 func (u *User) getSuggestedFollows(ctx context.Context, s *Server, showHandles bool) ([]SuggestedFollow, error) {
 	if !time.Now().After(u.suggestedFollowsExpiresAt) {
+		observeCacheLookup("suggested_follows", true)
 		return u.suggestedFollows, nil
 	}
 
@@ -20,15 +21,16 @@ func (u *User) getSuggestedFollows(ctx context.Context, s *Server, showHandles b
 	defer u.mu.Unlock()
 
 	if !time.Now().After(u.suggestedFollowsExpiresAt) {
+		observeCacheLookup("suggested_follows", true)
 		return u.suggestedFollows, nil
 	}
 
-	var suggestedFollows []SuggestedFollow
-	query := getSuggestedFollowsQuery
-	if showHandles {
-		query = getSuggestedFollowsQueryWithHandle
-	}
-	if err := s.conn.Select(ctx, &suggestedFollows, query, u.did); err != nil {
+	observeCacheLookup("suggested_follows", false)
+
+	start := time.Now()
+	suggestedFollows, err := s.store.SuggestedFollows(ctx, u.did, showHandles)
+	observeQuery("suggested_follows", start, err)
+	if err != nil {
 		return nil, err
 	}
 
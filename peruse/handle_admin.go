@@ -0,0 +1,129 @@
+package peruse
+
+import (
+	"sort"
+	"time"
+
+	"github.com/haileyok/peruse/internal/helpers"
+	"github.com/labstack/echo/v4"
+)
+
+type AdminFeed struct {
+	Name           string     `json:"name"`
+	Cached         bool       `json:"cached"`
+	CacheSize      int        `json:"cacheSize"`
+	CachedAt       *time.Time `json:"cachedAt,omitempty"`
+	CacheExpiresAt *time.Time `json:"cacheExpiresAt,omitempty"`
+	CacheAge       string     `json:"cacheAge,omitempty"`
+}
+
+type AdminListFeedsResponse struct {
+	Feeds []AdminFeed `json:"feeds"`
+}
+
+func (s *Server) handleAdminListFeeds(e echo.Context) error {
+	feeds := []AdminFeed{}
+	for name, f := range s.feeds {
+		af := AdminFeed{
+			Name: name,
+		}
+
+		if cf, ok := f.(CachedFeed); ok {
+			info := cf.CacheInfo()
+			af.Cached = true
+			af.CacheSize = info.Size
+			if !info.CachedAt.IsZero() {
+				af.CachedAt = &info.CachedAt
+				af.CacheExpiresAt = &info.ExpiresAt
+				af.CacheAge = time.Since(info.CachedAt).Round(time.Second).String()
+			}
+		}
+
+		feeds = append(feeds, af)
+	}
+
+	sort.Slice(feeds, func(i, j int) bool {
+		return feeds[i].Name < feeds[j].Name
+	})
+
+	return e.JSON(200, AdminListFeedsResponse{
+		Feeds: feeds,
+	})
+}
+
+func (s *Server) handleAdminRefreshFeed(e echo.Context) error {
+	name := e.Param("feed")
+
+	f, ok := s.feeds[name]
+	if !ok {
+		return helpers.InputError(e, "FeedNotFound", "")
+	}
+
+	cf, ok := f.(CachedFeed)
+	if !ok {
+		return helpers.InputError(e, "FeedNotCached", "Feed does not have a cache to refresh")
+	}
+
+	if err := cf.RefreshCache(e.Request().Context()); err != nil {
+		s.logger.Error("error refreshing feed cache", "feed", name, "error", err)
+		return helpers.ServerError(e, "RefreshFailed", err.Error())
+	}
+
+	info := cf.CacheInfo()
+
+	return e.JSON(200, AdminFeed{
+		Name:           name,
+		Cached:         true,
+		CacheSize:      info.Size,
+		CachedAt:       &info.CachedAt,
+		CacheExpiresAt: &info.ExpiresAt,
+		CacheAge:       time.Since(info.CachedAt).Round(time.Second).String(),
+	})
+}
+
+type AdminFirehoseResponse struct {
+	Cursor     string  `json:"cursor"`
+	Paused     bool    `json:"paused"`
+	Lag        string  `json:"lag"`
+	LagSeconds float64 `json:"lagSeconds"`
+}
+
+func (s *Server) firehoseStatus() AdminFirehoseResponse {
+	lag := s.firehose.lag()
+	return AdminFirehoseResponse{
+		Cursor:     s.cursor,
+		Paused:     s.firehose.isPaused(),
+		Lag:        lag.Round(time.Millisecond).String(),
+		LagSeconds: lag.Seconds(),
+	}
+}
+
+func (s *Server) handleAdminGetFirehose(e echo.Context) error {
+	return e.JSON(200, s.firehoseStatus())
+}
+
+func (s *Server) handleAdminPauseFirehose(e echo.Context) error {
+	s.logger.Info("pausing firehose consumer from admin api")
+	s.firehose.pause()
+	return e.JSON(200, s.firehoseStatus())
+}
+
+func (s *Server) handleAdminResumeFirehose(e echo.Context) error {
+	s.logger.Info("resuming firehose consumer from admin api")
+	s.firehose.resume()
+	return e.JSON(200, s.firehoseStatus())
+}
+
+func (s *Server) handleAdminEvictUser(e echo.Context) error {
+	did := e.Param("did")
+	if !s.userManager.evictUser(did) {
+		return helpers.InputError(e, "UserNotFound", "")
+	}
+	return e.NoContent(200)
+}
+
+// handleAdminSetCloseByParams sets a user's own close by params, which take precedence over the server's configured
+// params for that user's feeds
+func (s *Server) handleAdminSetCloseByParams(e echo.Context) error {
+	return s.setCloseByParams(e, e.Param("did"))
+}
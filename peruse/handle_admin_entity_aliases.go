@@ -0,0 +1,51 @@
+package peruse
+
+import (
+	"github.com/haileyok/peruse/internal/helpers"
+	"github.com/labstack/echo/v4"
+)
+
+type AdminListEntityAliasesResponse struct {
+	Aliases []EntityAlias `json:"aliases"`
+}
+
+type AdminSetEntityAliasRequest struct {
+	Alias    string `param:"alias"`
+	EntityId string `json:"entityId"`
+}
+
+func (s *Server) handleAdminListEntityAliases(e echo.Context) error {
+	return e.JSON(200, AdminListEntityAliasesResponse{
+		Aliases: s.entityFeeds.ListAliases(),
+	})
+}
+
+func (s *Server) handleAdminSetEntityAlias(e echo.Context) error {
+	var req AdminSetEntityAliasRequest
+	if err := e.Bind(&req); err != nil {
+		return helpers.InputError(e, "InvalidRequest", err.Error())
+	}
+
+	alias, err := s.entityFeeds.SetAlias(e.Request().Context(), req.Alias, req.EntityId)
+	if err != nil {
+		s.logger.Error("error setting entity alias", "alias", req.Alias, "entity", req.EntityId, "error", err)
+		return helpers.InputError(e, "SetAliasFailed", err.Error())
+	}
+
+	s.logger.Info("set entity alias from admin api", "alias", alias.Alias, "entity", alias.EntityId)
+
+	return e.JSON(200, alias)
+}
+
+func (s *Server) handleAdminDeleteEntityAlias(e echo.Context) error {
+	alias := e.Param("alias")
+
+	if err := s.entityFeeds.DeleteAlias(e.Request().Context(), alias); err != nil {
+		s.logger.Error("error deleting entity alias", "alias", alias, "error", err)
+		return helpers.InputError(e, "DeleteAliasFailed", err.Error())
+	}
+
+	s.logger.Info("deleted entity alias from admin api", "alias", alias)
+
+	return e.NoContent(200)
+}
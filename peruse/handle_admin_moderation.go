@@ -0,0 +1,85 @@
+package peruse
+
+import (
+	"github.com/haileyok/peruse/internal/helpers"
+	"github.com/labstack/echo/v4"
+)
+
+type AdminListModerationResponse struct {
+	Entries []ModerationEntry `json:"entries"`
+}
+
+type AdminBanRequest struct {
+	Subject string `json:"subject"`
+	// Feed to ban the subject from. Leave empty to ban from every feed
+	Feed   string `json:"feed"`
+	Reason string `json:"reason"`
+}
+
+type AdminUnbanRequest struct {
+	Subject string `query:"subject"`
+	Feed    string `query:"feed"`
+}
+
+// isKnownFeedName reports whether name is a registered feed, one of the personalized feeds, or empty for global
+func (s *Server) isKnownFeedName(name string) bool {
+	if name == "" {
+		return true
+	}
+	if _, ok := s.feeds[name]; ok {
+		return true
+	}
+	switch name {
+	case ChronoFeedName, SuggestedFollowsFeedName, CloseByRankedFeedName, EntityFeedsName:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) handleAdminListModeration(e echo.Context) error {
+	return e.JSON(200, AdminListModerationResponse{
+		Entries: s.moderation.List(),
+	})
+}
+
+func (s *Server) handleAdminBan(e echo.Context) error {
+	var req AdminBanRequest
+	if err := e.Bind(&req); err != nil {
+		return helpers.InputError(e, "InvalidRequest", err.Error())
+	}
+
+	if !s.isKnownFeedName(req.Feed) {
+		return helpers.InputError(e, "FeedNotFound", "")
+	}
+
+	entry, err := s.moderation.Ban(e.Request().Context(), req.Subject, req.Feed, req.Reason)
+	if err != nil {
+		s.logger.Error("error adding moderation entry", "subject", req.Subject, "feed", req.Feed, "error", err)
+		return helpers.InputError(e, "BanFailed", err.Error())
+	}
+
+	s.logger.Info("banned subject from admin api", "subject", entry.Subject, "feed", entry.Feed, "reason", entry.Reason)
+
+	return e.JSON(200, entry)
+}
+
+func (s *Server) handleAdminUnban(e echo.Context) error {
+	var req AdminUnbanRequest
+	if err := e.Bind(&req); err != nil {
+		return helpers.InputError(e, "InvalidRequest", err.Error())
+	}
+
+	if !s.isKnownFeedName(req.Feed) {
+		return helpers.InputError(e, "FeedNotFound", "")
+	}
+
+	if err := s.moderation.Unban(e.Request().Context(), req.Subject, req.Feed); err != nil {
+		s.logger.Error("error removing moderation entry", "subject", req.Subject, "feed", req.Feed, "error", err)
+		return helpers.InputError(e, "UnbanFailed", err.Error())
+	}
+
+	s.logger.Info("unbanned subject from admin api", "subject", req.Subject, "feed", req.Feed)
+
+	return e.NoContent(200)
+}
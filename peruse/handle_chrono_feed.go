@@ -13,7 +13,7 @@ func (s *Server) handleChronoFeed(e echo.Context, req FeedSkeletonRequest) error
 	ctx := e.Request().Context()
 	u := e.Get("user").(*User)
 
-	closeBy, err := u.getCloseBy(ctx, s)
+	closeBy, err := u.getCloseBy(ctx, s, s.closeByParamsForUser(ctx, u))
 	if err != nil {
 		s.logger.Error("error getting close by for user", "user", u.did, "error", err)
 		return helpers.ServerError(e, "FeedError", "")
@@ -21,15 +21,21 @@ func (s *Server) handleChronoFeed(e echo.Context, req FeedSkeletonRequest) error
 
 	cbdids := []string{}
 	for _, cb := range closeBy {
+		if cb.SuggestedDid == u.did {
+			continue
+		}
 		cbdids = append(cbdids, cb.SuggestedDid)
 	}
-	cbdids = cbdids[1:] // remove self
+
+	if len(cbdids) == 0 {
+		return helpers.ServerError(e, "FeedError", "Not enough posts")
+	}
 
 	if req.Cursor == "" {
 		req.Cursor = DefaultCursor // hack for simplicity...
 	}
 
-	posts, err := s.getPostsForDidsChronological(ctx, cbdids, req.Cursor)
+	posts, err := s.getPostsForDidsChronological(ctx, cbdids, req.Cursor, s.args.ChronoFeedIncludeReposts)
 	if err != nil {
 		s.logger.Error("error getting close by chrono posts", "error", err)
 		return helpers.ServerError(e, "FeedError", "")
@@ -39,7 +45,7 @@ func (s *Server) handleChronoFeed(e echo.Context, req FeedSkeletonRequest) error
 		return helpers.ServerError(e, "FeedError", "Not enough posts")
 	}
 
-	fpis, cursor := modelPostsToFeedItems(posts)
+	fpis, cursor := chronoPostsToFeedItems(posts, closeByContextFunc(closeBy), s.isModeratedChronoPost(ChronoFeedName))
 
 	return e.JSON(200, FeedSkeletonResponse{
 		Cursor: &cursor,
@@ -0,0 +1,65 @@
+package peruse
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChronoFeedMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := newTestMemoryServer(t)
+	s.args.CloseByParams = DefaultCloseByParams()
+	ms := s.store.(*MemoryStore)
+
+	const (
+		viewer = "did:plc:viewer"
+		mutual = "did:plc:mutual"
+	)
+	now := time.Now()
+
+	// the store leaves the viewer out of their own close by, so every account it returns is served
+	recordTestLike(t, ms, viewer, testPostUri(mutual, 1), now)
+	recordTestLike(t, ms, mutual, testPostUri(viewer, 1), now)
+	authors := []string{"did:plc:author0", "did:plc:author1"}
+	for i, author := range authors {
+		recordTestLike(t, ms, mutual, testPostUri(author, 0), now)
+		if err := ms.RecordPost(ctx, StoredPost{Uri: testPostUri(author, 1), Did: author, Rkey: "1", CreatedAt: now.Add(-time.Duration(i+1) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serve := func(did string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e := s.echo.NewContext(httptest.NewRequest(http.MethodGet, "/xrpc/app.bsky.feed.getFeedSkeleton", nil), rec)
+		e.Set("user", NewUser(did))
+		if err := s.handleChronoFeed(e, FeedSkeletonRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	rec := serve(viewer)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var resp FeedSkeletonResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, item := range resp.Feed {
+		got = append(got, item.Post)
+	}
+	if want := []string{testPostUri(authors[0], 1), testPostUri(authors[1], 1)}; !equalStrings(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// a viewer without any close by gets an error rather than a panic
+	if rec := serve("did:plc:newcomer"); rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected %d for a viewer without close by, got %d", http.StatusInternalServerError, rec.Code)
+	}
+}
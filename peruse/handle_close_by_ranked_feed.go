@@ -0,0 +1,294 @@
+package peruse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haileyok/peruse/internal/helpers"
+	"github.com/haileyok/photocopy/models"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	CloseByMixPostsPerAuthor = 2
+	CloseByMixExistingRatio  = 2
+	CloseByMixDiscoveryRatio = 1
+	CloseByMixPageSize       = 30
+	CloseByMixLookback       = 48 * time.Hour
+	CloseByMixDecay          = 0.1
+
+	// the ranked pages are kept for each viewer's snapshot, so that paging doesn't rerank and can't repeat or skip
+	// posts when the viewer's close by or the posts in range change between requests
+	maxCloseByRankedSnapshots = 1_000
+	closeByRankedSnapshotTTL  = 15 * time.Minute
+)
+
+type closeByRankedKey struct {
+	did      string
+	snapshot int64
+}
+
+// CloseByMixParams controls how the ranked close by feed blends posts from existing connections and new discoveries
+type CloseByMixParams struct {
+	// Maximum number of posts from a single author on one page
+	PostsPerAuthor int
+	// For every ExistingRatio posts from existing connections, DiscoveryRatio posts from new discoveries are served
+	ExistingRatio  int
+	DiscoveryRatio int
+	PageSize       int
+	Lookback       time.Duration
+}
+
+func DefaultCloseByMixParams() CloseByMixParams {
+	return CloseByMixParams{
+		PostsPerAuthor: CloseByMixPostsPerAuthor,
+		ExistingRatio:  CloseByMixExistingRatio,
+		DiscoveryRatio: CloseByMixDiscoveryRatio,
+		PageSize:       CloseByMixPageSize,
+		Lookback:       CloseByMixLookback,
+	}
+}
+
+func (p CloseByMixParams) withDefaults(def CloseByMixParams) CloseByMixParams {
+	if p.PostsPerAuthor <= 0 {
+		p.PostsPerAuthor = def.PostsPerAuthor
+	}
+	if p.ExistingRatio < 0 {
+		p.ExistingRatio = def.ExistingRatio
+	}
+	if p.DiscoveryRatio < 0 {
+		p.DiscoveryRatio = def.DiscoveryRatio
+	}
+	if p.ExistingRatio == 0 && p.DiscoveryRatio == 0 {
+		p.ExistingRatio = def.ExistingRatio
+		p.DiscoveryRatio = def.DiscoveryRatio
+	}
+	if p.PageSize <= 0 {
+		p.PageSize = def.PageSize
+	}
+	if p.Lookback <= 0 {
+		p.Lookback = def.Lookback
+	}
+	return p
+}
+
+type closeByRankedPost struct {
+	uri         string
+	did         string
+	score       float64
+	feedContext string
+}
+
+// handleCloseByRankedFeed serves posts from the user's close by accounts, weighted by each author's blended score.
+// The cursor is made up of the time the first page was generated and the page index. The pages ranked for the first
+// page are cached for that snapshot and later pages are read from them, so the ordering is stable while paginating.
+// If the snapshot has expired the pages are ranked again from the same time.
+func (s *Server) handleCloseByRankedFeed(e echo.Context, req FeedSkeletonRequest) error {
+	ctx := e.Request().Context()
+	u := e.Get("user").(*User)
+
+	snapshot := time.Now().UTC().Truncate(time.Second)
+	page := 0
+	if req.Cursor != "" {
+		var err error
+		snapshot, page, err = parseCloseByRankedCursor(req.Cursor)
+		if err != nil {
+			return helpers.InputError(e, "InvalidCursor", "")
+		}
+	}
+
+	key := closeByRankedKey{did: u.did, snapshot: snapshot.Unix()}
+	pages, ok := s.closeByRankedPages.Get(key)
+	if !ok {
+		var err error
+		pages, err = s.rankCloseByFeed(ctx, u, snapshot)
+		if errors.Is(err, errNoCloseBy) {
+			return helpers.ServerError(e, "FeedError", "Not enough posts")
+		}
+		if err != nil {
+			s.logger.Error("error ranking close by posts", "user", u.did, "error", err)
+			return helpers.ServerError(e, "FeedError", "")
+		}
+		s.closeByRankedPages.Add(key, pages)
+	}
+
+	if page >= len(pages) {
+		return e.JSON(200, FeedSkeletonResponse{
+			Feed: []FeedPostItem{},
+		})
+	}
+
+	items := []FeedPostItem{}
+	for _, p := range pages[page] {
+		// posts moderated since the pages were ranked are still left out
+		if s.isExcluded(CloseByRankedFeedName, p.did, p.uri) {
+			continue
+		}
+		items = append(items, FeedPostItem{
+			Post:        p.uri,
+			FeedContext: &p.feedContext,
+		})
+	}
+
+	var cursor *string
+	if page+1 < len(pages) {
+		c := makeCloseByRankedCursor(snapshot, page+1)
+		cursor = &c
+	}
+
+	return e.JSON(200, FeedSkeletonResponse{
+		Cursor: cursor,
+		Feed:   items,
+	})
+}
+
+var errNoCloseBy = errors.New("no close by accounts")
+
+// rankCloseByFeed ranks the posts of the user's close by accounts from the lookback before snapshot into pages
+func (s *Server) rankCloseByFeed(ctx context.Context, u *User, snapshot time.Time) ([][]closeByRankedPost, error) {
+	params := s.args.CloseByMixParams
+
+	closeBy, err := u.getCloseBy(ctx, s, s.closeByParamsForUser(ctx, u))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get close by: %w", err)
+	}
+
+	closeByMap := map[string]CloseBy{}
+	cbdids := []string{}
+	for _, cb := range closeBy {
+		if cb.SuggestedDid == u.did {
+			continue
+		}
+		closeByMap[cb.SuggestedDid] = cb
+		cbdids = append(cbdids, cb.SuggestedDid)
+	}
+
+	if len(cbdids) == 0 {
+		return nil, errNoCloseBy
+	}
+
+	posts, err := s.getPostsForDidsInRange(ctx, cbdids, snapshot.Add(-params.Lookback), snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get posts: %w", err)
+	}
+
+	unmoderated := posts[:0]
+	for _, p := range posts {
+		if s.isExcluded(CloseByRankedFeedName, p.Did, p.Uri) {
+			continue
+		}
+		unmoderated = append(unmoderated, p)
+	}
+
+	return rankCloseByPosts(unmoderated, closeByMap, snapshot, params), nil
+}
+
+// rankCloseByPosts scores each post by its author's blended score with a time decay, interleaves existing connections
+// and new discoveries at the configured ratio, then splits the result into pages while capping the number of posts
+// per author on each page. Posts over the cap are pushed to the next page rather than dropped.
+func rankCloseByPosts(posts []models.Post, closeBy map[string]CloseBy, now time.Time, params CloseByMixParams) [][]closeByRankedPost {
+	var existing, discovery []closeByRankedPost
+	for _, p := range posts {
+		cb, ok := closeBy[p.Did]
+		if !ok {
+			continue
+		}
+
+		hoursOld := now.Sub(p.CreatedAt).Hours()
+		if hoursOld < 0 {
+			hoursOld = 0
+		}
+
+		rp := closeByRankedPost{
+			uri:         p.Uri,
+			did:         p.Did,
+			score:       float64(cb.BlendedScore) * math.Exp(-CloseByMixDecay*hoursOld),
+			feedContext: closeByFeedContext(cb),
+		}
+
+		if cb.ConnectionType == "existing_connection" {
+			existing = append(existing, rp)
+		} else {
+			discovery = append(discovery, rp)
+		}
+	}
+
+	sortRanked := func(rps []closeByRankedPost) {
+		sort.SliceStable(rps, func(i, j int) bool {
+			if rps[i].score != rps[j].score {
+				return rps[i].score > rps[j].score
+			}
+			return rps[i].uri > rps[j].uri
+		})
+	}
+	sortRanked(existing)
+	sortRanked(discovery)
+
+	merged := make([]closeByRankedPost, 0, len(existing)+len(discovery))
+	for len(existing) > 0 || len(discovery) > 0 {
+		for i := 0; i < params.ExistingRatio && len(existing) > 0; i++ {
+			merged = append(merged, existing[0])
+			existing = existing[1:]
+		}
+		for i := 0; i < params.DiscoveryRatio && len(discovery) > 0; i++ {
+			merged = append(merged, discovery[0])
+			discovery = discovery[1:]
+		}
+		if params.ExistingRatio == 0 && len(discovery) == 0 {
+			merged = append(merged, existing...)
+			existing = nil
+		}
+		if params.DiscoveryRatio == 0 && len(existing) == 0 {
+			merged = append(merged, discovery...)
+			discovery = nil
+		}
+	}
+
+	var pages [][]closeByRankedPost
+	pending := merged
+	for len(pending) > 0 {
+		var page, deferred []closeByRankedPost
+		perAuthor := map[string]int{}
+		for _, rp := range pending {
+			if len(page) >= params.PageSize || perAuthor[rp.did] >= params.PostsPerAuthor {
+				deferred = append(deferred, rp)
+				continue
+			}
+			perAuthor[rp.did]++
+			page = append(page, rp)
+		}
+		pages = append(pages, page)
+		pending = deferred
+	}
+
+	return pages
+}
+
+func makeCloseByRankedCursor(snapshot time.Time, page int) string {
+	return fmt.Sprintf("%d::%d", snapshot.Unix(), page)
+}
+
+func parseCloseByRankedCursor(cursor string) (time.Time, int, error) {
+	pts := strings.Split(cursor, "::")
+	if len(pts) != 2 {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+
+	ts, err := strconv.ParseInt(pts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor timestamp: %w", err)
+	}
+
+	page, err := strconv.Atoi(pts[1])
+	if err != nil || page < 0 {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor page %q", pts[1])
+	}
+
+	return time.Unix(ts, 0).UTC(), page, nil
+}
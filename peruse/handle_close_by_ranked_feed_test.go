@@ -0,0 +1,101 @@
+package peruse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func getCloseByRankedPage(t *testing.T, s *Server, viewer, cursor string) FeedSkeletonResponse {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/xrpc/app.bsky.feed.getFeedSkeleton?"+url.Values{"cursor": {cursor}}.Encode(), nil)
+	rec := httptest.NewRecorder()
+	e := s.echo.NewContext(req, rec)
+	e.Set("user", s.userManager.getUser(viewer))
+
+	if err := s.handleCloseByRankedFeed(e, FeedSkeletonRequest{Cursor: cursor}); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var resp FeedSkeletonResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestCloseByRankedFeedPagesFromSnapshot(t *testing.T) {
+	ctx := context.Background()
+	s := newTestMemoryServer(t)
+	s.args.CloseByParams = DefaultCloseByParams()
+	s.args.CloseByMixParams = DefaultCloseByMixParams()
+	ms := s.store.(*MemoryStore)
+
+	const (
+		viewer = "did:plc:viewer"
+		mutual = "did:plc:mutual"
+	)
+	now := time.Now()
+
+	// the mutual likes five authors, who each have ten posts, so that each page holds two posts per author
+	recordTestLike(t, ms, viewer, testPostUri(mutual, 1), now)
+	recordTestLike(t, ms, mutual, testPostUri(viewer, 1), now)
+	var authors []string
+	for i := range 5 {
+		author := fmt.Sprintf("did:plc:author%d", i)
+		authors = append(authors, author)
+		recordTestLike(t, ms, mutual, testPostUri(author, 0), now)
+		for j := range 10 {
+			if err := ms.RecordPost(ctx, StoredPost{Uri: testPostUri(author, j+1), Did: author, CreatedAt: now.Add(-time.Duration(i*10+j+1) * time.Minute)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	first := getCloseByRankedPage(t, s, viewer, "")
+	if len(first.Feed) != 10 || first.Cursor == nil {
+		t.Fatalf("expected a full first page with a cursor, got %d posts", len(first.Feed))
+	}
+
+	// posts indexed late and a change of close by don't move posts between the pages of the snapshot
+	for _, author := range authors {
+		if err := ms.RecordPost(ctx, StoredPost{Uri: testPostUri(author, 100), Did: author, CreatedAt: now.Add(-30 * time.Second)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.userManager.evictUser(viewer)
+
+	seen := map[string]bool{}
+	for _, item := range first.Feed {
+		seen[item.Post] = true
+	}
+	cursor := first.Cursor
+	for cursor != nil {
+		page := getCloseByRankedPage(t, s, viewer, *cursor)
+		for _, item := range page.Feed {
+			if seen[item.Post] {
+				t.Fatalf("%s was served twice", item.Post)
+			}
+			seen[item.Post] = true
+		}
+		cursor = page.Cursor
+	}
+
+	if len(seen) != 50 {
+		t.Errorf("expected the 50 posts of the snapshot, got %d", len(seen))
+	}
+	for _, author := range authors {
+		if seen[testPostUri(author, 100)] {
+			t.Errorf("expected the late post by %s to be left out of the snapshot", author)
+		}
+	}
+}
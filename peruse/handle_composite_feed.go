@@ -0,0 +1,268 @@
+package peruse
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/haileyok/peruse/internal/helpers"
+	"github.com/haileyok/peruse/wikidata"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	compositeCacheTTL = 1 * time.Minute
+	// compositeSnapshotTTL is how long a ranking is kept around after it is replaced, so that viewers paging through
+	// it keep getting consistent pages
+	compositeSnapshotTTL = 15 * time.Minute
+	compositePageSize    = 30
+)
+
+// CompositeFeedConfig defines a feed made by combining other registered feeds. See parseCompositeExpr for the syntax.
+type CompositeFeedConfig struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+}
+
+// CompositeFeed ranks the posts of other feeds combined with set operations. It doesn't ingest anything itself, and
+// operand feeds are looked up through the server's feeds whenever the ranking is rebuilt.
+type CompositeFeed struct {
+	logger     *slog.Logger
+	feeds      map[string]Feed
+	expr       compositeNode
+	isExcluded func(feedName, did, uri string) bool
+	feedName   string
+
+	mu             sync.RWMutex
+	cached         []RankedFeedPost
+	cachedAt       time.Time
+	cacheExpiresAt time.Time
+	snapshots      *expirable.LRU[int64, []RankedFeedPost]
+}
+
+func NewCompositeFeed(s *Server, cfg CompositeFeedConfig) (*CompositeFeed, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("composite feeds need a name")
+	}
+
+	expr, err := parseCompositeExpr(cfg.Expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression for composite feed %s: %w", cfg.Name, err)
+	}
+
+	for _, name := range expr.feedNames() {
+		f, ok := s.feeds[name]
+		if !ok {
+			return nil, fmt.Errorf("composite feed %s references unknown feed %s", cfg.Name, name)
+		}
+		if _, ok := f.(RankedSource); !ok {
+			return nil, fmt.Errorf("composite feed %s references %s, which can't be combined", cfg.Name, name)
+		}
+	}
+
+	return &CompositeFeed{
+		logger:     s.logger.With("feed", cfg.Name),
+		feeds:      s.feeds,
+		expr:       expr,
+		isExcluded: s.isExcluded,
+		feedName:   cfg.Name,
+		snapshots:  expirable.NewLRU[int64, []RankedFeedPost](64, nil, compositeSnapshotTTL),
+	}, nil
+}
+
+func (f *CompositeFeed) Name() string {
+	return f.feedName
+}
+
+func (f *CompositeFeed) RequiresAuth() bool {
+	return false
+}
+
+// FeedSkeleton pages through a snapshot of the ranking. The cursor holds the snapshot's id and an offset into it, so
+// refreshes of the operand feeds don't shuffle posts between pages. If the snapshot has expired the current ranking
+// is used from the same offset.
+func (f *CompositeFeed) FeedSkeleton(e echo.Context, req FeedSkeletonRequest) error {
+	ctx := e.Request().Context()
+
+	var posts []RankedFeedPost
+	var snapshot int64
+	offset := 0
+	if req.Cursor != "" {
+		var err error
+		snapshot, offset, err = parseCompositeCursor(req.Cursor)
+		if err != nil {
+			return helpers.InputError(e, "InvalidCursor", "")
+		}
+		posts, _ = f.snapshots.Get(snapshot)
+	}
+
+	if posts == nil {
+		var err error
+		posts, snapshot, err = f.getPosts(ctx)
+		if err != nil {
+			f.logger.Error("error getting posts", "error", err)
+			return helpers.ServerError(e, "FeedError", "Unable to get posts for feed")
+		}
+	}
+
+	posts = f.filterModerated(posts)
+	posts = filterLangs(posts, req.ViewerLangs)
+
+	if offset > len(posts) {
+		offset = len(posts)
+	}
+
+	page := posts[offset:]
+	if len(page) > compositePageSize {
+		page = page[:compositePageSize]
+	}
+
+	items := make([]FeedPostItem, 0, len(page))
+	for _, p := range page {
+		items = append(items, FeedPostItem{
+			Post: p.Uri,
+		})
+	}
+
+	newCursor := makeCompositeCursor(snapshot, offset+len(page))
+
+	return e.JSON(200, FeedSkeletonResponse{
+		Feed:   items,
+		Cursor: &newCursor,
+	})
+}
+
+func makeCompositeCursor(snapshot int64, offset int) string {
+	return fmt.Sprintf("%d::%d", snapshot, offset)
+}
+
+func parseCompositeCursor(cursor string) (int64, int, error) {
+	snapshotStr, offsetStr, ok := strings.Cut(cursor, "::")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid cursor")
+	}
+	snapshot, err := strconv.ParseInt(snapshotStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	offset, err := strconv.Atoi(offsetStr)
+	if err != nil || offset < 0 {
+		return 0, 0, fmt.Errorf("invalid cursor offset")
+	}
+	return snapshot, offset, nil
+}
+
+func (f *CompositeFeed) OnPost(ctx context.Context, post *bsky.FeedPost, uri, did, rkey, cid string, indexedAt time.Time, nerItems []wikidata.EntityMatch) error {
+	return nil
+}
+
+func (f *CompositeFeed) OnLike(ctx context.Context, like *bsky.FeedLike, uri, did, rkey, cid string, indexedAt time.Time) error {
+	return nil
+}
+
+func (f *CompositeFeed) OnRepost(ctx context.Context, repost *bsky.FeedRepost, uri, did, rkey, cid string, indexedAt time.Time) error {
+	return nil
+}
+
+// RankedPosts lets composite feeds be used as operands of other composite feeds
+func (f *CompositeFeed) RankedPosts(ctx context.Context) ([]RankedFeedPost, error) {
+	posts, _, err := f.getPosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return f.filterModerated(posts), nil
+}
+
+// filterModerated drops posts banned or labeled out of the composite feed itself. Operand feeds have already removed
+// posts moderated out of them.
+func (f *CompositeFeed) filterModerated(posts []RankedFeedPost) []RankedFeedPost {
+	filtered := make([]RankedFeedPost, 0, len(posts))
+	for _, p := range posts {
+		did := ""
+		if aturi, err := syntax.ParseATURI(p.Uri); err == nil {
+			did = aturi.Authority().String()
+		}
+		if f.isExcluded(f.feedName, did, p.Uri) {
+			continue
+		}
+		filtered = append(filtered, p)
+	}
+	return filtered
+}
+
+// getPosts returns the current ranking and its snapshot id
+func (f *CompositeFeed) getPosts(ctx context.Context) ([]RankedFeedPost, int64, error) {
+	now := time.Now()
+	f.mu.RLock()
+	expiresAt := f.cacheExpiresAt
+	posts := f.cached
+	cachedAt := f.cachedAt
+	f.mu.RUnlock()
+	if posts != nil && now.Before(expiresAt) {
+		observeCacheLookup("feed_posts", true)
+		return posts, cachedAt.UnixMilli(), nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cached != nil && now.Before(f.cacheExpiresAt) {
+		observeCacheLookup("feed_posts", true)
+		return f.cached, f.cachedAt.UnixMilli(), nil
+	}
+
+	observeCacheLookup("feed_posts", false)
+
+	posts, err := f.refreshPostsLocked(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return posts, f.cachedAt.UnixMilli(), nil
+}
+
+// refreshPostsLocked rebuilds the ranking from the operand feeds and keeps it as a snapshot. f.mu must be held.
+func (f *CompositeFeed) refreshPostsLocked(ctx context.Context) ([]RankedFeedPost, error) {
+	posts, err := f.expr.eval(ctx, f.feeds)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	// snapshot ids have to be unique, which they wouldn't be if two refreshes landed in the same millisecond
+	if !f.cachedAt.IsZero() && now.UnixMilli() <= f.cachedAt.UnixMilli() {
+		now = f.cachedAt.Add(time.Millisecond)
+	}
+
+	f.cached = posts
+	f.cachedAt = now
+	f.cacheExpiresAt = now.Add(compositeCacheTTL)
+	f.snapshots.Add(now.UnixMilli(), posts)
+
+	return posts, nil
+}
+
+func (f *CompositeFeed) RefreshCache(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, err := f.refreshPostsLocked(ctx)
+	return err
+}
+
+func (f *CompositeFeed) CacheInfo() FeedCacheInfo {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return FeedCacheInfo{
+		CachedAt:  f.cachedAt,
+		ExpiresAt: f.cacheExpiresAt,
+		Size:      len(f.cached),
+	}
+}
@@ -18,6 +18,10 @@ func (s *Server) handleDescribeFeedGenerator(e echo.Context) error {
 		makeFeedUri(s.args.FeedOwnerDid, s.args.ChronoFeedRkey),
 	}
 
+	if s.args.CloseByRankedRkey != "" {
+		feedUris = append(feedUris, makeFeedUri(s.args.FeedOwnerDid, s.args.CloseByRankedRkey))
+	}
+
 	return e.JSON(200, &describeFeedGeneratorResponse{
 		Did:   s.args.ServiceDid,
 		Feeds: feedUris,
@@ -1,14 +1,28 @@
 package peruse
 
 import (
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/haileyok/peruse/internal/helpers"
 	"github.com/labstack/echo/v4"
 )
 
+// Names for the personalized feeds, which are served by rkey rather than registered with addFeed. These are used for
+// metrics and moderation.
+const (
+	ChronoFeedName           = "chrono"
+	SuggestedFollowsFeedName = "suggested-follows"
+	CloseByRankedFeedName    = "close-by-ranked"
+)
+
 type FeedSkeletonRequest struct {
 	Feed   string `query:"feed"`
 	Cursor string `query:"cursor"`
+	// ViewerLangs comes from the Accept-Language header that the AppView forwards from the viewer's client
+	ViewerLangs []string
 }
 
 type FeedSkeletonResponse struct {
@@ -17,8 +31,25 @@ type FeedSkeletonResponse struct {
 }
 
 type FeedPostItem struct {
-	Post   string  `json:"post"`
-	Reason *string `json:"reason,omitempty"`
+	Post        string          `json:"post"`
+	Reason      *FeedPostReason `json:"reason,omitempty"`
+	FeedContext *string         `json:"feedContext,omitempty"`
+}
+
+const (
+	SkeletonReasonRepost = "app.bsky.feed.defs#skeletonReasonRepost"
+)
+
+type FeedPostReason struct {
+	Type   string `json:"$type"`
+	Repost string `json:"repost,omitempty"`
+}
+
+func newRepostReason(repostUri string) *FeedPostReason {
+	return &FeedPostReason{
+		Type:   SkeletonReasonRepost,
+		Repost: repostUri,
+	}
 }
 
 func (s *Server) handleFeedSkeleton(e echo.Context) error {
@@ -27,25 +58,69 @@ func (s *Server) handleFeedSkeleton(e echo.Context) error {
 		s.logger.Error("unable to bind feed skeleton request", "error", err)
 		return helpers.ServerError(e, "", "")
 	}
+	req.ViewerLangs = parseAcceptLanguage(e.Request().Header.Get("Accept-Language"))
 
 	aturi, err := syntax.ParseATURI(req.Feed)
 	if err != nil {
 		return helpers.InputError(e, "InvalidFeed", "")
 	}
 
+	start := time.Now()
+	defer func() {
+		feedSkeletonDuration.WithLabelValues(s.metricsFeedName(aturi.RecordKey().String()), strconv.Itoa(e.Response().Status)).Observe(time.Since(start).Seconds())
+	}()
+
 	feed, exists := s.feeds[aturi.RecordKey().String()]
+	if !exists && s.entityFeeds != nil && strings.HasPrefix(aturi.RecordKey().String(), EntityFeedRkeyPrefix) {
+		return s.entityFeeds.FeedSkeleton(e, req, aturi.RecordKey().String())
+	}
+
 	if !exists {
+		// all of the personalized feeds below need a viewer
+		if userFromContext(e) == nil {
+			return helpers.UnauthorizedError(e, "AuthRequired", "This feed requires authentication")
+		}
+
 		// TODO: refactor these feeds to work with addFeed
-		switch aturi.RecordKey().String() {
-		case s.args.ChronoFeedRkey:
+		switch rkey := aturi.RecordKey().String(); {
+		case rkey == s.args.ChronoFeedRkey:
 			return s.handleChronoFeed(e, req)
-		case s.args.SuggestedFollowsRkey:
+		case rkey == s.args.SuggestedFollowsRkey:
 			return s.handleSuggestedFollowsFeed(e, req)
+		case s.args.CloseByRankedRkey != "" && rkey == s.args.CloseByRankedRkey:
+			return s.handleCloseByRankedFeed(e, req)
 		default:
 			s.logger.Warn("invalid feed requested", "requested-feed", req.Feed)
 			return helpers.InputError(e, "FeedNotFound", "")
 		}
 	}
 
+	if feed.RequiresAuth() && userFromContext(e) == nil {
+		return helpers.UnauthorizedError(e, "AuthRequired", "This feed requires authentication")
+	}
+
 	return feed.FeedSkeleton(e, req)
 }
+
+// metricsFeedName returns the feed name to use as a metrics label, so that requests for feeds that don't exist can't
+// create new label values
+func (s *Server) metricsFeedName(rkey string) string {
+	if _, ok := s.feeds[rkey]; ok {
+		return rkey
+	}
+
+	if strings.HasPrefix(rkey, EntityFeedRkeyPrefix) {
+		return EntityFeedsName
+	}
+
+	switch rkey {
+	case s.args.ChronoFeedRkey:
+		return ChronoFeedName
+	case s.args.SuggestedFollowsRkey:
+		return SuggestedFollowsFeedName
+	case s.args.CloseByRankedRkey:
+		return CloseByRankedFeedName
+	default:
+		return "unknown"
+	}
+}
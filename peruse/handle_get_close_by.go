@@ -0,0 +1,84 @@
+package peruse
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type GetCloseByRequest struct {
+	Handle                   string  `query:"handle"`
+	ExistingConnectionWeight *uint64 `query:"existingConnectionWeight"`
+	NewDiscoveryWeight       *uint64 `query:"newDiscoveryWeight"`
+	TopMutualLimit           *uint64 `query:"topMutualLimit"`
+	Timeframe                string  `query:"timeframe"`
+}
+
+type GetCloseByResponse struct {
+	Params  GetCloseByParamsView `json:"params"`
+	CloseBy []CloseBy            `json:"closeBy"`
+}
+
+type GetCloseByParamsView struct {
+	ExistingConnectionWeight uint64 `json:"existingConnectionWeight"`
+	NewDiscoveryWeight       uint64 `json:"newDiscoveryWeight"`
+	TopMutualLimit           uint64 `json:"topMutualLimit"`
+	Timeframe                string `json:"timeframe"`
+}
+
+// handleGetCloseBy is an admin debug endpoint for trying out different close by params for a given user without
+// affecting that user's cached results. It exposes the user's interaction graph, so it is only served on the admin
+// router.
+func (s *Server) handleGetCloseBy(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	var req GetCloseByRequest
+	if err := e.Bind(&req); err != nil {
+		return e.String(400, err.Error())
+	}
+
+	if req.Handle == "" {
+		return e.String(400, "no input handle provided")
+	}
+
+	params := s.args.CloseByParams
+	if req.ExistingConnectionWeight != nil {
+		params.ExistingConnectionWeight = *req.ExistingConnectionWeight
+	}
+	if req.NewDiscoveryWeight != nil {
+		params.NewDiscoveryWeight = *req.NewDiscoveryWeight
+	}
+	if req.TopMutualLimit != nil {
+		params.TopMutualLimit = *req.TopMutualLimit
+	}
+	if req.Timeframe != "" {
+		tf, err := time.ParseDuration(req.Timeframe)
+		if err != nil {
+			return e.String(400, fmt.Sprintf("invalid timeframe: %v", err))
+		}
+		params.Timeframe = tf
+	}
+	params = params.withDefaults(s.args.CloseByParams).clamped()
+
+	ident, err := s.resolveIdentity(ctx, req.Handle)
+	if err != nil {
+		return e.String(400, fmt.Sprintf("error looking up handle: %v", err))
+	}
+
+	u := NewUser(ident.DID.String())
+	closeBy, err := u.getCloseBy(ctx, s, params)
+	if err != nil {
+		return e.String(400, fmt.Sprintf("error getting close by: %v", err))
+	}
+
+	return e.JSON(200, GetCloseByResponse{
+		Params: GetCloseByParamsView{
+			ExistingConnectionWeight: params.ExistingConnectionWeight,
+			NewDiscoveryWeight:       params.NewDiscoveryWeight,
+			TopMutualLimit:           params.TopMutualLimit,
+			Timeframe:                params.Timeframe.String(),
+		},
+		CloseBy: closeBy,
+	})
+}
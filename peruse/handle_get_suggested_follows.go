@@ -1,22 +1,113 @@
 package peruse
 
 import (
+	"bytes"
 	"fmt"
-	"strings"
+	"html/template"
+	"strconv"
 
-	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/haileyok/peruse/internal/helpers"
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	SuggestedFollowsDefaultLimit = 50
+	SuggestedFollowsMaxLimit     = 100
+)
+
 type GetSuggestedFollowsRequest struct {
+	Limit  int    `query:"limit"`
+	Cursor string `query:"cursor"`
+}
+
+type GetSuggestedFollowsResponse struct {
+	Cursor      *string                  `json:"cursor,omitempty"`
+	Suggestions []SuggestedFollowsResult `json:"suggestions"`
+}
+
+type SuggestedFollowsResult struct {
+	Did             string `json:"did"`
+	FollowedByCount uint64 `json:"followedByCount"`
+}
+
+// handleGetSuggestedFollowsXrpc returns suggested follows for the authenticated viewer, paginated by offset into the
+// viewer's cached suggestions
+func (s *Server) handleGetSuggestedFollowsXrpc(e echo.Context) error {
+	ctx := e.Request().Context()
+	u := e.Get("user").(*User)
+
+	var req GetSuggestedFollowsRequest
+	if err := e.Bind(&req); err != nil {
+		return helpers.InputError(e, "InvalidRequest", "")
+	}
+
+	if req.Limit == 0 {
+		req.Limit = SuggestedFollowsDefaultLimit
+	}
+	if req.Limit < 1 || req.Limit > SuggestedFollowsMaxLimit {
+		return helpers.InputError(e, "InvalidRequest", fmt.Sprintf("limit must be between 1 and %d", SuggestedFollowsMaxLimit))
+	}
+
+	var offset int
+	if req.Cursor != "" {
+		o, err := strconv.Atoi(req.Cursor)
+		if err != nil || o < 0 {
+			return helpers.InputError(e, "InvalidCursor", "")
+		}
+		offset = o
+	}
+
+	suggs, err := u.getSuggestedFollows(ctx, s, false)
+	if err != nil {
+		s.logger.Error("error getting suggested follows for user", "user", u.did, "error", err)
+		return helpers.ServerError(e, "InternalError", "")
+	}
+
+	if offset > len(suggs) {
+		offset = len(suggs)
+	}
+	suggs = suggs[offset:]
+
+	// a cursor is only returned when there is at least one more suggestion after this page
+	more := len(suggs) > req.Limit
+	if more {
+		suggs = suggs[:req.Limit]
+	}
+
+	results := []SuggestedFollowsResult{}
+	for _, sugg := range suggs {
+		results = append(results, SuggestedFollowsResult{
+			Did:             sugg.SuggestedDid,
+			FollowedByCount: sugg.FollowedByCount,
+		})
+	}
+
+	var cursor *string
+	if more {
+		c := strconv.Itoa(offset + len(suggs))
+		cursor = &c
+	}
+
+	return e.JSON(200, GetSuggestedFollowsResponse{
+		Cursor:      cursor,
+		Suggestions: results,
+	})
+}
+
+type GetSuggestedFollowsPageRequest struct {
 	Handle      string `query:"handle"`
 	ShowHandles bool   `query:"showHandles"`
 }
 
-func (s *Server) handleGetSuggestedFollows(e echo.Context) error {
+var suggestedFollowsPageTmpl = template.Must(template.New("suggestedFollows").Parse(`<html><table><tr><th>suggested did</th><th>bsky profile</th></tr>
+{{- range . }}<tr><td>{{ .SuggestedDid }}</td><td><a href="{{ .BskyUrl }}">{{ .BskyUrl }}</a></td></tr>{{ end -}}
+</table></html>`))
+
+// handleGetSuggestedFollowsPage renders suggested follows for any handle or did as a simple html table
+func (s *Server) handleGetSuggestedFollowsPage(e echo.Context) error {
 	ctx := e.Request().Context()
 
-	var req GetSuggestedFollowsRequest
+	var req GetSuggestedFollowsPageRequest
 	if err := e.Bind(&req); err != nil {
 		return e.String(500, err.Error())
 	}
@@ -25,26 +116,21 @@ func (s *Server) handleGetSuggestedFollows(e echo.Context) error {
 		return e.String(400, "no input handle provided")
 	}
 
-	if !strings.HasPrefix(req.Handle, "did:plc:") {
-		resp, err := atproto.IdentityResolveHandle(ctx, s.xrpc, req.Handle)
-		if err != nil {
-			return e.String(400, fmt.Sprintf("error looking up handle: %v", err))
-		}
-
-		req.Handle = resp.Did
+	ident, err := s.resolveIdentity(ctx, req.Handle)
+	if err != nil {
+		return e.String(400, fmt.Sprintf("error looking up handle: %v", err))
 	}
 
-	u := NewUser(req.Handle)
+	u := NewUser(ident.DID.String())
 	suggs, err := u.getSuggestedFollows(ctx, s, req.ShowHandles)
 	if err != nil {
 		return e.String(400, fmt.Sprintf("error getting suggested follows: %v", err))
 	}
 
-	html := "<html><table><tr><th>suggested did</th><th>bsky profile</th></tr>"
-	for _, sugg := range suggs {
-		html += fmt.Sprintf("<tr><td>%s</td><td><a href=\"%s\">%s</td></tr>", sugg.SuggestedDid, sugg.BskyUrl, sugg.BskyUrl)
+	var buf bytes.Buffer
+	if err := suggestedFollowsPageTmpl.Execute(&buf, suggs); err != nil {
+		return e.String(500, fmt.Sprintf("error rendering suggested follows: %v", err))
 	}
-	html += "</table></html>"
 
-	return e.HTML(200, html)
+	return e.HTMLBlob(200, buf.Bytes())
 }
@@ -0,0 +1,41 @@
+package peruse
+
+import (
+	"github.com/haileyok/peruse/internal/helpers"
+	"github.com/labstack/echo/v4"
+)
+
+// handlePutCloseByParams lets the authenticated viewer set their own close by params
+func (s *Server) handlePutCloseByParams(e echo.Context) error {
+	u := e.Get("user").(*User)
+	return s.setCloseByParams(e, u.did)
+}
+
+func (s *Server) setCloseByParams(e echo.Context, did string) error {
+	ctx := e.Request().Context()
+
+	var req SetCloseByParamsRequest
+	if err := e.Bind(&req); err != nil {
+		return helpers.InputError(e, "InvalidRequest", err.Error())
+	}
+
+	if req.Reset {
+		if err := s.closeByParams.Reset(ctx, did); err != nil {
+			s.logger.Error("error resetting close by params", "did", did, "error", err)
+			return helpers.ServerError(e, "InternalError", "")
+		}
+		return e.NoContent(200)
+	}
+
+	params, err := req.apply(s.args.CloseByParams)
+	if err != nil {
+		return helpers.InputError(e, "InvalidRequest", err.Error())
+	}
+
+	if err := s.closeByParams.Set(ctx, did, params); err != nil {
+		s.logger.Error("error setting close by params", "did", did, "error", err)
+		return helpers.ServerError(e, "InternalError", "")
+	}
+
+	return e.NoContent(200)
+}
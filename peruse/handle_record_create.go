@@ -9,7 +9,7 @@ import (
 	"github.com/araddon/dateparse"
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/atproto/syntax"
-	"github.com/haileyok/photocopy/nervana"
+	"github.com/haileyok/peruse/wikidata"
 )
 
 func (s *Server) handleCreate(ctx context.Context, recb []byte, indexedAt, rev, did, collection, rkey, cid, seq string) error {
@@ -18,6 +18,8 @@ func (s *Server) handleCreate(ctx context.Context, recb []byte, indexedAt, rev,
 		return err
 	}
 
+	firehoseEvents.WithLabelValues(metricsCollection(collection), "create").Inc()
+
 	switch collection {
 	case "app.bsky.feed.post":
 		return s.handleCreatePost(ctx, rev, recb, uriFromParts(did, collection, rkey), did, collection, rkey, cid, iat)
@@ -25,6 +27,8 @@ func (s *Server) handleCreate(ctx context.Context, recb []byte, indexedAt, rev,
 		return s.handleCreateLike(ctx, rev, recb, uriFromParts(did, collection, rkey), did, collection, rkey, cid, iat)
 	case "app.bsky.feed.repost":
 		return s.handleCreateRepost(ctx, rev, recb, uriFromParts(did, collection, rkey), did, collection, rkey, cid, iat)
+	case "app.bsky.graph.follow":
+		return s.handleCreateFollow(ctx, recb, did, iat)
 	default:
 		return nil
 	}
@@ -36,37 +40,89 @@ func (s *Server) handleCreatePost(ctx context.Context, rev string, recb []byte,
 		return err
 	}
 
-	var nerItems []nervana.NervanaItem
-	if rec.Text != "" && rec.Reply == nil {
-		ctxWithTmt, cancel := context.WithTimeout(ctx, 5*time.Second)
-		maybeNerItems, err := s.nervanaClient.MakeRequest(ctxWithTmt, rec.Text)
-		if err != nil {
-			s.logger.Warn("unable to fetch ner items for post", "error", err)
-		} else {
-			nerItems = maybeNerItems
-		}
-		cancel()
+	storedPost := StoredPost{
+		Uri:       uri,
+		Did:       did,
+		Rkey:      rkey,
+		CreatedAt: indexedAt,
+	}
+	if rec.Reply != nil && rec.Reply.Parent != nil {
+		storedPost.ParentUri = rec.Reply.Parent.Uri
+	}
+	if err := s.store.RecordPost(ctx, storedPost); err != nil {
+		return err
+	}
+
+	// replies are only sent to nervana when asked for, since there are a lot of them
+	var nerItems []wikidata.EntityMatch
+	if rec.Reply == nil || s.args.NerOnReplies {
+		nerItems = s.nerForPost(ctx, &rec)
 	}
 
 	for fname, f := range s.feeds {
+		s.feedWork.Add(1)
 		go func() {
+			defer s.feedWork.Done()
 			if err := f.OnPost(ctx, &rec, uri, did, rkey, cid, indexedAt, nerItems); err != nil {
 				s.logger.Error("error running on post", "feed", fname, "error", err)
 			}
 		}()
 	}
 
+	if s.entityFeeds != nil {
+		s.feedWork.Add(1)
+		go func() {
+			defer s.feedWork.Done()
+			if err := s.entityFeeds.OnPost(ctx, &rec, uri, did, indexedAt, nerItems); err != nil {
+				s.logger.Error("error running on post", "feed", EntityFeedsName, "error", err)
+			}
+		}()
+	}
+
 	return nil
 }
 
+// nerForPost runs NER over a post, returning nothing when the post has no text worth sending or nervana fails
+func (s *Server) nerForPost(ctx context.Context, post *bsky.FeedPost) []wikidata.EntityMatch {
+	sections := buildNerInput(post)
+	if len(sections) == 0 {
+		return nil
+	}
+
+	ctxWithTmt, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	maybeNerItems, err := s.nerClient.MakeRequest(ctxWithTmt, nerInputText(sections))
+	status := "ok"
+	if err != nil {
+		status = "failed"
+	}
+	nervanaRequestDuration.WithLabelValues(status).Observe(time.Since(start).Seconds())
+	if err != nil {
+		s.logger.Warn("unable to fetch ner items for post", "error", err)
+		return nil
+	}
+
+	return tagNerItems(sections, maybeNerItems)
+}
+
 func (s *Server) handleCreateLike(ctx context.Context, rev string, recb []byte, uri, did, collection, rkey, cid string, indexedAt time.Time) error {
 	var rec bsky.FeedLike
 	if err := rec.UnmarshalCBOR(bytes.NewReader(recb)); err != nil {
 		return err
 	}
 
+	if rec.Subject != nil {
+		if err := s.store.RecordInteraction(ctx, newInteraction(InteractionKindLike, uri, did, rkey, rec.Subject.Uri, indexedAt)); err != nil {
+			return err
+		}
+	}
+
 	for fname, f := range s.feeds {
+		s.feedWork.Add(1)
 		go func() {
+			defer s.feedWork.Done()
 			if err := f.OnLike(ctx, &rec, uri, did, rkey, cid, indexedAt); err != nil {
 				s.logger.Error("error running on like", "feed", fname, "error", err)
 			}
@@ -82,8 +138,16 @@ func (s *Server) handleCreateRepost(ctx context.Context, rev string, recb []byte
 		return err
 	}
 
+	if rec.Subject != nil {
+		if err := s.store.RecordInteraction(ctx, newInteraction(InteractionKindRepost, uri, did, rkey, rec.Subject.Uri, indexedAt)); err != nil {
+			return err
+		}
+	}
+
 	for fname, f := range s.feeds {
+		s.feedWork.Add(1)
 		go func() {
+			defer s.feedWork.Done()
 			if err := f.OnRepost(ctx, &rec, uri, did, rkey, cid, indexedAt); err != nil {
 				s.logger.Error("error running on repost", "feed", fname, "error", err)
 			}
@@ -93,6 +157,47 @@ func (s *Server) handleCreateRepost(ctx context.Context, rev string, recb []byte
 	return nil
 }
 
+func (s *Server) handleCreateFollow(ctx context.Context, recb []byte, did string, indexedAt time.Time) error {
+	var rec bsky.GraphFollow
+	if err := rec.UnmarshalCBOR(bytes.NewReader(recb)); err != nil {
+		return err
+	}
+
+	return s.store.RecordFollow(ctx, Follow{
+		Did:       did,
+		Subject:   rec.Subject,
+		CreatedAt: indexedAt,
+	})
+}
+
+func newInteraction(kind, uri, did, rkey, subjectUri string, indexedAt time.Time) Interaction {
+	subjectDid := ""
+	if aturi, err := syntax.ParseATURI(subjectUri); err == nil {
+		subjectDid = aturi.Authority().String()
+	}
+
+	return Interaction{
+		Uri:        uri,
+		Did:        did,
+		Rkey:       rkey,
+		Kind:       kind,
+		SubjectUri: subjectUri,
+		SubjectDid: subjectDid,
+		CreatedAt:  indexedAt,
+	}
+}
+
+// metricsCollection keeps the collection label on firehose metrics bounded, since anyone can write records to any
+// collection
+func metricsCollection(collection string) string {
+	switch collection {
+	case "app.bsky.feed.post", "app.bsky.feed.like", "app.bsky.feed.repost", "app.bsky.graph.follow", "app.bsky.graph.block", "app.bsky.actor.profile":
+		return collection
+	default:
+		return "other"
+	}
+}
+
 func uriFromParts(did string, collection string, rkey string) string {
 	return "at://" + did + "/" + collection + "/" + rkey
 }
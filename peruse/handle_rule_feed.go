@@ -0,0 +1,176 @@
+package peruse
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/haileyok/peruse/wikidata"
+)
+
+// RuleFeedConfig defines a topic feed by simple rules instead of wikidata entities. A post is included when it
+// matches any of the rules.
+type RuleFeedConfig struct {
+	Name  string `json:"name"`
+	Table string `json:"table"`
+	// Hashtags match tag facets and the post's own tags, without the leading # and ignoring case
+	Hashtags []string `json:"hashtags"`
+	// Domains match links in facets and external embeds, including subdomains
+	Domains []string `json:"domains"`
+	// Mentions are dids of accounts whose mention puts a post in the feed
+	Mentions []string `json:"mentions"`
+	// Patterns are regular expressions matched against the post's text
+	Patterns []string `json:"patterns"`
+}
+
+type RuleFeed struct {
+	*rankedFeed
+	hashtags map[string]struct{}
+	domains  []string
+	mentions map[string]struct{}
+	patterns []*regexp.Regexp
+}
+
+func NewRuleFeed(ctx context.Context, s *Server, cfg RuleFeedConfig) (*RuleFeed, error) {
+	if cfg.Name == "" || cfg.Table == "" {
+		return nil, fmt.Errorf("rule feeds need a name and a table")
+	}
+
+	f := &RuleFeed{
+		hashtags: map[string]struct{}{},
+		mentions: map[string]struct{}{},
+	}
+
+	for _, tag := range cfg.Hashtags {
+		f.hashtags[normalizeHashtag(tag)] = struct{}{}
+	}
+
+	for _, d := range cfg.Domains {
+		f.domains = append(f.domains, strings.ToLower(strings.TrimPrefix(d, "www.")))
+	}
+
+	for _, m := range cfg.Mentions {
+		did, err := syntax.ParseDID(m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mention in rule feed %s: %w", cfg.Name, err)
+		}
+		f.mentions[did.String()] = struct{}{}
+	}
+
+	for _, p := range cfg.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern in rule feed %s: %w", cfg.Name, err)
+		}
+		f.patterns = append(f.patterns, re)
+	}
+
+	if len(f.hashtags) == 0 && len(f.domains) == 0 && len(f.mentions) == 0 && len(f.patterns) == 0 {
+		return nil, fmt.Errorf("rule feed %s has no rules", cfg.Name)
+	}
+
+	rf, err := newRankedFeed(ctx, s, cfg.Name, cfg.Table)
+	if err != nil {
+		return nil, err
+	}
+	f.rankedFeed = rf
+
+	return f, nil
+}
+
+func (f *RuleFeed) OnPost(ctx context.Context, post *bsky.FeedPost, uri, did, rkey, cid string, indexedAt time.Time, nerItems []wikidata.EntityMatch) error {
+	if !f.considerPost(post, did, uri) {
+		return nil
+	}
+
+	return f.includePost(ctx, post, uri, indexedAt, f.matches(post), nerItems)
+}
+
+func (f *RuleFeed) matches(post *bsky.FeedPost) bool {
+	if len(f.hashtags) > 0 {
+		for _, tag := range post.Tags {
+			if _, ok := f.hashtags[normalizeHashtag(tag)]; ok {
+				return true
+			}
+		}
+	}
+
+	for _, facet := range post.Facets {
+		if facet == nil {
+			continue
+		}
+		for _, feature := range facet.Features {
+			if feature == nil {
+				continue
+			}
+			if t := feature.RichtextFacet_Tag; t != nil {
+				if _, ok := f.hashtags[normalizeHashtag(t.Tag)]; ok {
+					return true
+				}
+			}
+			if l := feature.RichtextFacet_Link; l != nil && f.matchesDomain(l.Uri) {
+				return true
+			}
+			if m := feature.RichtextFacet_Mention; m != nil {
+				if _, ok := f.mentions[m.Did]; ok {
+					return true
+				}
+			}
+		}
+	}
+
+	if ext := externalEmbed(post); ext != nil && ext.External != nil && f.matchesDomain(ext.External.Uri) {
+		return true
+	}
+
+	for _, re := range f.patterns {
+		if re.MatchString(post.Text) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *RuleFeed) matchesDomain(link string) bool {
+	if len(f.domains) == 0 {
+		return false
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, d := range f.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func normalizeHashtag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+}
+
+// externalEmbed returns a post's link card, whether it is the post's only embed or attached alongside a quote
+func externalEmbed(post *bsky.FeedPost) *bsky.EmbedExternal {
+	if post.Embed == nil {
+		return nil
+	}
+	if post.Embed.EmbedExternal != nil {
+		return post.Embed.EmbedExternal
+	}
+	if rwm := post.Embed.EmbedRecordWithMedia; rwm != nil && rwm.Media != nil {
+		return rwm.Media.EmbedExternal
+	}
+	return nil
+}
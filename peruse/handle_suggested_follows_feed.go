@@ -24,7 +24,7 @@ func (s *Server) handleSuggestedFollowsFeed(e echo.Context, req FeedSkeletonRequ
 		req.Cursor = DefaultCursor
 	}
 
-	posts, err := s.getPostsForDidsChronological(ctx, suggDids, req.Cursor)
+	posts, err := s.getPostsForDidsChronological(ctx, suggDids, req.Cursor, false)
 	if err != nil {
 		s.logger.Error("error getting suggested follows chrono posts", "error", err)
 		return helpers.ServerError(e, "FeedError", "")
@@ -34,7 +34,7 @@ func (s *Server) handleSuggestedFollowsFeed(e echo.Context, req FeedSkeletonRequ
 		return helpers.ServerError(e, "FeedError", "Not enough posts")
 	}
 
-	fpis, cursor := modelPostsToFeedItems(posts)
+	fpis, cursor := chronoPostsToFeedItems(posts, suggestedFollowsContextFunc(suggFollows), s.isModeratedChronoPost(SuggestedFollowsFeedName))
 
 	return e.JSON(200, FeedSkeletonResponse{
 		Cursor: &cursor,
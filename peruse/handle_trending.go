@@ -0,0 +1,63 @@
+package peruse
+
+import (
+	"time"
+
+	"github.com/haileyok/peruse/internal/helpers"
+	"github.com/labstack/echo/v4"
+)
+
+type TrendingRequest struct {
+	Feed  string `query:"feed"`
+	Limit int    `query:"limit"`
+}
+
+type TrendingResponse struct {
+	Feed    string           `json:"feed"`
+	Windows []TrendingWindow `json:"windows"`
+}
+
+// handleTrending reports the entities mentioned most, relative to their usual rate, in the posts a feed has included
+func (s *Server) handleTrending(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	if s.trending == nil {
+		return helpers.InputError(e, "TrendingDisabled", "Trending entities are not enabled on this server")
+	}
+
+	var req TrendingRequest
+	if err := e.Bind(&req); err != nil {
+		return helpers.InputError(e, "InvalidRequest", err.Error())
+	}
+
+	if _, ok := s.feeds[req.Feed]; !ok {
+		return helpers.InputError(e, "FeedNotFound", "")
+	}
+
+	if req.Limit <= 0 {
+		req.Limit = 20
+	} else if req.Limit > 100 {
+		req.Limit = 100
+	}
+
+	now := time.Now()
+	resp := TrendingResponse{
+		Feed:    req.Feed,
+		Windows: make([]TrendingWindow, 0, len(TrendingWindows)),
+	}
+
+	for _, window := range TrendingWindows {
+		counts, err := s.trending.Counts(ctx, req.Feed, now, window)
+		if err != nil {
+			s.logger.Error("error getting trending counts", "feed", req.Feed, "window", window, "error", err)
+			return helpers.ServerError(e, "TrendingError", "")
+		}
+
+		resp.Windows = append(resp.Windows, TrendingWindow{
+			Window:   formatTrendingWindow(window),
+			Entities: rankTrending(counts, window, req.Limit),
+		})
+	}
+
+	return e.JSON(200, resp)
+}
@@ -4,49 +4,53 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log/slog"
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/bluesky-social/indigo/api/bsky"
-	"github.com/haileyok/peruse/internal/helpers"
 	"github.com/haileyok/peruse/wikidata"
-	"github.com/haileyok/photocopy/clickhouse_inserter"
-	"github.com/haileyok/photocopy/nervana"
-	"github.com/labstack/echo/v4"
 )
 
 type WikidataFeed struct {
-	conn           driver.Conn
-	logger         *slog.Logger
-	cached         []RankedFeedPost
-	cacheExpiresAt time.Time
-	mu             sync.RWMutex
-	nervanaClient  *nervana.Client
-	entities       map[string]wikidata.Entity
-	inserter       *clickhouse_inserter.Inserter
-	feedName       string
-	tableName      string
+	*rankedFeed
+	entities map[string]wikidata.Entity
 }
 
-type RankedFeedPost struct {
-	LikeCt     uint64    `ch:"like_ct"`
-	Uri        string    `ch:"uri"`
-	CreatedAt  time.Time `ch:"created_at"`
-	HoursOld   int64     `ch:"hours_old"`
-	DecayScore float64   `ch:"decay_score"`
+type WikidataFeedConfig struct {
+	Name     string
+	Table    string
+	Entities string
 }
 
-func NewWikidataFeed(ctx context.Context, s *Server, feedName string, tableName string, entitiesJson string) *WikidataFeed {
-	logger := s.logger.With("feed", feedName)
+// WikidataFeeds are the topic feeds matched by entity, which every instance serves
+var WikidataFeeds = []WikidataFeedConfig{
+	{"seattle", "seattle_post", wikidata.SeattleEntities},
+	{"los-angeles", "los_angeles_post", wikidata.LosAngelesEntities},
+	{"san-francisco", "san_francisco_post", wikidata.SanFranciscoEntities},
+	{"austin", "austin_post", wikidata.AustinEntities},
+	{"chicago", "chicago_post", wikidata.ChicagoEntities},
+	{"boston", "boston_post", wikidata.BostonEntities},
+	{"software", "software_post", wikidata.SoftwareEntities},
+	{"baseball", "baseball_post", wikidata.BaseballEntities},
+}
+
+// FeedTables returns the tables of the wikidata feeds and the given rule feeds
+func FeedTables(ruleFeeds []RuleFeedConfig) []string {
+	var tables []string
+	for _, cfg := range WikidataFeeds {
+		tables = append(tables, cfg.Table)
+	}
+	for _, cfg := range ruleFeeds {
+		tables = append(tables, cfg.Table)
+	}
+	return tables
+}
 
+func NewWikidataFeed(ctx context.Context, s *Server, feedName string, tableName string, entitiesJson string) (*WikidataFeed, error) {
 	// TODO: just make this the `Unmarshal` of the `wikidata.Entity` struct
 	var entitiesArr []wikidata.Entity
 	if err := json.Unmarshal([]byte(entitiesJson), &entitiesArr); err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid entities for feed %s: %w", feedName, err)
 	}
 
 	entities := map[string]wikidata.Entity{}
@@ -76,150 +80,25 @@ func NewWikidataFeed(ctx context.Context, s *Server, feedName string, tableName
 		}
 	}
 
-	inserter, err := clickhouse_inserter.New(ctx, &clickhouse_inserter.Args{
-		PrometheusCounterPrefix: "peruse_wikidata_" + feedName,
-		BatchSize:               1,
-		Logger:                  s.logger,
-		Conn:                    s.conn,
-		Query:                   fmt.Sprintf("INSERT INTO %s (uri, created_at)", tableName),
-		RateLimit:               3,
-	})
+	rf, err := newRankedFeed(ctx, s, feedName, tableName)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	return &WikidataFeed{
-		conn:          s.conn,
-		logger:        logger,
-		nervanaClient: s.nervanaClient,
-		entities:      entities,
-		inserter:      inserter,
-		feedName:      feedName,
-		tableName:     tableName,
-	}
-}
-
-func (f *WikidataFeed) Name() string {
-	return f.feedName
-}
-
-func (f *WikidataFeed) FeedSkeleton(e echo.Context, req FeedSkeletonRequest) error {
-	ctx := e.Request().Context()
-
-	var cursor int
-	if req.Cursor != "" {
-		cursor64, err := strconv.ParseInt(req.Cursor, 10, 32)
-		if err != nil {
-			f.logger.Error("error converting cursor", "error", err)
-		}
-		cursor = int(cursor64)
-	}
-
-	posts, err := f.getPosts(ctx)
-	if err != nil {
-		f.logger.Error("error getting posts", "error", err)
-		return helpers.ServerError(e, "FeedError", "Unable to get posts for feed")
-	}
-
-	if len(posts) < cursor {
-		cursor = len(posts)
-	}
-
-	posts = posts[cursor:]
-
-	if len(posts) > 30 {
-		posts = posts[:30]
-	}
-
-	var items []FeedPostItem
-	for _, p := range posts {
-		items = append(items, FeedPostItem{
-			Post: p.Uri,
-		})
-	}
-
-	newCursor := fmt.Sprintf("%d", cursor+len(posts))
-
-	return e.JSON(200, FeedSkeletonResponse{
-		Feed:   items,
-		Cursor: &newCursor,
-	})
-}
-
-type FeedDatabaseItem struct {
-	Uri       string    `ch:"uri"`
-	CreatedAt time.Time `ch:"created_at"`
+		rankedFeed: rf,
+		entities:   entities,
+	}, nil
 }
 
-func (f *WikidataFeed) OnPost(ctx context.Context, post *bsky.FeedPost, uri, did, rkey, cid string, indexedAt time.Time, nerItems []nervana.NervanaItem) error {
-	if post.Reply != nil {
+func (f *WikidataFeed) OnPost(ctx context.Context, post *bsky.FeedPost, uri, did, rkey, cid string, indexedAt time.Time, nerItems []wikidata.EntityMatch) error {
+	if len(nerItems) == 0 {
 		return nil
 	}
 
-	if post.Text == "" {
+	if !f.considerPost(post, did, uri) {
 		return nil
 	}
 
-	if wikidata.ShouldInclude(ctx, f.entities, nerItems) {
-		fdi := FeedDatabaseItem{
-			Uri:       uri,
-			CreatedAt: indexedAt,
-		}
-		if err := f.inserter.Insert(ctx, fdi); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (f *WikidataFeed) OnLike(ctx context.Context, like *bsky.FeedLike, uri, did, rkey, cid string, indexedAt time.Time) error {
-	return nil
-}
-
-func (f *WikidataFeed) OnRepost(ctx context.Context, repost *bsky.FeedRepost, uri, did, rkey, cid string, indexedAt time.Time) error {
-	return nil
-}
-
-func (f *WikidataFeed) getPosts(ctx context.Context) ([]RankedFeedPost, error) {
-	now := time.Now()
-	f.mu.RLock()
-	expiresAt := f.cacheExpiresAt
-	posts := f.cached
-	f.mu.RUnlock()
-	if posts != nil && now.Before(expiresAt) {
-		return posts, nil
-	}
-
-	f.mu.Lock()
-	defer f.mu.Unlock()
-
-	if f.cached != nil && now.Before(expiresAt) {
-		return f.cached, nil
-	}
-
-	if err := f.conn.Select(ctx, &posts, makeCityQuery(f.tableName)); err != nil {
-		return nil, err
-	}
-	f.cached = posts
-	f.cacheExpiresAt = now.Add(1 * time.Minute)
-
-	return posts, nil
-}
-
-func makeCityQuery(tableName string) string {
-	return fmt.Sprintf(`
-SELECT 
-    count(*) as like_ct,
-    sp.uri,
-    sp.created_at,
-    dateDiff('hour', sp.created_at, now()) as hours_old,
-    count(*) * exp(-0.1 * dateDiff('hour', sp.created_at, now())) as decay_score
-FROM %s sp 
-LEFT JOIN default.like_by_subject i ON sp.uri = i.subject_uri 
-WHERE sp.created_at > now() - INTERVAL 1 DAY 
-GROUP BY sp.uri, sp.created_at 
-ORDER BY decay_score DESC
-LIMIT 5000
-		`, tableName)
+	return f.includePost(ctx, post, uri, indexedAt, wikidata.ShouldInclude(ctx, f.entities, nerItems), nerItems)
 }
@@ -0,0 +1,451 @@
+package peruse
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/araddon/dateparse"
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/label"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	"github.com/gorilla/websocket"
+)
+
+// DefaultExcludedLabels are the labels that keep content out of every feed unless a feed has its own policy
+var DefaultExcludedLabels = []string{"porn", "sexual", "nudity", "graphic-media", "spam", "!hide", "!takedown"}
+
+type LabelRow struct {
+	Src string     `ch:"src"`
+	Uri string     `ch:"uri"`
+	Val string     `ch:"val"`
+	Neg uint8      `ch:"neg"`
+	Cts time.Time  `ch:"cts"`
+	Exp *time.Time `ch:"exp"`
+	Seq int64      `ch:"seq"`
+}
+
+const (
+	// DefaultMaxLabelSubjects bounds how many labeled posts and accounts are kept in memory
+	DefaultMaxLabelSubjects = 2_000_000
+	labelPruneInterval      = time.Minute
+)
+
+type labelState struct {
+	expiresAt *time.Time
+}
+
+type labelExpiry struct {
+	subject string
+	val     string
+	at      time.Time
+}
+
+// labelExpiries is a heap of expiring labels ordered by when they expire, so that pruning doesn't have to scan every
+// label
+type labelExpiries []labelExpiry
+
+func (h labelExpiries) Len() int           { return len(h) }
+func (h labelExpiries) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h labelExpiries) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *labelExpiries) Push(x any)        { *h = append(*h, x.(labelExpiry)) }
+func (h *labelExpiries) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// LabelStore subscribes to a labeler and keeps the labels that any feed's policy cares about, keyed by the labeled
+// uri or did. Labels are also written to the store so that they survive restarts. Expired labels are pruned, and once
+// maxSubjects posts and accounts carry labels, labels for any others are dropped.
+type LabelStore struct {
+	store       Store
+	logger      *slog.Logger
+	directory   identity.Directory
+	labelerDid  string
+	labelerHost string
+
+	// label values that at least one feed excludes. other labels are dropped on ingest
+	relevant map[string]struct{}
+
+	maxSubjects int
+
+	mu       sync.RWMutex
+	labels   map[string]map[string]labelState // subject -> val -> state
+	expiries labelExpiries
+	cursor   int64
+}
+
+func NewLabelStore(store Store, logger *slog.Logger, directory identity.Directory, labelerDid, labelerHost string, relevant []string, maxSubjects int) *LabelStore {
+	if maxSubjects <= 0 {
+		maxSubjects = DefaultMaxLabelSubjects
+	}
+
+	rel := map[string]struct{}{}
+	for _, v := range relevant {
+		rel[v] = struct{}{}
+	}
+
+	return &LabelStore{
+		store:       store,
+		logger:      logger.With("component", "labels", "labeler", labelerDid),
+		directory:   directory,
+		labelerDid:  labelerDid,
+		labelerHost: labelerHost,
+		relevant:    rel,
+		maxSubjects: maxSubjects,
+		labels:      map[string]map[string]labelState{},
+	}
+}
+
+// Init loads the stored labels and cursor
+func (ls *LabelStore) Init(ctx context.Context) error {
+	rows, err := ls.store.Labels(ctx, ls.labelerDid)
+	if err != nil {
+		return fmt.Errorf("failed to load labels: %w", err)
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	for _, r := range rows {
+		if r.Seq > ls.cursor {
+			ls.cursor = r.Seq
+		}
+		if _, ok := ls.relevant[r.Val]; !ok || r.Neg == 1 {
+			continue
+		}
+		ls.setLocked(r.Uri, r.Val, r.Exp)
+	}
+
+	ls.logger.Info("loaded labels", "count", len(rows), "cursor", ls.cursor)
+
+	return nil
+}
+
+func (ls *LabelStore) setLocked(subject, val string, exp *time.Time) {
+	now := time.Now()
+
+	// a label that has already expired replaces the label before it, but has no effect itself
+	if exp != nil && !exp.After(now) {
+		ls.removeLocked(subject, val)
+		return
+	}
+
+	if ls.labels[subject] == nil {
+		if len(ls.labels) >= ls.maxSubjects {
+			ls.pruneLocked(now)
+		}
+		if len(ls.labels) >= ls.maxSubjects {
+			labelsDropped.Inc()
+			return
+		}
+		ls.labels[subject] = map[string]labelState{}
+	}
+	ls.labels[subject][val] = labelState{
+		expiresAt: exp,
+	}
+	if exp != nil {
+		heap.Push(&ls.expiries, labelExpiry{subject: subject, val: val, at: *exp})
+	}
+
+	labelSubjects.Set(float64(len(ls.labels)))
+}
+
+func (ls *LabelStore) removeLocked(subject, val string) {
+	delete(ls.labels[subject], val)
+	if len(ls.labels[subject]) == 0 {
+		delete(ls.labels, subject)
+	}
+
+	labelSubjects.Set(float64(len(ls.labels)))
+}
+
+// pruneLocked removes the labels that have expired by now. Labels that were replaced or negated since their expiry
+// was queued are left alone.
+func (ls *LabelStore) pruneLocked(now time.Time) {
+	for len(ls.expiries) > 0 && !ls.expiries[0].at.After(now) {
+		e := heap.Pop(&ls.expiries).(labelExpiry)
+		st, ok := ls.labels[e.subject][e.val]
+		if ok && st.expiresAt != nil && st.expiresAt.Equal(e.at) {
+			ls.removeLocked(e.subject, e.val)
+		}
+	}
+}
+
+func (ls *LabelStore) runPrune(ctx context.Context) {
+	ticker := time.NewTicker(labelPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			ls.mu.Lock()
+			ls.pruneLocked(now)
+			ls.mu.Unlock()
+		}
+	}
+}
+
+// HasAny reports whether the post uri or its author did currently carry any of the given labels
+func (ls *LabelStore) HasAny(did, uri string, vals []string) bool {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+
+	now := time.Now()
+	for _, subject := range []string{did, uri} {
+		subjectLabels, ok := ls.labels[subject]
+		if !ok {
+			continue
+		}
+		for _, v := range vals {
+			st, ok := subjectLabels[v]
+			if !ok {
+				continue
+			}
+			if st.expiresAt == nil || st.expiresAt.After(now) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Run consumes the labeler's subscribeLabels stream, reconnecting with backoff until the context is cancelled, and
+// prunes expired labels
+func (ls *LabelStore) Run(ctx context.Context) {
+	go ls.runPrune(ctx)
+
+	backoff := time.Second
+	for {
+		err := ls.consume(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		ls.logger.Error("label stream ended, reconnecting", "error", err, "backoff", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func (ls *LabelStore) consume(ctx context.Context) error {
+	u, err := url.Parse(ls.labelerHost)
+	if err != nil {
+		return err
+	}
+	u.Path = "/xrpc/com.atproto.label.subscribeLabels"
+
+	ls.mu.RLock()
+	cursor := ls.cursor
+	ls.mu.RUnlock()
+
+	if cursor > 0 {
+		u.RawQuery = "cursor=" + strconv.FormatInt(cursor, 10)
+	}
+
+	ls.logger.Info("connecting to labeler", "url", u.String())
+
+	con, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), http.Header{
+		"user-agent": []string{"peruse/0.0.0"},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to connect to labeler: %w", err)
+	}
+
+	rsc := events.RepoStreamCallbacks{
+		LabelLabels: func(evt *atproto.LabelSubscribeLabels_Labels) error {
+			ls.handleLabels(ctx, evt)
+			return nil
+		},
+	}
+
+	// labels have to be applied in order so that negations land after the label they negate
+	scheduler := sequential.NewScheduler(con.RemoteAddr().String(), rsc.EventHandler)
+
+	return events.HandleRepoStream(ctx, con, scheduler, ls.logger)
+}
+
+func (ls *LabelStore) handleLabels(ctx context.Context, evt *atproto.LabelSubscribeLabels_Labels) {
+	var rows []LabelRow
+	for _, lex := range evt.Labels {
+		if lex == nil {
+			continue
+		}
+
+		if _, ok := ls.relevant[lex.Val]; !ok {
+			continue
+		}
+
+		if lex.Src != ls.labelerDid {
+			ls.logger.Warn("dropping label from unexpected source", "src", lex.Src, "uri", lex.Uri)
+			continue
+		}
+
+		if err := ls.verifyLabel(ctx, lex); err != nil {
+			ls.logger.Warn("dropping label with invalid signature", "uri", lex.Uri, "val", lex.Val, "error", err)
+			continue
+		}
+
+		cts, err := dateparse.ParseAny(lex.Cts)
+		if err != nil {
+			ls.logger.Warn("dropping label with invalid timestamp", "uri", lex.Uri, "val", lex.Val, "error", err)
+			continue
+		}
+
+		row := LabelRow{
+			Src: lex.Src,
+			Uri: labelSubject(lex.Uri),
+			Val: lex.Val,
+			Cts: cts,
+			Seq: evt.Seq,
+		}
+		if lex.Neg != nil && *lex.Neg {
+			row.Neg = 1
+		}
+		if lex.Exp != nil {
+			if exp, err := dateparse.ParseAny(*lex.Exp); err == nil {
+				row.Exp = &exp
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	ls.mu.Lock()
+	for _, r := range rows {
+		if r.Neg == 1 {
+			ls.removeLocked(r.Uri, r.Val)
+		} else {
+			ls.setLocked(r.Uri, r.Val, r.Exp)
+		}
+	}
+	ls.cursor = evt.Seq
+	ls.mu.Unlock()
+
+	if len(rows) == 0 {
+		return
+	}
+
+	if err := ls.store.WriteLabels(ctx, rows); err != nil {
+		ls.logger.Error("error storing labels", "error", err)
+	}
+}
+
+func (ls *LabelStore) verifyLabel(ctx context.Context, lex *atproto.LabelDefs_Label) error {
+	did, err := syntax.ParseDID(lex.Src)
+	if err != nil {
+		return err
+	}
+
+	ident, err := ls.directory.LookupDID(ctx, did)
+	if err != nil {
+		return err
+	}
+
+	key, err := ident.GetPublicKey("atproto_label")
+	if err != nil {
+		return err
+	}
+
+	l := label.FromLexicon(lex)
+	// FromLexicon doesn't carry over negation, but it is part of the signed bytes
+	l.Negated = lex.Neg
+
+	return l.VerifySignature(key)
+}
+
+// labelSubject normalizes the labeled resource. Account labels are applied to the bare did, either directly or as an
+// at:// uri with no path.
+func labelSubject(uri string) string {
+	if strings.HasPrefix(uri, "did:") {
+		return uri
+	}
+	aturi, err := syntax.ParseATURI(uri)
+	if err != nil {
+		return uri
+	}
+	if aturi.Collection() == "" {
+		return aturi.Authority().String()
+	}
+	return uri
+}
+
+// ParseFeedExcludedLabels parses a per-feed label policy given as feed=label|label. An empty list of labels disables
+// label filtering for the feed.
+func ParseFeedExcludedLabels(policy string) (string, []string, error) {
+	return parseFeedList(policy, "label policy", "feed=label|label")
+}
+
+// parseFeedList parses the feed=value|value form shared by the per-feed flags
+func parseFeedList(s, what, form string) (string, []string, error) {
+	feed, vals, ok := strings.Cut(s, "=")
+	if !ok || feed == "" {
+		return "", nil, fmt.Errorf("invalid %s %q, expected %s", what, s, form)
+	}
+
+	list := []string{}
+	for _, v := range strings.Split(vals, "|") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return feed, list, nil
+}
+
+// excludedLabels returns the labels that keep content out of the named feed
+func (s *Server) excludedLabels(feedName string) []string {
+	if vals, ok := s.args.FeedExcludedLabels[feedName]; ok {
+		return vals
+	}
+	return s.args.ExcludedLabels
+}
+
+// relevantLabels is every label value that excludes content from at least one feed
+func (s *Server) relevantLabels() []string {
+	vals := append([]string{}, s.args.ExcludedLabels...)
+	for _, feedVals := range s.args.FeedExcludedLabels {
+		vals = append(vals, feedVals...)
+	}
+	return vals
+}
+
+// isExcluded reports whether a post should be kept out of the named feed, either because it or its author has been
+// banned by an operator or carries one of the feed's excluded labels
+func (s *Server) isExcluded(feedName, did, uri string) bool {
+	if s.moderation.IsBanned(feedName, did, uri) {
+		return true
+	}
+	return s.labels != nil && s.labels.HasAny(did, uri, s.excludedLabels(feedName))
+}
+
+// isUriExcluded is isExcluded for when only the post's uri is at hand
+func (s *Server) isUriExcluded(feedName, uri string) bool {
+	did := ""
+	if aturi, err := syntax.ParseATURI(uri); err == nil {
+		did = aturi.Authority().String()
+	}
+	return s.isExcluded(feedName, did, uri)
+}
@@ -0,0 +1,230 @@
+package peruse
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	atcrypto "github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/label"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/gorilla/websocket"
+)
+
+const testLabelerDid = "did:plc:testlabeler00000000000"
+
+func signTestLabel(t *testing.T, key atcrypto.PrivateKey, src, uri, val string, neg bool) *atproto.LabelDefs_Label {
+	t.Helper()
+
+	l := label.Label{
+		Version:   label.ATPROTO_LABEL_VERSION,
+		CreatedAt: syntax.DatetimeNow().String(),
+		SourceDID: src,
+		URI:       uri,
+		Val:       val,
+	}
+	if neg {
+		l.Negated = &neg
+	}
+	if err := l.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+
+	lex := l.ToLexicon()
+	lex.Neg = l.Negated
+	return &lex
+}
+
+// newTestLabeler serves the given label events over subscribeLabels, then holds the connection open until the test
+// ends
+func newTestLabeler(t *testing.T, evts []*atproto.LabelSubscribeLabels_Labels) string {
+	t.Helper()
+
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		con, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer con.Close()
+
+		for _, evt := range evts {
+			var buf bytes.Buffer
+			hdr := events.EventHeader{Op: events.EvtKindMessage, MsgType: "#labels"}
+			if err := hdr.MarshalCBOR(&buf); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := evt.MarshalCBOR(&buf); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := con.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		<-done
+	}))
+	t.Cleanup(func() {
+		close(done)
+		srv.Close()
+	})
+
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func newTestLabelStore(t *testing.T, store Store, host string, maxSubjects int) (*LabelStore, atcrypto.PrivateKey) {
+	t.Helper()
+
+	key, err := atcrypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := key.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:    syntax.DID(testLabelerDid),
+		Handle: syntax.HandleInvalid,
+		Keys: map[string]identity.VerificationMethod{
+			"atproto_label": {Type: "Multikey", PublicKeyMultibase: pub.Multibase()},
+		},
+	})
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return NewLabelStore(store, logger, &dir, testLabelerDid, host, []string{"spam", "porn"}, maxSubjects), key
+}
+
+func TestLabelStoreVerifiesSignatures(t *testing.T) {
+	forger, err := atcrypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		signedPost = "at://did:plc:author/app.bsky.feed.post/1"
+		forgedPost = "at://did:plc:author/app.bsky.feed.post/2"
+		negPost    = "at://did:plc:author/app.bsky.feed.post/3"
+	)
+
+	store := NewMemoryStore(0, 0)
+	ls, key := newTestLabelStore(t, store, "", 0)
+
+	evts := []*atproto.LabelSubscribeLabels_Labels{
+		{Seq: 1, Labels: []*atproto.LabelDefs_Label{
+			signTestLabel(t, key, testLabelerDid, signedPost, "spam", false),
+			signTestLabel(t, forger, testLabelerDid, forgedPost, "spam", false),
+			signTestLabel(t, key, testLabelerDid, negPost, "porn", false),
+		}},
+		{Seq: 2, Labels: []*atproto.LabelDefs_Label{
+			signTestLabel(t, key, testLabelerDid, "did:plc:author", "porn", false),
+			// a forged negation can't remove a label
+			signTestLabel(t, forger, testLabelerDid, signedPost, "spam", true),
+			signTestLabel(t, key, testLabelerDid, negPost, "porn", true),
+		}},
+	}
+	ls.labelerHost = newTestLabeler(t, evts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ls.Run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ls.mu.RLock()
+		cursor := ls.cursor
+		ls.mu.RUnlock()
+		if cursor == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for labels, cursor at %d", cursor)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !ls.HasAny("did:plc:other", signedPost, []string{"spam"}) {
+		t.Error("expected the signed label to be applied")
+	}
+	if ls.HasAny("did:plc:other", forgedPost, []string{"spam"}) {
+		t.Error("expected the label with an invalid signature to be dropped")
+	}
+	if ls.HasAny("did:plc:other", negPost, []string{"porn"}) {
+		t.Error("expected the signed negation to remove the label")
+	}
+	if !ls.HasAny("did:plc:author", forgedPost, []string{"porn"}) {
+		t.Error("expected the signed account label to apply to the author's posts")
+	}
+
+	rows, err := store.Labels(ctx, testLabelerDid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := map[string]bool{}
+	for _, r := range rows {
+		stored[r.Uri+" "+r.Val] = true
+	}
+	for _, want := range []string{signedPost + " spam", negPost + " porn", "did:plc:author porn"} {
+		if !stored[want] {
+			t.Errorf("expected %s to be stored, got %v", want, stored)
+		}
+	}
+	if stored[forgedPost+" spam"] {
+		t.Error("expected the label with an invalid signature not to be stored")
+	}
+}
+
+func TestLabelStoreBounds(t *testing.T) {
+	ls, _ := newTestLabelStore(t, NewMemoryStore(0, 0), "", 2)
+
+	past := time.Now().Add(-time.Minute)
+	soon := time.Now().Add(50 * time.Millisecond)
+
+	ls.mu.Lock()
+	ls.setLocked("at://did:plc:a/app.bsky.feed.post/expired", "spam", &past)
+	ls.setLocked("at://did:plc:a/app.bsky.feed.post/1", "spam", nil)
+	ls.setLocked("at://did:plc:a/app.bsky.feed.post/2", "spam", &soon)
+	// the store is full, so this one is dropped
+	ls.setLocked("at://did:plc:a/app.bsky.feed.post/3", "spam", nil)
+	ls.mu.Unlock()
+
+	if ls.HasAny("", "at://did:plc:a/app.bsky.feed.post/expired", []string{"spam"}) {
+		t.Error("expected an already expired label not to be kept")
+	}
+	if ls.HasAny("", "at://did:plc:a/app.bsky.feed.post/3", []string{"spam"}) {
+		t.Error("expected labels past the cap to be dropped")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// once a label expires, its room is reclaimed for new subjects
+	ls.mu.Lock()
+	ls.setLocked("at://did:plc:a/app.bsky.feed.post/4", "spam", nil)
+	subjects := len(ls.labels)
+	ls.mu.Unlock()
+
+	if subjects != 2 {
+		t.Errorf("expected 2 labeled subjects, got %d", subjects)
+	}
+	if !ls.HasAny("", "at://did:plc:a/app.bsky.feed.post/4", []string{"spam"}) {
+		t.Error("expected the expired label's room to be reused")
+	}
+	if !ls.HasAny("", "at://did:plc:a/app.bsky.feed.post/1", []string{"spam"}) {
+		t.Error("expected labels without an expiry to be kept")
+	}
+}
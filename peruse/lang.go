@@ -0,0 +1,99 @@
+package peruse
+
+import (
+	"strings"
+
+	"github.com/abadojack/whatlanggo"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"golang.org/x/text/language"
+)
+
+// normalizeLang reduces a BCP-47 tag such as en-US or pt-BR to its lowercased primary language subtag, since that is
+// what both the detector and most clients agree on
+func normalizeLang(tag string) string {
+	primary, _, _ := strings.Cut(strings.TrimSpace(tag), "-")
+	return strings.ToLower(primary)
+}
+
+// detectLang guesses the language of a post's text, returning an empty string when the detector isn't confident
+func detectLang(text string) string {
+	info := whatlanggo.Detect(text)
+	if !info.IsReliable() {
+		return ""
+	}
+	return info.Lang.Iso6391()
+}
+
+// postLang returns the primary language of a post. The post's own langs are preferred, and the detector is only used
+// when the author's client didn't set any.
+func postLang(post *bsky.FeedPost) string {
+	for _, l := range post.Langs {
+		if lang := normalizeLang(l); lang != "" {
+			return lang
+		}
+	}
+	return detectLang(post.Text)
+}
+
+// langAllowed reports whether a post in lang may be shown given a list of allowed languages. An empty list allows
+// everything, and posts whose language is unknown are always allowed rather than silently dropped.
+func langAllowed(lang string, allowed []string) bool {
+	if len(allowed) == 0 || lang == "" {
+		return true
+	}
+	for _, a := range allowed {
+		if a == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAcceptLanguage returns the primary languages from an Accept-Language header. Malformed headers, and headers
+// that accept any language with a wildcard, are treated as having no preference.
+func parseAcceptLanguage(header string) []string {
+	if header == "" {
+		return nil
+	}
+
+	tags, _, err := language.ParseAcceptLanguage(header)
+	if err != nil {
+		return nil
+	}
+
+	var langs []string
+	seen := map[string]struct{}{}
+	for _, t := range tags {
+		base, conf := t.Base()
+		if conf == language.No {
+			continue
+		}
+		lang := normalizeLang(base.String())
+		// x/text parses the * wildcard as mul
+		if lang == "mul" {
+			return nil
+		}
+		if lang == "" || lang == "und" {
+			continue
+		}
+		if _, ok := seen[lang]; ok {
+			continue
+		}
+		seen[lang] = struct{}{}
+		langs = append(langs, lang)
+	}
+
+	return langs
+}
+
+// ParseFeedLanguages parses a feed's allowed languages given as feed=lang|lang
+func ParseFeedLanguages(policy string) (string, []string, error) {
+	feed, langs, err := parseFeedList(policy, "language list", "feed=lang|lang")
+	if err != nil {
+		return "", nil, err
+	}
+	for i, l := range langs {
+		langs[i] = normalizeLang(l)
+	}
+	return feed, langs, nil
+}
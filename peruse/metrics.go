@@ -0,0 +1,130 @@
+package peruse
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var authKeyCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "peruse",
+	Name:      "auth_key_cache_lookups",
+	Help:      "total lookups of service auth signing keys by cache result",
+}, []string{"result"})
+
+var authKeyRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "peruse",
+	Name:      "auth_key_refreshes",
+	Help:      "total forced signing key refreshes after a signature verification failure, by outcome",
+}, []string{"status"})
+
+var firehoseEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "peruse",
+	Name:      "firehose_events",
+	Help:      "total record operations received from the firehose by collection and action",
+}, []string{"collection", "action"})
+
+var firehoseCommitLag = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "peruse",
+	Name:      "firehose_commit_lag_seconds",
+	Help:      "seconds between a commit's time and when it was processed",
+})
+
+var nervanaRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "peruse",
+	Name:      "nervana_request_duration_seconds",
+	Help:      "duration of nervana entity extraction requests by status",
+	Buckets:   prometheus.ExponentialBuckets(0.01, 2, 10),
+}, []string{"status"})
+
+var feedPostsEvaluated = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "peruse",
+	Name:      "feed_posts_evaluated",
+	Help:      "total posts evaluated for inclusion in a feed, by feed and whether they were included",
+}, []string{"feed", "included"})
+
+var feedSkeletonDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "peruse",
+	Name:      "feed_skeleton_duration_seconds",
+	Help:      "duration of feed skeleton requests by feed and response status",
+	Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+}, []string{"feed", "status"})
+
+var cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "peruse",
+	Name:      "cache_lookups",
+	Help:      "total cache lookups by cache and result",
+}, []string{"cache", "result"})
+
+var clickhouseQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "peruse",
+	Name:      "clickhouse_query_duration_seconds",
+	Help:      "duration of clickhouse queries by query and status",
+	Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+}, []string{"query", "status"})
+
+var clickhouseInsertDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "peruse",
+	Name:      "clickhouse_insert_duration_seconds",
+	Help:      "duration of clickhouse batch inserts by inserter",
+	Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+}, []string{"inserter"})
+
+var feedInsertQueued = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "peruse",
+	Name:      "feed_insert_queued",
+	Help:      "feed posts waiting to be written to clickhouse",
+})
+
+var feedInsertFlushes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "peruse",
+	Name:      "feed_insert_flushes",
+	Help:      "total flushes of queued feed posts by what triggered them",
+}, []string{"reason"})
+
+var feedInsertRows = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "peruse",
+	Name:      "feed_insert_rows",
+	Help:      "total feed posts written to clickhouse, or dropped because too many were queued, by table and status",
+}, []string{"table", "status"})
+
+var labelSubjects = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "peruse",
+	Name:      "label_subjects",
+	Help:      "posts and accounts with labels kept in memory",
+})
+
+var labelsDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "peruse",
+	Name:      "labels_dropped",
+	Help:      "total labels dropped because the maximum number of labeled posts and accounts was reached",
+})
+
+var memoryStoreRecords = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "peruse",
+	Name:      "memory_store_records",
+	Help:      "rows kept by the memory store, as of the last prune",
+})
+
+var memoryStoreDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "peruse",
+	Name:      "memory_store_dropped",
+	Help:      "total rows the memory store dropped because it was full, by kind",
+}, []string{"kind"})
+
+func observeQuery(query string, start time.Time, err error) {
+	status := "ok"
+	if err != nil {
+		status = "failed"
+	}
+	clickhouseQueryDuration.WithLabelValues(query, status).Observe(time.Since(start).Seconds())
+}
+
+func observeCacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.WithLabelValues(cache, result).Inc()
+}
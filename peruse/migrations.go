@@ -0,0 +1,244 @@
+package peruse
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// Every table peruse writes to is created and changed through a migration. Applied migrations are recorded in
+// peruse_schema_migration under a scope: the tables every instance shares are under the empty scope, and each feed's
+// table is under its own name so that a feed's table is created the first time the feed is registered. All DDL is
+// idempotent, so instances that start at the same time and race to apply a migration don't conflict.
+
+const schemaMigrationTableDDL = `
+CREATE TABLE IF NOT EXISTS peruse_schema_migration (
+	scope String,
+	version UInt32,
+	name String,
+	applied_at DateTime64(3)
+) ENGINE = ReplacingMergeTree(applied_at)
+ORDER BY (scope, version)
+`
+
+type Migration struct {
+	Version uint32
+	Name    string
+	DDL     string
+}
+
+// Migrations are applied in order and must never be edited or reordered once released. Add a new one instead.
+var Migrations = []Migration{
+	{1, "create_moderation", `
+CREATE TABLE IF NOT EXISTS peruse_moderation (
+	subject String,
+	feed String,
+	reason String,
+	created_at DateTime64(3),
+	deleted UInt8
+) ENGINE = ReplacingMergeTree(created_at)
+ORDER BY (subject, feed)
+`},
+	{2, "create_label", `
+CREATE TABLE IF NOT EXISTS peruse_label (
+	src String,
+	uri String,
+	val String,
+	neg UInt8,
+	cts DateTime64(3),
+	exp Nullable(DateTime64(3)),
+	seq Int64
+) ENGINE = ReplacingMergeTree(cts)
+ORDER BY (uri, src, val)
+`},
+	{3, "create_entity_mention", `
+CREATE TABLE IF NOT EXISTS peruse_entity_mention (
+	feed LowCardinality(String),
+	entity_id String,
+	text String,
+	created_at DateTime64(3)
+) ENGINE = MergeTree
+ORDER BY (feed, created_at, entity_id)
+TTL toDateTime(created_at) + INTERVAL 8 DAY
+`},
+	{4, "create_entity_post", `
+CREATE TABLE IF NOT EXISTS peruse_entity_post (
+	entity_id String,
+	uri String,
+	created_at DateTime64(3),
+	lang LowCardinality(String)
+) ENGINE = MergeTree
+ORDER BY (entity_id, created_at)
+TTL toDateTime(created_at) + INTERVAL 3 DAY
+`},
+	{5, "create_entity_alias", `
+CREATE TABLE IF NOT EXISTS peruse_entity_alias (
+	alias String,
+	entity_id String,
+	created_at DateTime64(3),
+	deleted UInt8
+) ENGINE = ReplacingMergeTree(created_at)
+ORDER BY alias
+`},
+	{6, "create_close_by_params", `
+CREATE TABLE IF NOT EXISTS peruse_close_by_params (
+	did String,
+	existing_connection_weight UInt64,
+	new_discovery_weight UInt64,
+	top_mutual_limit UInt64,
+	timeframe_seconds Int64,
+	updated_at DateTime64(3),
+	deleted UInt8
+) ENGINE = ReplacingMergeTree(updated_at)
+ORDER BY did
+`},
+}
+
+// feedTableMigrations are applied to each feed's table. Feeds only rank their last day of posts, so a few days are
+// kept for backfills and debugging.
+var feedTableMigrations = []Migration{
+	{1, "create_feed_table", `
+CREATE TABLE IF NOT EXISTS %[1]s (
+	uri String,
+	created_at DateTime64(3)
+) ENGINE = MergeTree
+ORDER BY (created_at, uri)
+TTL toDateTime(created_at) + INTERVAL 3 DAY
+`},
+	// tables that were created by hand before migrations may not have a ttl, but that is left to operators since
+	// adding one rewrites the table
+	{2, "add_lang", `ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS lang LowCardinality(String) DEFAULT ''`},
+}
+
+var tableNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// FeedTableMigrations returns the migrations for a feed's table
+func FeedTableMigrations(table string) ([]Migration, error) {
+	if !tableNameRegex.MatchString(table) {
+		return nil, fmt.Errorf("invalid feed table name %q", table)
+	}
+
+	migrations := make([]Migration, 0, len(feedTableMigrations))
+	for _, m := range feedTableMigrations {
+		m.DDL = fmt.Sprintf(m.DDL, table)
+		migrations = append(migrations, m)
+	}
+	return migrations, nil
+}
+
+type AppliedMigration struct {
+	Scope     string    `ch:"scope"`
+	Version   uint32    `ch:"version"`
+	Name      string    `ch:"name"`
+	AppliedAt time.Time `ch:"applied_at"`
+}
+
+type Migrator struct {
+	conn   driver.Conn
+	logger *slog.Logger
+}
+
+func NewMigrator(conn driver.Conn, logger *slog.Logger) *Migrator {
+	return &Migrator{
+		conn:   conn,
+		logger: logger.With("component", "migrator"),
+	}
+}
+
+// Applied returns the migrations that have been applied under a scope, by version
+func (m *Migrator) Applied(ctx context.Context, scope string) (map[uint32]AppliedMigration, error) {
+	if err := m.conn.Exec(ctx, schemaMigrationTableDDL); err != nil {
+		return nil, fmt.Errorf("failed to create schema migration table: %w", err)
+	}
+
+	var rows []AppliedMigration
+	if err := m.conn.Select(ctx, &rows, `
+		SELECT scope, version, name, applied_at
+		FROM peruse_schema_migration FINAL
+		WHERE scope = ?
+		`, scope); err != nil {
+		return nil, fmt.Errorf("failed to load applied migrations: %w", err)
+	}
+
+	applied := make(map[uint32]AppliedMigration, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// Pending returns the migrations under a scope that haven't been applied yet
+func (m *Migrator) Pending(ctx context.Context, scope string, migrations []Migration) ([]Migration, error) {
+	applied, err := m.Applied(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, mig := range migrations {
+		if _, ok := applied[mig.Version]; !ok {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// Apply runs the pending migrations under a scope in order, and returns how many were applied
+func (m *Migrator) Apply(ctx context.Context, scope string, migrations []Migration) (int, error) {
+	pending, err := m.Pending(ctx, scope, migrations)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, mig := range pending {
+		m.logger.Info("applying migration", "scope", scope, "version", mig.Version, "name", mig.Name)
+
+		if err := m.conn.Exec(ctx, mig.DDL); err != nil {
+			return i, fmt.Errorf("failed to apply migration %d (%s): %w", mig.Version, mig.Name, err)
+		}
+
+		batch, err := m.conn.PrepareBatch(ctx, "INSERT INTO peruse_schema_migration (scope, version, name, applied_at)")
+		if err != nil {
+			return i, err
+		}
+		if err := batch.AppendStruct(&AppliedMigration{
+			Scope:     scope,
+			Version:   mig.Version,
+			Name:      mig.Name,
+			AppliedAt: time.Now(),
+		}); err != nil {
+			return i, err
+		}
+		if err := batch.Send(); err != nil {
+			return i, fmt.Errorf("failed to record migration %d (%s): %w", mig.Version, mig.Name, err)
+		}
+	}
+
+	return len(pending), nil
+}
+
+// Migrate applies the shared migrations and those of each feed table
+func (m *Migrator) Migrate(ctx context.Context, feedTables []string) (int, error) {
+	total, err := m.Apply(ctx, "", Migrations)
+	if err != nil {
+		return total, err
+	}
+
+	for _, table := range feedTables {
+		migrations, err := FeedTableMigrations(table)
+		if err != nil {
+			return total, err
+		}
+		n, err := m.Apply(ctx, table, migrations)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
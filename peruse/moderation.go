@@ -0,0 +1,195 @@
+package peruse
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// ModerationEntry bans a did or at-uri from a single feed, or from every feed when Feed is empty
+type ModerationEntry struct {
+	Subject   string    `ch:"subject" json:"subject"`
+	Feed      string    `ch:"feed" json:"feed"`
+	Reason    string    `ch:"reason" json:"reason"`
+	CreatedAt time.Time `ch:"created_at" json:"createdAt"`
+	Deleted   uint8     `ch:"deleted" json:"-"`
+}
+
+// ModerationStore keeps banned dids and uris in memory, backed by the peruse_moderation table. Bans and unbans are
+// written to the store as new rows, and the latest row for each subject and feed wins.
+type ModerationStore struct {
+	store  Store
+	logger *slog.Logger
+
+	mu      sync.RWMutex
+	entries map[string]map[string]ModerationEntry // feed -> subject -> entry. the global list is under ""
+}
+
+func NewModerationStore(store Store, logger *slog.Logger) *ModerationStore {
+	return &ModerationStore{
+		store:   store,
+		logger:  logger.With("component", "moderation"),
+		entries: map[string]map[string]ModerationEntry{},
+	}
+}
+
+func (ms *ModerationStore) Init(ctx context.Context) error {
+	return ms.Load(ctx)
+}
+
+// Load replaces the in memory lists with the current state of the moderation table
+func (ms *ModerationStore) Load(ctx context.Context) error {
+	rows, err := ms.store.ModerationEntries(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load moderation entries: %w", err)
+	}
+
+	entries := map[string]map[string]ModerationEntry{}
+	for _, r := range rows {
+		if entries[r.Feed] == nil {
+			entries[r.Feed] = map[string]ModerationEntry{}
+		}
+		entries[r.Feed][r.Subject] = r
+	}
+
+	ms.mu.Lock()
+	ms.entries = entries
+	ms.mu.Unlock()
+
+	return nil
+}
+
+// Run periodically reloads the lists so that changes made by other instances or the cli are picked up
+func (ms *ModerationStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ms.Load(ctx); err != nil {
+				ms.logger.Error("error reloading moderation entries", "error", err)
+			}
+		}
+	}
+}
+
+func normalizeModerationSubject(subject string) (string, error) {
+	subject = strings.TrimSpace(subject)
+	if strings.HasPrefix(subject, "at://") {
+		if _, err := syntax.ParseATURI(subject); err != nil {
+			return "", fmt.Errorf("invalid at-uri: %w", err)
+		}
+		return subject, nil
+	}
+
+	did, err := syntax.ParseDID(subject)
+	if err != nil {
+		return "", fmt.Errorf("subject must be a did or an at-uri: %w", err)
+	}
+	return did.String(), nil
+}
+
+func (ms *ModerationStore) Ban(ctx context.Context, subject, feed, reason string) (*ModerationEntry, error) {
+	return ms.write(ctx, subject, feed, reason, false)
+}
+
+func (ms *ModerationStore) Unban(ctx context.Context, subject, feed string) error {
+	_, err := ms.write(ctx, subject, feed, "", true)
+	return err
+}
+
+func (ms *ModerationStore) write(ctx context.Context, subject, feed, reason string, deleted bool) (*ModerationEntry, error) {
+	subject, err := normalizeModerationSubject(subject)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := ModerationEntry{
+		Subject:   subject,
+		Feed:      feed,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	}
+	if deleted {
+		entry.Deleted = 1
+	}
+
+	if err := ms.store.WriteModerationEntry(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if deleted {
+		delete(ms.entries[feed], subject)
+	} else {
+		if ms.entries[feed] == nil {
+			ms.entries[feed] = map[string]ModerationEntry{}
+		}
+		ms.entries[feed][subject] = entry
+	}
+
+	return &entry, nil
+}
+
+// List returns all active entries, sorted by feed and then subject
+func (ms *ModerationStore) List() []ModerationEntry {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	entries := []ModerationEntry{}
+	for _, feedEntries := range ms.entries {
+		for _, e := range feedEntries {
+			entries = append(entries, e)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Feed != entries[j].Feed {
+			return entries[i].Feed < entries[j].Feed
+		}
+		return entries[i].Subject < entries[j].Subject
+	})
+
+	return entries
+}
+
+// IsBanned reports whether a post, or its author, is banned globally or from the given feed
+func (ms *ModerationStore) IsBanned(feed, did, uri string) bool {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	for _, f := range []string{"", feed} {
+		feedEntries, ok := ms.entries[f]
+		if !ok {
+			continue
+		}
+		if _, ok := feedEntries[did]; ok {
+			return true
+		}
+		if _, ok := feedEntries[uri]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsUriBanned is IsBanned for when only the post's uri is at hand
+func (ms *ModerationStore) IsUriBanned(feed, uri string) bool {
+	did := ""
+	if aturi, err := syntax.ParseATURI(uri); err == nil {
+		did = aturi.Authority().String()
+	}
+	return ms.IsBanned(feed, did, uri)
+}
@@ -0,0 +1,41 @@
+package peruse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/haileyok/photocopy/nervana"
+)
+
+// NerClient extracts entities from the text built for a post. The server uses nervana unless recorded responses are
+// given.
+type NerClient interface {
+	MakeRequest(ctx context.Context, text string) ([]nervana.NervanaItem, error)
+}
+
+// RecordedNer answers NER requests from recorded responses keyed by the exact text sent, so that replaying a firehose
+// recording gives the same feeds every time without nervana. Text without a recorded response has no entities.
+type RecordedNer struct {
+	responses map[string][]nervana.NervanaItem
+}
+
+// LoadRecordedNer reads recorded responses from a json object of text to the items nervana returned for it
+func LoadRecordedNer(path string) (*RecordedNer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recorded ner responses: %w", err)
+	}
+
+	responses := map[string][]nervana.NervanaItem{}
+	if err := json.Unmarshal(b, &responses); err != nil {
+		return nil, fmt.Errorf("invalid recorded ner responses in %s: %w", path, err)
+	}
+
+	return &RecordedNer{responses: responses}, nil
+}
+
+func (rn *RecordedNer) MakeRequest(ctx context.Context, text string) ([]nervana.NervanaItem, error) {
+	return rn.responses[text], nil
+}
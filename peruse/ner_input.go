@@ -0,0 +1,114 @@
+package peruse
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/haileyok/peruse/wikidata"
+	"github.com/haileyok/photocopy/nervana"
+)
+
+// nerSection is one field of a post that was included in the text sent to nervana
+type nerSection struct {
+	source wikidata.Source
+	text   string
+}
+
+// buildNerInput collects the parts of a post worth running NER over. Everything is sent to nervana in a single request
+// so that the cost per post stays the same, with each part on its own line.
+func buildNerInput(post *bsky.FeedPost) []nerSection {
+	var sections []nerSection
+	add := func(source wikidata.Source, text string) {
+		text = strings.TrimSpace(text)
+		if text != "" {
+			sections = append(sections, nerSection{source: source, text: text})
+		}
+	}
+
+	add(wikidata.SourceText, post.Text)
+
+	if post.Embed != nil {
+		var media *bsky.EmbedRecordWithMedia_Media
+		if rwm := post.Embed.EmbedRecordWithMedia; rwm != nil {
+			media = rwm.Media
+		} else {
+			media = &bsky.EmbedRecordWithMedia_Media{
+				EmbedImages:   post.Embed.EmbedImages,
+				EmbedVideo:    post.Embed.EmbedVideo,
+				EmbedExternal: post.Embed.EmbedExternal,
+			}
+		}
+
+		if media != nil {
+			if ext := media.EmbedExternal; ext != nil && ext.External != nil {
+				add(wikidata.SourceLinkTitle, ext.External.Title)
+				add(wikidata.SourceLinkDescription, ext.External.Description)
+			}
+			if imgs := media.EmbedImages; imgs != nil {
+				for _, img := range imgs.Images {
+					if img != nil {
+						add(wikidata.SourceAltText, img.Alt)
+					}
+				}
+			}
+			if vid := media.EmbedVideo; vid != nil && vid.Alt != nil {
+				add(wikidata.SourceAltText, *vid.Alt)
+			}
+		}
+	}
+
+	for _, facet := range post.Facets {
+		if facet == nil {
+			continue
+		}
+		for _, feature := range facet.Features {
+			if feature != nil && feature.RichtextFacet_Tag != nil {
+				add(wikidata.SourceHashtag, splitHashtag(feature.RichtextFacet_Tag.Tag))
+			}
+		}
+	}
+
+	return sections
+}
+
+func nerInputText(sections []nerSection) string {
+	texts := make([]string, 0, len(sections))
+	for _, s := range sections {
+		texts = append(texts, s.text)
+	}
+	return strings.Join(texts, "\n")
+}
+
+// tagNerItems works out which section each item nervana returned came from. Nervana only gives back the matched text,
+// so the first section containing it wins, which favors the post's own text.
+func tagNerItems(sections []nerSection, items []nervana.NervanaItem) []wikidata.EntityMatch {
+	matches := make([]wikidata.EntityMatch, 0, len(items))
+	for _, item := range items {
+		source := wikidata.SourceText
+		for _, s := range sections {
+			if strings.Contains(strings.ToLower(s.text), strings.ToLower(item.Text)) {
+				source = s.source
+				break
+			}
+		}
+		matches = append(matches, wikidata.EntityMatch{
+			NervanaItem: item,
+			Source:      source,
+		})
+	}
+	return matches
+}
+
+// splitHashtag turns a camel case tag like WrigleyField into words that NER has a chance at
+func splitHashtag(tag string) string {
+	var b strings.Builder
+	runes := []rune(strings.TrimPrefix(tag, "#"))
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+			b.WriteRune(' ')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
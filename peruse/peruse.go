@@ -8,17 +8,16 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/ClickHouse/clickhouse-go/v2"
-	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/atproto/identity"
-	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/haileyok/peruse/internal/helpers"
 	"github.com/haileyok/peruse/wikidata"
 	"github.com/haileyok/photocopy/nervana"
 	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	slogecho "github.com/samber/slog-echo"
@@ -28,44 +27,135 @@ import (
 type Server struct {
 	httpd         *http.Server
 	echo          *echo.Echo
-	conn          driver.Conn
+	store         Store
 	logger        *slog.Logger
 	args          *ServerArgs
-	keyCache      *lru.Cache[string, crypto.PublicKey]
+	keyCache      *expirable.LRU[string, crypto.PublicKey]
+	keyRefreshMu  sync.Mutex
+	keyRefreshes  *expirable.LRU[string, struct{}] // dids whose key was refreshed in the last KeyRefreshInterval
+	jtiCache      *lru.Cache[string, time.Time]
 	directory     identity.Directory
 	userManager   *UserManager
-	xrpc          *xrpc.Client
 	feeds         map[string]Feed
 	cursor        string
-	nervanaClient *nervana.Client
+	nerClient     NerClient
+	feedWork      sync.WaitGroup // feed callbacks still running for commits that were already handled
+	rateLimiter   *rateLimiter
+	firehose      *firehoseState
+	moderation    *ModerationStore
+	closeByParams *CloseByParamsStore
+	labels        *LabelStore
+	trending      TrendingStore
+	entityFeeds   *EntityFeeds
+
+	closeByRankedPages *expirable.LRU[closeByRankedKey, [][]closeByRankedPost]
 }
 
 type ServerArgs struct {
-	Logger               *slog.Logger
-	HttpAddr             string
-	ClickhouseAddr       string
-	ClickhouseDatabase   string
-	ClickhouseUser       string
-	ClickhousePass       string
-	FeedOwnerDid         string
-	ServiceDid           string
-	ServiceEndpoint      string
-	ChronoFeedRkey       string
-	SuggestedFollowsRkey string
-	CursorFile           string
-	RelayHost            string
-	NervanaEndpoint      string
-	NervanaApiKey        string
+	Logger                   *slog.Logger
+	HttpAddr                 string
+	ClickhouseAddr           string
+	ClickhouseDatabase       string
+	ClickhouseUser           string
+	ClickhousePass           string
+	FeedOwnerDid             string
+	ServiceDid               string
+	ServiceEndpoint          string
+	ChronoFeedRkey           string
+	SuggestedFollowsRkey     string
+	CloseByRankedRkey        string
+	ChronoFeedIncludeReposts bool
+	SuggestedFollowsPage     bool
+	CursorFile               string
+	RelayHost                string
+	NervanaEndpoint          string
+	NervanaApiKey            string
+	CloseByParams            CloseByParams
+	CloseByMixParams         CloseByMixParams
+	PlcUrl                   string
+	PlcRateLimit             float64
+	IdentityTimeout          time.Duration
+	JwtLeeway                time.Duration
+	JwtReplayProtection      bool
+	KeyCacheTTL              time.Duration
+	// Overrides for the per route budgets in DefaultRateLimits
+	RateLimits map[string]RateLimit
+	// TrustedProxies are the addresses or cidr ranges of proxies whose X-Forwarded-For header is trusted for the client
+	// ip. The connection's remote address is used when empty.
+	TrustedProxies []string
+	// The admin api is only served when AdminAddr is set, and requires AdminToken as a bearer token
+	AdminAddr  string
+	AdminToken string
+	// Labels from LabelerDid are only consumed when LabelerHost is set. ExcludedLabels applies to every feed that
+	// doesn't have its own list in FeedExcludedLabels.
+	LabelerHost        string
+	LabelerDid         string
+	ExcludedLabels     []string
+	FeedExcludedLabels map[string][]string
+	// MaxLabelSubjects caps how many labeled posts and accounts are kept in memory. Zero uses DefaultMaxLabelSubjects.
+	MaxLabelSubjects int
+	// Posts in languages outside a feed's list are dropped at ingest. Feeds without a list accept every language.
+	FeedLanguages map[string][]string
+	// Which replies and quotes each topic feed considers. Feeds without options use DefaultFeedPostOptions.
+	FeedPostOptions map[string]FeedPostOptions
+	// NerOnReplies sends replies to nervana as well as top level posts. Feeds can't match replies without it.
+	NerOnReplies bool
+	// RuleFeeds are topic feeds matched by hashtags, domains, mentions and patterns rather than entities
+	RuleFeeds []RuleFeedConfig
+	// CompositeFeeds combine other feeds, and may reference any feed defined before them
+	CompositeFeeds []CompositeFeedConfig
+	// TrendingBackend is where entity mentions are counted for the trending api: clickhouse, memory or none
+	TrendingBackend string
+	// EntityFeedMinPosts is how many ranked posts an entity needs before its feed is served
+	EntityFeedMinPosts int
+	// ReplayFile is a firehose recording to consume instead of RelayHost. ReplaySpeed scales the recorded time between
+	// commits, and zero replays as fast as possible.
+	ReplayFile  string
+	ReplaySpeed float64
+	// NerResponsesFile answers NER requests from recorded responses instead of nervana, for replays that don't depend
+	// on it. See LoadRecordedNer.
+	NerResponsesFile string
+	// StoreBackend is where peruse reads and writes its data: clickhouse, or memory for small instances without
+	// clickhouse. The memory store keeps MemoryStoreRetention of posts, interactions and follows, up to
+	// MemoryStoreMaxRecords of them.
+	StoreBackend          string
+	MemoryStoreRetention  time.Duration
+	MemoryStoreMaxRecords int
+	// FeedInsert batches the rows the topic feeds write to clickhouse
+	FeedInsert FeedInsertConfig
 }
 
 type Feed interface {
 	Name() string
+	// RequiresAuth reports whether the feed needs a viewer. Feeds that don't may be served to logged out clients, in
+	// which case FeedSkeleton is called without a user set on the context.
+	RequiresAuth() bool
 	FeedSkeleton(e echo.Context, req FeedSkeletonRequest) error
-	OnPost(ctx context.Context, post *bsky.FeedPost, uri, did, rkey, cid string, indexedAt time.Time, nerItems []nervana.NervanaItem) error
+	OnPost(ctx context.Context, post *bsky.FeedPost, uri, did, rkey, cid string, indexedAt time.Time, nerItems []wikidata.EntityMatch) error
 	OnLike(ctx context.Context, like *bsky.FeedLike, uri, did, rkey, cid string, indexedAt time.Time) error
 	OnRepost(ctx context.Context, repost *bsky.FeedRepost, uri, did, rkey, cid string, indexedAt time.Time) error
 }
 
+// CachedFeed is implemented by feeds that keep a ranked cache which operators can inspect and force to refresh
+type CachedFeed interface {
+	Feed
+	CacheInfo() FeedCacheInfo
+	RefreshCache(ctx context.Context) error
+}
+
+// RankedSource is implemented by feeds whose ranked posts can be combined by a CompositeFeed
+type RankedSource interface {
+	Feed
+	// RankedPosts returns the feed's current ranking, with posts moderated out of the feed already removed
+	RankedPosts(ctx context.Context) ([]RankedFeedPost, error)
+}
+
+type FeedCacheInfo struct {
+	CachedAt  time.Time
+	ExpiresAt time.Time
+	Size      int
+}
+
 func NewServer(args ServerArgs) (*Server, error) {
 	if args.Logger == nil {
 		args.Logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
@@ -73,7 +163,34 @@ func NewServer(args ServerArgs) (*Server, error) {
 		}))
 	}
 
+	if args.CloseByParams == (CloseByParams{}) {
+		args.CloseByParams = DefaultCloseByParams()
+	} else {
+		args.CloseByParams = args.CloseByParams.withDefaults(DefaultCloseByParams())
+	}
+
+	args.CloseByMixParams = args.CloseByMixParams.withDefaults(DefaultCloseByMixParams())
+
+	if args.AdminAddr != "" && args.AdminToken == "" {
+		return nil, fmt.Errorf("an admin token is required when the admin api is enabled")
+	}
+
+	if args.ReplaySpeed < 0 {
+		return nil, fmt.Errorf("replay speed can't be negative")
+	}
+
+	ipExtractor, err := newIPExtractor(args.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimiter, err := newRateLimiter(args.RateLimits)
+	if err != nil {
+		return nil, err
+	}
+
 	e := echo.New()
+	e.IPExtractor = ipExtractor
 	e.Use(middleware.RemoveTrailingSlash())
 	e.Use(slogecho.New(args.Logger))
 	e.Use(middleware.Recover())
@@ -83,63 +200,107 @@ func NewServer(args ServerArgs) (*Server, error) {
 		Handler: e,
 	}
 
-	conn, err := clickhouse.Open(&clickhouse.Options{
-		Addr: []string{args.ClickhouseAddr},
-		Auth: clickhouse.Auth{
-			Database: args.ClickhouseDatabase,
-			Username: args.ClickhouseUser,
-			Password: args.ClickhousePass,
-		},
-	})
+	store, err := newStore(&args)
 	if err != nil {
 		return nil, err
 	}
 
-	kc, _ := lru.New[string, crypto.PublicKey](100_000)
+	if args.KeyCacheTTL <= 0 {
+		args.KeyCacheTTL = DefaultKeyCacheTTL
+	}
+
+	kc := expirable.NewLRU[string, crypto.PublicKey](100_000, nil, args.KeyCacheTTL)
+
+	if args.JwtLeeway <= 0 {
+		args.JwtLeeway = DefaultJwtLeeway
+	}
+
+	var jc *lru.Cache[string, time.Time]
+	if args.JwtReplayProtection {
+		jc, _ = lru.New[string, time.Time](100_000)
+	}
+
+	if args.PlcUrl == "" {
+		args.PlcUrl = DefaultPlcUrl
+	}
+	if args.PlcRateLimit <= 0 {
+		args.PlcRateLimit = DefaultPlcRateLimit
+	}
+	if args.IdentityTimeout <= 0 {
+		args.IdentityTimeout = 5 * time.Second
+	}
 
 	baseDir := identity.BaseDirectory{
-		PLCURL: "https://plc.directory",
+		PLCURL: args.PlcUrl,
 		HTTPClient: http.Client{
-			Timeout: time.Second * 5,
+			Timeout: args.IdentityTimeout,
 		},
-		PLCLimiter:            rate.NewLimiter(rate.Limit(10), 1), // TODO: what is this rate limit anyway?
+		PLCLimiter:            rate.NewLimiter(rate.Limit(args.PlcRateLimit), 1), // requests per second to the plc directory
 		TryAuthoritativeDNS:   false,
 		SkipDNSDomainSuffixes: []string{".bsky.social", ".staging.bsky.dev"},
 	}
 
 	dir := identity.NewCacheDirectory(&baseDir, 100_000, time.Hour*48, time.Minute*15, time.Minute*15)
 
-	nervanaClient := nervana.NewClient(args.NervanaEndpoint, args.NervanaApiKey)
-
-	return &Server{
-		echo:        e,
-		httpd:       httpd,
-		conn:        conn,
-		args:        &args,
-		logger:      args.Logger,
-		keyCache:    kc,
-		directory:   &dir,
-		userManager: NewUserManager(),
-		xrpc: &xrpc.Client{
-			Host: "https://public.api.bsky.app",
-		},
+	if args.LabelerHost != "" && args.LabelerDid == "" {
+		return nil, fmt.Errorf("a labeler did is required when a labeler host is set")
+	}
+	if args.ExcludedLabels == nil {
+		args.ExcludedLabels = DefaultExcludedLabels
+	}
+
+	var nerClient NerClient = nervana.NewClient(args.NervanaEndpoint, args.NervanaApiKey)
+	if args.NerResponsesFile != "" {
+		nerClient, err = LoadRecordedNer(args.NerResponsesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Server{
+		echo:          e,
+		httpd:         httpd,
+		store:         store,
+		args:          &args,
+		logger:        args.Logger,
+		keyCache:      kc,
+		keyRefreshes:  expirable.NewLRU[string, struct{}](100_000, nil, KeyRefreshInterval),
+		jtiCache:      jc,
+		directory:     &dir,
+		userManager:   NewUserManager(),
 		feeds:         map[string]Feed{},
-		nervanaClient: nervanaClient,
-	}, nil
+		nerClient:     nerClient,
+		rateLimiter:   rateLimiter,
+		firehose:      newFirehoseState(),
+		moderation:    NewModerationStore(store, args.Logger),
+		closeByParams: NewCloseByParamsStore(store, args.Logger),
+
+		closeByRankedPages: expirable.NewLRU[closeByRankedKey, [][]closeByRankedPost](maxCloseByRankedSnapshots, nil, closeByRankedSnapshotTTL),
+	}
+
+	s.trending, err = NewTrendingStore(args.TrendingBackend, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.repliesWanted() && !args.NerOnReplies {
+		args.Logger.Warn("some wikidata feeds include replies, but replies aren't sent to nervana so they will never match")
+	}
+
+	if args.LabelerHost != "" {
+		s.labels = NewLabelStore(store, args.Logger, &dir, args.LabelerDid, args.LabelerHost, s.relevantLabels(), args.MaxLabelSubjects)
+	}
+
+	return s, nil
 }
 
 func (s *Server) Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	s.addFeed(NewWikidataFeed(ctx, s, "seattle", "seattle_post", wikidata.SeattleEntities))
-	s.addFeed(NewWikidataFeed(ctx, s, "los-angeles", "los_angeles_post", wikidata.LosAngelesEntities))
-	s.addFeed(NewWikidataFeed(ctx, s, "san-francisco", "san_francisco_post", wikidata.SanFranciscoEntities))
-	s.addFeed(NewWikidataFeed(ctx, s, "austin", "austin_post", wikidata.AustinEntities))
-	s.addFeed(NewWikidataFeed(ctx, s, "chicago", "chicago_post", wikidata.ChicagoEntities))
-	s.addFeed(NewWikidataFeed(ctx, s, "boston", "boston_post", wikidata.BostonEntities))
-	s.addFeed(NewWikidataFeed(ctx, s, "software", "software_post", wikidata.SoftwareEntities))
-	s.addFeed(NewWikidataFeed(ctx, s, "baseball", "baseball_post", wikidata.BaseballEntities))
+	if err := s.setup(ctx); err != nil {
+		return err
+	}
 
 	s.addRoutes()
 
@@ -149,6 +310,15 @@ func (s *Server) Run(ctx context.Context) error {
 		}
 	}()
 
+	if s.args.AdminAddr != "" {
+		adminHttpd := s.newAdminServer()
+		go func() {
+			if err := adminHttpd.ListenAndServe(); err != nil {
+				s.logger.Error("error starting admin http server", "error", err)
+			}
+		}()
+	}
+
 	go func(ctx context.Context, cancel context.CancelFunc) {
 		if err := s.startConsumer(ctx, cancel); err != nil {
 			s.logger.Error("error starting consumer", "error", err)
@@ -159,7 +329,90 @@ func (s *Server) Run(ctx context.Context) error {
 
 	s.logger.Info("shutting down server...")
 
-	s.conn.Close()
+	s.close()
+
+	return nil
+}
+
+// close waits for the feeds to finish with the posts they were given, writes out everything that is still buffered and
+// closes the store
+func (s *Server) close() {
+	s.feedWork.Wait()
+
+	if s.trending != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.trending.Close(ctx); err != nil {
+			s.logger.Error("error closing trending store", "error", err)
+		}
+	}
+
+	if err := s.store.Close(); err != nil {
+		s.logger.Error("error closing store", "error", err)
+	}
+}
+
+// setup initializes the store and everything loaded from it, and registers the feeds. It is shared by Run and the
+// commands that work on feeds without serving them.
+func (s *Server) setup(ctx context.Context) error {
+	if err := s.store.Init(ctx); err != nil {
+		return err
+	}
+
+	if err := s.moderation.Init(ctx); err != nil {
+		return err
+	}
+	go s.moderation.Run(ctx, time.Minute)
+
+	if s.trending != nil {
+		if err := s.trending.Init(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s.labels != nil {
+		if err := s.labels.Init(ctx); err != nil {
+			return err
+		}
+		go s.labels.Run(ctx)
+	}
+
+	for _, cfg := range WikidataFeeds {
+		f, err := NewWikidataFeed(ctx, s, cfg.Name, cfg.Table, cfg.Entities)
+		if err != nil {
+			return err
+		}
+		if err := s.addFeed(f); err != nil {
+			return err
+		}
+	}
+
+	for _, cfg := range s.args.RuleFeeds {
+		f, err := NewRuleFeed(ctx, s, cfg)
+		if err != nil {
+			return err
+		}
+		if err := s.addFeed(f); err != nil {
+			return err
+		}
+	}
+
+	for _, cfg := range s.args.CompositeFeeds {
+		f, err := NewCompositeFeed(s, cfg)
+		if err != nil {
+			return err
+		}
+		if err := s.addFeed(f); err != nil {
+			return err
+		}
+	}
+
+	entityFeeds, err := NewEntityFeeds(ctx, s)
+	if err != nil {
+		return err
+	}
+	s.entityFeeds = entityFeeds
+	go s.entityFeeds.Run(ctx, time.Minute)
 
 	return nil
 }
@@ -174,31 +427,66 @@ func (s *Server) addFeed(f Feed) error {
 }
 
 func (s *Server) addRoutes() {
-	s.echo.GET("/xrpc/app.bsky.feed.getFeedSkeleton", s.handleFeedSkeleton, s.handleAuthMiddleware)
-	s.echo.GET("/xrpc/app.bsky.feed.describeFeedGenerator", s.handleDescribeFeedGenerator)
-	s.echo.GET("/.well-known/did.json", s.handleWellKnown)
-	s.echo.GET("/api/getSuggestedFollows", s.handleGetSuggestedFollows)
+	s.echo.GET("/xrpc/app.bsky.feed.getFeedSkeleton", s.handleFeedSkeleton, s.rateLimitMiddleware(RateLimitFeedSkeleton), s.handleOptionalAuthMiddleware)
+	s.echo.GET("/xrpc/app.bsky.feed.describeFeedGenerator", s.handleDescribeFeedGenerator, s.rateLimitMiddleware(RateLimitDescribeFeedGenerator))
+	s.echo.GET("/.well-known/did.json", s.handleWellKnown, s.rateLimitMiddleware(RateLimitWellKnown))
+	s.echo.GET("/xrpc/app.peruse.graph.getSuggestedFollows", s.handleGetSuggestedFollowsXrpc, s.rateLimitMiddleware(RateLimitSuggestedFollows), s.handleAuthMiddleware)
+	if s.args.SuggestedFollowsPage {
+		s.echo.GET("/api/getSuggestedFollows", s.handleGetSuggestedFollowsPage, s.rateLimitMiddleware(RateLimitSuggestedFollowsPage))
+	}
+	s.echo.POST("/xrpc/app.peruse.graph.putCloseByParams", s.handlePutCloseByParams, s.rateLimitMiddleware(RateLimitCloseByParams), s.handleAuthMiddleware)
+	s.echo.GET("/api/trending", s.handleTrending, s.rateLimitMiddleware(RateLimitTrending))
 }
 
 func (s *Server) handleAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(e echo.Context) error {
 		auth := e.Request().Header.Get("authorization")
-		pts := strings.Split(auth, " ")
-		if auth == "" || len(pts) != 2 || pts[0] != "Bearer" {
-			return helpers.InputError(e, "AuthRequired", "")
+		if auth == "" {
+			return helpers.UnauthorizedError(e, "AuthRequired", "")
 		}
 
-		did, err := s.checkJwt(e.Request().Context(), pts[1])
-		if err != nil {
-			return helpers.InputError(e, "AuthRequired", err.Error())
+		return s.authenticate(e, auth, next)
+	}
+}
+
+// handleOptionalAuthMiddleware behaves like handleAuthMiddleware when an authorization header is present, but lets
+// requests without one through with no user set. Handlers are responsible for rejecting anonymous requests they can't
+// serve.
+func (s *Server) handleOptionalAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(e echo.Context) error {
+		auth := e.Request().Header.Get("authorization")
+		if auth == "" {
+			return next(e)
 		}
 
-		u := s.userManager.getUser(did)
+		return s.authenticate(e, auth, next)
+	}
+}
+
+func (s *Server) authenticate(e echo.Context, auth string, next echo.HandlerFunc) error {
+	pts := strings.Split(auth, " ")
+	if len(pts) != 2 || pts[0] != "Bearer" {
+		return s.rejectAuth(e, "")
+	}
 
-		e.Set("user", u)
+	lxm := strings.TrimPrefix(e.Path(), "/xrpc/")
 
-		return next(e)
+	did, err := s.checkJwt(e.Request().Context(), pts[1], lxm)
+	if err != nil {
+		return s.rejectAuth(e, err.Error())
 	}
+
+	u := s.userManager.getUser(did)
+
+	e.Set("user", u)
+
+	return s.rateLimitAuthenticated(e, did, next)
+}
+
+// userFromContext returns the authenticated user for the request, or nil if the request is anonymous
+func userFromContext(e echo.Context) *User {
+	u, _ := e.Get("user").(*User)
+	return u
 }
 
 func urisToFeedPostItems(uris []string) []FeedPostItem {
@@ -2,38 +2,79 @@ package peruse
 
 import (
 	"context"
-	"strings"
+	"time"
 
 	"github.com/haileyok/photocopy/models"
 )
 
-func (s *Server) getPostsForDidsChronological(ctx context.Context, dids []string, cursor string) ([]models.Post, error) {
-	var posts []models.Post
-	if err := s.conn.Select(ctx, &posts, `
-		SELECT uri
-		FROM default.post
-		WHERE rkey < ?
-		AND did IN (?)
-		AND parent_uri = ''
-		ORDER BY created_at DESC
-		LIMIT 50
-		`, cursor, dids); err != nil {
+// ChronoPost is a post, or a repost of a post, by one of the dids a chronological feed is built from. For reposts,
+// Uri is the reposted post, Did and Rkey belong to the repost record, and RepostUri is set.
+type ChronoPost struct {
+	Uri       string `ch:"uri"`
+	Did       string `ch:"did"`
+	Rkey      string `ch:"rkey"`
+	RepostUri string `ch:"repost_uri"`
+}
+
+func (s *Server) getPostsForDidsChronological(ctx context.Context, dids []string, cursor string, includeReposts bool) ([]ChronoPost, error) {
+	queryName := "posts_chronological"
+	if includeReposts {
+		queryName = "posts_and_reposts_chronological"
+	}
+
+	start := time.Now()
+	posts, err := s.store.PostsChronological(ctx, dids, cursor, includeReposts)
+	observeQuery(queryName, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+func (s *Server) getPostsForDidsInRange(ctx context.Context, dids []string, since, until time.Time) ([]models.Post, error) {
+	start := time.Now()
+	posts, err := s.store.PostsInRange(ctx, dids, since, until)
+	observeQuery("posts_in_range", start, err)
+	if err != nil {
 		return nil, err
 	}
 	return posts, nil
 }
 
-func modelPostsToFeedItems(posts []models.Post) ([]FeedPostItem, string) {
+// isModeratedChronoPost returns a check for whether a post or repost is banned or labeled out of the named feed
+func (s *Server) isModeratedChronoPost(feedName string) func(p ChronoPost) bool {
+	return func(p ChronoPost) bool {
+		if s.isExcluded(feedName, p.Did, p.Uri) {
+			return true
+		}
+		// for reposts, also check the author of the post that was reposted
+		return p.RepostUri != "" && s.isUriExcluded(feedName, p.Uri)
+	}
+}
+
+// chronoPostsToFeedItems converts posts to feed items, attaching a repost reason where needed and a feed context
+// from contextFor if it returns one for the item's author. Posts matching skip are left out, but the cursor still
+// points past them.
+func chronoPostsToFeedItems(posts []ChronoPost, contextFor func(did string) *string, skip func(p ChronoPost) bool) ([]FeedPostItem, string) {
 	var fpis []FeedPostItem
 	var cursor string
 	for i, p := range posts {
-		fpis = append(fpis, FeedPostItem{
-			Post: p.Uri,
-		})
 		if i == len(posts)-1 {
-			pts := strings.Split(p.Uri, "/")
-			cursor = pts[len(pts)-1]
+			cursor = p.Rkey
+		}
+		if skip != nil && skip(p) {
+			continue
+		}
+		fpi := FeedPostItem{
+			Post: p.Uri,
+		}
+		if p.RepostUri != "" {
+			fpi.Reason = newRepostReason(p.RepostUri)
+		}
+		if contextFor != nil {
+			fpi.FeedContext = contextFor(p.Did)
 		}
+		fpis = append(fpis, fpi)
 	}
 	return fpis, cursor
 }
@@ -0,0 +1,312 @@
+package peruse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/haileyok/peruse/internal/helpers"
+	"github.com/haileyok/peruse/wikidata"
+	"github.com/labstack/echo/v4"
+)
+
+// rankedFeed is the storage, ranking and serving shared by the topic feeds. Matching posts are inserted into the
+// feed's table, and the feed is served from that table ranked by likes with a time decay. Feed types embed it and
+// only need to implement OnPost, calling considerPost before matching and includePost for posts that matched.
+type rankedFeed struct {
+	store          Store
+	logger         *slog.Logger
+	cached         []RankedFeedPost
+	cachedAt       time.Time
+	cacheExpiresAt time.Time
+	mu             sync.RWMutex
+	isExcluded     func(feedName, did, uri string) bool
+	languages      []string
+	postOptions    FeedPostOptions
+	trending       TrendingStore
+	feedName       string
+	tableName      string
+
+	// rank fetches the feed's ranking from the store, and queryName is what it is reported as in query metrics
+	rank      func(ctx context.Context) ([]RankedFeedPost, error)
+	queryName string
+}
+
+func newRankedFeed(ctx context.Context, s *Server, feedName, tableName string) (*rankedFeed, error) {
+	if err := s.store.InitFeedTable(ctx, tableName); err != nil {
+		return nil, fmt.Errorf("failed to init table for feed %s: %w", feedName, err)
+	}
+
+	return &rankedFeed{
+		store:       s.store,
+		logger:      s.logger.With("feed", feedName),
+		isExcluded:  s.isExcluded,
+		languages:   s.args.FeedLanguages[feedName],
+		postOptions: s.feedPostOptions(feedName),
+		trending:    s.trending,
+		feedName:    feedName,
+		tableName:   tableName,
+		rank: func(ctx context.Context) ([]RankedFeedPost, error) {
+			return s.store.RankedFeedPosts(ctx, tableName)
+		},
+		queryName: "feed_posts_" + feedName,
+	}, nil
+}
+
+// considerPost reports whether a post is the kind of post this feed takes at all, before any matching is done
+func (f *rankedFeed) considerPost(post *bsky.FeedPost, did, uri string) bool {
+	if post.Reply != nil && !f.postOptions.allowsReply(post.Reply) {
+		return false
+	}
+
+	if !f.postOptions.Quotes && isQuotePost(post) {
+		return false
+	}
+
+	return !f.isExcluded(f.feedName, did, uri)
+}
+
+// includePost applies the checks that are only worth running for posts that matched, then adds the post to the feed
+// and counts its entities towards the feed's trending entities
+func (f *rankedFeed) includePost(ctx context.Context, post *bsky.FeedPost, uri string, indexedAt time.Time, matched bool, nerItems []wikidata.EntityMatch) error {
+	included := matched
+
+	// the language is only worked out for posts that matched, since detection isn't free
+	var lang string
+	if included {
+		lang = postLang(post)
+		included = langAllowed(lang, f.languages)
+	}
+
+	if included && post.Reply != nil && post.Reply.Root != nil && f.postOptions.MinRootLikes > 0 {
+		start := time.Now()
+		likes, err := f.store.LikeCount(ctx, post.Reply.Root.Uri)
+		observeQuery("like_count", start, err)
+		if err != nil {
+			return fmt.Errorf("failed to get root like count: %w", err)
+		}
+		included = likes >= f.postOptions.MinRootLikes
+	}
+
+	feedPostsEvaluated.WithLabelValues(f.feedName, strconv.FormatBool(included)).Inc()
+
+	if included {
+		fdi := FeedDatabaseItem{
+			Uri:       uri,
+			CreatedAt: indexedAt,
+			Lang:      lang,
+		}
+		// a post dropped because clickhouse is behind is already logged and counted by the inserter
+		if err := f.store.InsertFeedPost(ctx, f.tableName, fdi); err != nil && !errors.Is(err, ErrFeedInsertDropped) {
+			return err
+		}
+
+		if mentions := entityMentions(nerItems); f.trending != nil && len(mentions) > 0 {
+			if err := f.trending.Record(ctx, f.feedName, mentions, indexedAt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type RankedFeedPost struct {
+	LikeCt     uint64    `ch:"like_ct"`
+	Uri        string    `ch:"uri"`
+	CreatedAt  time.Time `ch:"created_at"`
+	Lang       string    `ch:"lang"`
+	HoursOld   int64     `ch:"hours_old"`
+	DecayScore float64   `ch:"decay_score"`
+}
+
+type FeedDatabaseItem struct {
+	Uri       string    `ch:"uri"`
+	CreatedAt time.Time `ch:"created_at"`
+	Lang      string    `ch:"lang"`
+}
+
+func (f *rankedFeed) Name() string {
+	return f.feedName
+}
+
+func (f *rankedFeed) RequiresAuth() bool {
+	return false
+}
+
+func (f *rankedFeed) FeedSkeleton(e echo.Context, req FeedSkeletonRequest) error {
+	ctx := e.Request().Context()
+
+	var cursor int
+	if req.Cursor != "" {
+		cursor64, err := strconv.ParseInt(req.Cursor, 10, 32)
+		if err != nil {
+			f.logger.Error("error converting cursor", "error", err)
+		}
+		cursor = int(cursor64)
+	}
+
+	posts, err := f.getPosts(ctx)
+	if err != nil {
+		f.logger.Error("error getting posts", "error", err)
+		return helpers.ServerError(e, "FeedError", "Unable to get posts for feed")
+	}
+
+	posts = f.filterModerated(posts)
+	posts = filterLangs(posts, req.ViewerLangs)
+
+	if len(posts) < cursor {
+		cursor = len(posts)
+	}
+
+	posts = posts[cursor:]
+
+	if len(posts) > 30 {
+		posts = posts[:30]
+	}
+
+	var items []FeedPostItem
+	for _, p := range posts {
+		items = append(items, FeedPostItem{
+			Post: p.Uri,
+		})
+	}
+
+	newCursor := fmt.Sprintf("%d", cursor+len(posts))
+
+	return e.JSON(200, FeedSkeletonResponse{
+		Feed:   items,
+		Cursor: &newCursor,
+	})
+}
+
+func (f *rankedFeed) OnLike(ctx context.Context, like *bsky.FeedLike, uri, did, rkey, cid string, indexedAt time.Time) error {
+	return nil
+}
+
+func (f *rankedFeed) OnRepost(ctx context.Context, repost *bsky.FeedRepost, uri, did, rkey, cid string, indexedAt time.Time) error {
+	return nil
+}
+
+func (f *rankedFeed) RankedPosts(ctx context.Context) ([]RankedFeedPost, error) {
+	posts, err := f.getPosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return f.filterModerated(posts), nil
+}
+
+// filterModerated drops posts that were banned or labeled after they were added to the feed
+func (f *rankedFeed) filterModerated(posts []RankedFeedPost) []RankedFeedPost {
+	filtered := make([]RankedFeedPost, 0, len(posts))
+	for _, p := range posts {
+		did := ""
+		if aturi, err := syntax.ParseATURI(p.Uri); err == nil {
+			did = aturi.Authority().String()
+		}
+		if f.isExcluded(f.feedName, did, p.Uri) {
+			continue
+		}
+		filtered = append(filtered, p)
+	}
+	return filtered
+}
+
+// filterLangs drops posts that aren't in one of the viewer's languages. Viewers without a preference see everything.
+func filterLangs(posts []RankedFeedPost, viewerLangs []string) []RankedFeedPost {
+	if len(viewerLangs) == 0 {
+		return posts
+	}
+	filtered := make([]RankedFeedPost, 0, len(posts))
+	for _, p := range posts {
+		if langAllowed(p.Lang, viewerLangs) {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
+
+func (f *rankedFeed) getPosts(ctx context.Context) ([]RankedFeedPost, error) {
+	now := time.Now()
+	f.mu.RLock()
+	expiresAt := f.cacheExpiresAt
+	posts := f.cached
+	f.mu.RUnlock()
+	if posts != nil && now.Before(expiresAt) {
+		observeCacheLookup("feed_posts", true)
+		return posts, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cached != nil && now.Before(f.cacheExpiresAt) {
+		observeCacheLookup("feed_posts", true)
+		return f.cached, nil
+	}
+
+	observeCacheLookup("feed_posts", false)
+
+	return f.refreshPostsLocked(ctx)
+}
+
+// refreshPostsLocked reruns the ranking query and replaces the cache. f.mu must be held.
+func (f *rankedFeed) refreshPostsLocked(ctx context.Context) ([]RankedFeedPost, error) {
+	start := time.Now()
+	posts, err := f.rank(ctx)
+	observeQuery(f.queryName, start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	f.cached = posts
+	f.cachedAt = now
+	f.cacheExpiresAt = now.Add(1 * time.Minute)
+
+	return posts, nil
+}
+
+func (f *rankedFeed) RefreshCache(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, err := f.refreshPostsLocked(ctx)
+	return err
+}
+
+func (f *rankedFeed) CacheInfo() FeedCacheInfo {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return FeedCacheInfo{
+		CachedAt:  f.cachedAt,
+		ExpiresAt: f.cacheExpiresAt,
+		Size:      len(f.cached),
+	}
+}
+
+// makeRankedQuery ranks the posts in source, which is a table or a subquery with uri, created_at and lang columns
+func makeRankedQuery(source string) string {
+	return fmt.Sprintf(`
+SELECT 
+    count(*) as like_ct,
+    sp.uri,
+    sp.created_at,
+    sp.lang,
+    dateDiff('hour', sp.created_at, now()) as hours_old,
+    count(*) * exp(-0.1 * dateDiff('hour', sp.created_at, now())) as decay_score
+FROM %s sp 
+LEFT JOIN default.like_by_subject i ON sp.uri = i.subject_uri 
+WHERE sp.created_at > now() - INTERVAL 1 DAY 
+GROUP BY sp.uri, sp.created_at, sp.lang 
+ORDER BY decay_score DESC
+LIMIT 5000
+		`, source)
+}
@@ -0,0 +1,259 @@
+package peruse
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/haileyok/peruse/internal/helpers"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is a token bucket budget, refilled at Rate tokens per second up to Burst tokens. A Rate of zero or less
+// disables limiting for the route.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+const (
+	RateLimitFeedSkeleton          = "getFeedSkeleton"
+	RateLimitDescribeFeedGenerator = "describeFeedGenerator"
+	RateLimitWellKnown             = "wellKnown"
+	RateLimitSuggestedFollows      = "getSuggestedFollows"
+	RateLimitSuggestedFollowsPage  = "getSuggestedFollowsPage"
+	RateLimitCloseByParams         = "putCloseByParams"
+	RateLimitTrending              = "trending"
+	RateLimitEntityFeedCreate      = "entityFeedCreate"
+)
+
+func DefaultRateLimits() map[string]RateLimit {
+	return map[string]RateLimit{
+		RateLimitFeedSkeleton:          {Rate: 5, Burst: 20},
+		RateLimitDescribeFeedGenerator: {Rate: 10, Burst: 50},
+		RateLimitWellKnown:             {Rate: 10, Burst: 50},
+		RateLimitSuggestedFollows:      {Rate: 1, Burst: 10},
+		// the page runs the expensive graph queries for arbitrary users without auth, so keep it tight
+		RateLimitSuggestedFollowsPage: {Rate: 0.1, Burst: 3},
+		// changing params refetches the user's close by, which is just as expensive
+		RateLimitCloseByParams: {Rate: 0.1, Burst: 3},
+		RateLimitTrending:      {Rate: 1, Burst: 10},
+		// entity feeds that aren't live yet are ranked on request to see whether they have enough posts, for any entity
+		// the requester names
+		RateLimitEntityFeedCreate: {Rate: 0.05, Burst: 5},
+	}
+}
+
+// ParseRateLimitOverride parses a route budget override in the form `route=rate:burst`, e.g. `getFeedSkeleton=5:20`
+func ParseRateLimitOverride(override string) (string, RateLimit, error) {
+	route, budget, ok := strings.Cut(override, "=")
+	if !ok || route == "" {
+		return "", RateLimit{}, fmt.Errorf("invalid rate limit override %q, expected route=rate:burst", override)
+	}
+	if _, ok := DefaultRateLimits()[route]; !ok {
+		return "", RateLimit{}, fmt.Errorf("unknown route %q in rate limit override %q", route, override)
+	}
+
+	rateStr, burstStr, ok := strings.Cut(budget, ":")
+	if !ok {
+		return "", RateLimit{}, fmt.Errorf("invalid rate limit override %q, expected route=rate:burst", override)
+	}
+
+	r, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil {
+		return "", RateLimit{}, fmt.Errorf("invalid rate in rate limit override %q: %w", override, err)
+	}
+
+	burst, err := strconv.Atoi(burstStr)
+	if err != nil || burst < 1 {
+		return "", RateLimit{}, fmt.Errorf("invalid burst in rate limit override %q", override)
+	}
+
+	return route, RateLimit{Rate: r, Burst: burst}, nil
+}
+
+// newIPExtractor picks how the client ip that anonymous requests are limited by is found. Without trusted proxies the
+// connection's remote address is used as is. Behind proxies, X-Forwarded-For is only believed when it was set by one
+// of them, so that clients can't pick their own key by sending the header.
+func newIPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		opts = append(opts, echo.TrustIPRange(ipNet))
+	}
+
+	return echo.ExtractIPFromXFFHeader(opts...), nil
+}
+
+type rateLimiter struct {
+	mu       sync.Mutex
+	limits   map[string]RateLimit
+	limiters *lru.Cache[string, *rate.Limiter]
+}
+
+func newRateLimiter(overrides map[string]RateLimit) (*rateLimiter, error) {
+	limits := DefaultRateLimits()
+	for route, rl := range overrides {
+		if _, ok := limits[route]; !ok {
+			return nil, fmt.Errorf("rate limit override for unknown route %q", route)
+		}
+		limits[route] = rl
+	}
+
+	// the least recently used limiters are dropped once there are too many. A client that is still busy can only be
+	// evicted, and come back with a full bucket, when more distinct clients than this are seen between its requests.
+	limiters, err := lru.New[string, *rate.Limiter](100_000)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rateLimiter{
+		limits:   limits,
+		limiters: limiters,
+	}, nil
+}
+
+func (rl *rateLimiter) limiterFor(route, key string, limit RateLimit) *rate.Limiter {
+	k := route + "::" + key
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if l, ok := rl.limiters.Get(k); ok {
+		return l
+	}
+
+	l := rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)
+	rl.limiters.Add(k, l)
+	return l
+}
+
+// rateLimitRouteKey is where rateLimitMiddleware leaves the route for authenticate, for requests that carry a token
+const rateLimitRouteKey = "rateLimitRoute"
+
+// rateLimitMiddleware limits requests to the given route. It goes before any auth middleware on the route, so that
+// requests are limited before any work is done to verify them.
+//
+// Anonymous requests are limited by client ip. Requests with a token are limited by the authenticated user's did
+// instead, since the appview forwards every user's requests from the same few addresses, so authenticate applies the
+// limit once the token is verified. Tokens that fail to verify are charged to a separate budget for the client ip,
+// which only decides whether further failures get a 401 or a 429, so that a client sending bad tokens through the
+// appview can't get the valid requests sharing its address limited.
+func (s *Server) rateLimitMiddleware(route string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(e echo.Context) error {
+			limit, ok := s.rateLimiter.limits[route]
+			if !ok || limit.Rate <= 0 {
+				return next(e)
+			}
+
+			if e.Request().Header.Get("authorization") == "" {
+				return s.applyRateLimit(e, route, clientIPKey(e), next)
+			}
+
+			e.Set(rateLimitRouteKey, route)
+			return next(e)
+		}
+	}
+}
+
+// clientIPKey is the key anonymous requests are limited by. IPv6 clients are limited by their /64, since a client is
+// usually given a whole /64 and can pick any address in it.
+func clientIPKey(e echo.Context) string {
+	ip := net.ParseIP(e.RealIP())
+	if ip == nil || ip.To4() != nil {
+		return "ip:" + e.RealIP()
+	}
+	return "ip:" + ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// rateLimitAuthenticated applies the route's limit to a request whose token was just verified
+func (s *Server) rateLimitAuthenticated(e echo.Context, did string, next echo.HandlerFunc) error {
+	route, ok := e.Get(rateLimitRouteKey).(string)
+	if !ok {
+		return next(e)
+	}
+	return s.applyRateLimit(e, route, "did:"+did, next)
+}
+
+// rejectAuth responds to a request whose token failed to verify. The failure is charged to the client ip's failure
+// budget, and clients that have run out are told to back off instead of being told their token is bad.
+func (s *Server) rejectAuth(e echo.Context, message string) error {
+	if route, ok := e.Get(rateLimitRouteKey).(string); ok {
+		limit := s.rateLimiter.limits[route]
+		l := s.rateLimiter.limiterFor(route, "authfail:"+clientIPKey(e), limit)
+		if !l.Allow() {
+			return s.rateLimitExceeded(e, l, limit)
+		}
+	}
+	return helpers.UnauthorizedError(e, "AuthRequired", message)
+}
+
+// rateLimitKey is what a request is limited by once any auth has run: the authenticated user's did, or the client ip
+// for anonymous requests
+func rateLimitKey(e echo.Context) string {
+	if u := userFromContext(e); u != nil {
+		return "did:" + u.did
+	}
+	return clientIPKey(e)
+}
+
+func (s *Server) applyRateLimit(e echo.Context, route, key string, next echo.HandlerFunc) error {
+	limit := s.rateLimiter.limits[route]
+	if limit.Rate <= 0 {
+		return next(e)
+	}
+
+	l := s.rateLimiter.limiterFor(route, key, limit)
+	if !l.Allow() {
+		return s.rateLimitExceeded(e, l, limit)
+	}
+
+	setRateLimitHeaders(e, l, limit)
+	return next(e)
+}
+
+func (s *Server) rateLimitExceeded(e echo.Context, l *rate.Limiter, limit RateLimit) error {
+	tokens := setRateLimitHeaders(e, l, limit)
+	e.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil((1-tokens)/limit.Rate))))
+	return helpers.RateLimitError(e, "RateLimitExceeded", "")
+}
+
+func setRateLimitHeaders(e echo.Context, l *rate.Limiter, limit RateLimit) float64 {
+	tokens := math.Max(l.Tokens(), 0)
+	reset := 0
+	if tokens < float64(limit.Burst) {
+		reset = int(math.Ceil((float64(limit.Burst) - tokens) / limit.Rate))
+	}
+
+	h := e.Response().Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(int(math.Floor(tokens))))
+	h.Set("RateLimit-Reset", strconv.Itoa(reset))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Burst, int(math.Ceil(float64(limit.Burst)/limit.Rate))))
+
+	return tokens
+}
@@ -0,0 +1,137 @@
+package peruse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func newTestRateLimitServer(t *testing.T, limit RateLimit) (*Server, string) {
+	t.Helper()
+
+	signers := newTestSigners(t)
+	s := newTestAuthServer(t, signers[0].key, false)
+
+	rl, err := newRateLimiter(map[string]RateLimit{RateLimitSuggestedFollows: limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.rateLimiter = rl
+	s.userManager = NewUserManager()
+
+	s.echo = echo.New()
+	s.echo.IPExtractor = echo.ExtractIPDirect()
+	s.echo.GET("/xrpc/"+testLxm, func(e echo.Context) error {
+		return e.NoContent(http.StatusOK)
+	}, s.rateLimitMiddleware(RateLimitSuggestedFollows), s.handleAuthMiddleware)
+
+	return s, signers[0].sign(t, validClaims())
+}
+
+func doRateLimitRequest(s *Server, remoteAddr, token string) int {
+	req := httptest.NewRequest(http.MethodGet, "/xrpc/"+testLxm, nil)
+	req.RemoteAddr = remoteAddr
+	if token != "" {
+		req.Header.Set("authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.echo.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestRateLimitFailedAuthByIp(t *testing.T) {
+	s, tok := newTestRateLimitServer(t, RateLimit{Rate: 0.001, Burst: 2})
+	dir := s.directory.(*countingDirectory)
+
+	// bad tokens use up the ip's failure budget, after which they are told to back off
+	codes := []int{}
+	for range 4 {
+		codes = append(codes, doRateLimitRequest(s, "192.0.2.1:1234", "not.a.jwt"))
+	}
+	want := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests, http.StatusTooManyRequests}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, codes)
+		}
+	}
+
+	// a valid token from the same address, as when both come through the appview, is limited by its did only
+	if code := doRateLimitRequest(s, "192.0.2.1:1234", tok); code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, code)
+	}
+	if dir.lookups != 1 {
+		t.Fatalf("expected only the valid token to look up a key, got %d lookups", dir.lookups)
+	}
+}
+
+func TestRateLimitAuthenticatedByDid(t *testing.T) {
+	s, tok := newTestRateLimitServer(t, RateLimit{Rate: 0.001, Burst: 2})
+
+	// the same did is limited across addresses, since the appview forwards requests for many users
+	for i, addr := range []string{"192.0.2.1:1234", "192.0.2.2:1234", "192.0.2.3:1234"} {
+		want := http.StatusOK
+		if i == 2 {
+			want = http.StatusTooManyRequests
+		}
+		if code := doRateLimitRequest(s, addr, tok); code != want {
+			t.Fatalf("request %d: expected %d, got %d", i, want, code)
+		}
+	}
+}
+
+func TestClientIPKeyIPv6By64(t *testing.T) {
+	e := echo.New()
+	e.IPExtractor = echo.ExtractIPDirect()
+	key := func(addr string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = addr
+		return clientIPKey(e.NewContext(req, httptest.NewRecorder()))
+	}
+
+	// rotating through addresses in the same /64 doesn't get a fresh budget
+	if a, b := key("[2001:db8::1]:1234"), key("[2001:db8::ffff:3]:1234"); a != b {
+		t.Fatalf("expected addresses in one /64 to share a key, got %s and %s", a, b)
+	}
+	if a, b := key("[2001:db8::1]:1234"), key("[2001:db8:0:1::1]:1234"); a == b {
+		t.Fatalf("expected addresses in different /64s to have their own keys, got %s", a)
+	}
+	if k := key("192.0.2.1:1234"); k != "ip:192.0.2.1" {
+		t.Fatalf("expected ipv4 addresses to be keyed as is, got %s", k)
+	}
+}
+
+func TestRateLimitOverrideUnknownRoute(t *testing.T) {
+	if _, _, err := ParseRateLimitOverride("getFeedSkeletn=5:20"); err == nil {
+		t.Fatal("expected an override for an unknown route to be rejected")
+	}
+	if _, err := newRateLimiter(map[string]RateLimit{"getFeedSkeletn": {Rate: 5, Burst: 20}}); err == nil {
+		t.Fatal("expected an override for an unknown route to be rejected")
+	}
+}
+
+func TestIPExtractorTrustedProxies(t *testing.T) {
+	extract, err := newIPExtractor([]string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(echo.HeaderXForwardedFor, "198.51.100.7")
+
+	req.RemoteAddr = "10.0.0.1:1234"
+	if ip := extract(req); ip != "198.51.100.7" {
+		t.Fatalf("expected the forwarded ip behind a trusted proxy, got %s", ip)
+	}
+
+	// other private addresses aren't trusted just for being private
+	req.RemoteAddr = "10.0.0.2:1234"
+	if ip := extract(req); ip != "10.0.0.2" {
+		t.Fatalf("expected the remote address for an untrusted proxy, got %s", ip)
+	}
+
+	if _, err := newIPExtractor([]string{"not-an-ip"}); err == nil {
+		t.Fatal("expected an invalid trusted proxy to be rejected")
+	}
+}
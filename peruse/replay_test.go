@@ -0,0 +1,261 @@
+package peruse
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"io"
+	"log/slog"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	atcrypto "github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/repo"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+var updateFixtures = flag.Bool("update", false, "regenerate the fixtures in testdata")
+
+const (
+	replayFixture    = "testdata/firehose.zst"
+	replayNerFixture = "testdata/ner_responses.json"
+
+	fixtureDid = "did:plc:fixtureauthor00000000"
+)
+
+// fixtureRkey gives each fixture record a fixed rkey, so that the uris the test expects don't change when the fixture
+// is regenerated
+func fixtureRkey(i int) string {
+	return syntax.NewTID(time.Date(2025, 7, 1, 12, 0, i, 0, time.UTC).UnixMicro(), 0).String()
+}
+
+func fixtureUri(collection string, i int) string {
+	return uriFromParts(fixtureDid, collection, fixtureRkey(i))
+}
+
+// the records in the fixture, one per commit. The ner fixture has a response for the seattle post's text only.
+func fixtureRecords() []struct {
+	collection string
+	rec        repo.CborMarshaler
+} {
+	createdAt := "2025-07-01T12:00:00.000Z"
+	return []struct {
+		collection string
+		rec        repo.CborMarshaler
+	}{
+		// matches the seattle feed through the recorded ner response
+		{"app.bsky.feed.post", &bsky.FeedPost{Text: "Spent the afternoon wandering around Seattle", CreatedAt: createdAt}},
+		// matches the golang rule feed by tag, and has no entities
+		{"app.bsky.feed.post", &bsky.FeedPost{Text: "Shipping a new release of our compiler today", Tags: []string{"golang"}, CreatedAt: createdAt}},
+		// matches nothing
+		{"app.bsky.feed.post", &bsky.FeedPost{Text: "Nothing much going on today", CreatedAt: createdAt}},
+		// replies aren't sent to ner or taken by the feeds by default
+		{"app.bsky.feed.post", &bsky.FeedPost{Text: "Spent the afternoon wandering around Seattle", CreatedAt: createdAt, Reply: &bsky.FeedPost_ReplyRef{
+			Root:   &atproto.RepoStrongRef{Uri: fixtureUri("app.bsky.feed.post", 0)},
+			Parent: &atproto.RepoStrongRef{Uri: fixtureUri("app.bsky.feed.post", 0)},
+		}}},
+		{"app.bsky.feed.like", &bsky.FeedLike{Subject: &atproto.RepoStrongRef{Uri: fixtureUri("app.bsky.feed.post", 0)}, CreatedAt: createdAt}},
+	}
+}
+
+// recordingBlockstore keeps every block written to the repo, so that each commit can carry the whole repo
+type recordingBlockstore struct {
+	blocks map[cid.Cid]blocks.Block
+}
+
+func (bs *recordingBlockstore) Put(ctx context.Context, b blocks.Block) error {
+	bs.blocks[b.Cid()] = b
+	return nil
+}
+
+func (bs *recordingBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	b, ok := bs.blocks[c]
+	if !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+// car writes a CARv1 of every block with root as its only root
+func (bs *recordingBlockstore) car(root cid.Cid) []byte {
+	var buf bytes.Buffer
+	writeLd := func(parts ...[]byte) {
+		var n int
+		for _, p := range parts {
+			n += len(p)
+		}
+		var lenBuf [binary.MaxVarintLen64]byte
+		buf.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(n))])
+		for _, p := range parts {
+			buf.Write(p)
+		}
+	}
+
+	// the header is the dag-cbor map {"roots": [root], "version": 1}, with the root as a tag 42 link
+	rootBytes := append([]byte{0x00}, root.Bytes()...)
+	hdr := []byte{0xa2, 0x65}
+	hdr = append(hdr, "roots"...)
+	hdr = append(hdr, 0x81, 0xd8, 0x2a, 0x58, byte(len(rootBytes)))
+	hdr = append(hdr, rootBytes...)
+	hdr = append(hdr, 0x67)
+	hdr = append(hdr, "version"...)
+	hdr = append(hdr, 0x01)
+	writeLd(hdr)
+
+	keys := make([]cid.Cid, 0, len(bs.blocks))
+	for c := range bs.blocks {
+		keys = append(keys, c)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].KeyString() < keys[j].KeyString() })
+	for _, c := range keys {
+		writeLd(c.Bytes(), bs.blocks[c].RawData())
+	}
+
+	return buf.Bytes()
+}
+
+func writeReplayFixture(t *testing.T) {
+	t.Helper()
+	ctx := context.Background()
+
+	key, err := atcrypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := func(ctx context.Context, did string, b []byte) ([]byte, error) {
+		return key.HashAndSign(b)
+	}
+
+	rec, err := NewFirehoseRecorder(replayFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs := &recordingBlockstore{blocks: map[cid.Cid]blocks.Block{}}
+	r := repo.NewRepo(ctx, fixtureDid, bs)
+	for i, fr := range fixtureRecords() {
+		path := fr.collection + "/" + fixtureRkey(i)
+		rc, err := r.PutRecord(ctx, path, fr.rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, rev, err := r.Commit(ctx, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		link := lexutil.LexLink(rc)
+		if err := rec.Write(&atproto.SyncSubscribeRepos_Commit{
+			Repo:   fixtureDid,
+			Rev:    rev,
+			Seq:    int64(i + 1),
+			Time:   time.Date(2025, 7, 1, 12, 0, i, 0, time.UTC).Format(time.RFC3339),
+			Commit: lexutil.LexLink(root),
+			Blocks: bs.car(root),
+			Ops:    []*atproto.SyncSubscribeRepos_RepoOp{{Action: "create", Path: path, Cid: &link}},
+			Blobs:  []lexutil.LexLink{},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func feedRows(ms *MemoryStore, table string) []string {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var uris []string
+	for uri := range ms.feedPosts[table] {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+	return uris
+}
+
+func TestReplayFixture(t *testing.T) {
+	if *updateFixtures {
+		writeReplayFixture(t)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := NewServer(ServerArgs{
+		Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+		StoreBackend:     StoreBackendMemory,
+		TrendingBackend:  TrendingBackendMemory,
+		ReplayFile:       replayFixture,
+		NerResponsesFile: replayNerFixture,
+		RuleFeeds:        []RuleFeedConfig{{Name: "golang", Table: "golang_post", Hashtags: []string{"golang"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.replayFirehose(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ms := s.store.(*MemoryStore)
+	seattlePost := fixtureUri("app.bsky.feed.post", 0)
+	golangPost := fixtureUri("app.bsky.feed.post", 1)
+
+	want := map[string][]string{
+		"seattle_post": {seattlePost},
+		"golang_post":  {golangPost},
+	}
+	for _, cfg := range WikidataFeeds {
+		if _, ok := want[cfg.Table]; !ok {
+			want[cfg.Table] = nil
+		}
+	}
+	for table, uris := range want {
+		if got := feedRows(ms, table); !equalStrings(got, uris) {
+			t.Errorf("%s: expected %v, got %v", table, uris, got)
+		}
+	}
+
+	entityPosts, err := ms.RankedEntityPosts(ctx, "Q5083")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mu.RLock()
+	_, seattleEntityPost := ms.entityPosts["Q5083"][seattlePost]
+	ms.mu.RUnlock()
+	if !seattleEntityPost {
+		t.Errorf("expected the seattle post to be recorded for its entity, got %v", entityPosts)
+	}
+
+	if likes, _ := ms.LikeCount(ctx, seattlePost); likes != 1 {
+		t.Errorf("expected 1 like on the seattle post, got %d", likes)
+	}
+
+	if s.cursor != "5" {
+		t.Errorf("expected the cursor to end at the last commit, got %q", s.cursor)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
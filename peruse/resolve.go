@@ -0,0 +1,39 @@
+package peruse
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+const (
+	DefaultPlcUrl       = "https://plc.directory"
+	DefaultPlcRateLimit = 10
+)
+
+// resolveIdentity takes either a handle or a did of any supported method and resolves it through the server's
+// directory. When given a handle, the returned identity is guaranteed to declare that same handle, so the handle and
+// did agree in both directions.
+func (s *Server) resolveIdentity(ctx context.Context, handleOrDid string) (*identity.Identity, error) {
+	atid, err := syntax.ParseAtIdentifier(strings.TrimPrefix(strings.TrimSpace(handleOrDid), "@"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid handle or did: %w", err)
+	}
+
+	ident, err := s.directory.Lookup(ctx, *atid)
+	if err != nil {
+		return nil, err
+	}
+
+	if atid.IsHandle() {
+		h, _ := atid.AsHandle()
+		if ident.Handle.Normalize() != h.Normalize() {
+			return nil, fmt.Errorf("handle %q does not match did %q: %w", h, ident.DID, identity.ErrHandleMismatch)
+		}
+	}
+
+	return ident, nil
+}
@@ -0,0 +1,114 @@
+package peruse
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/haileyok/photocopy/models"
+)
+
+const (
+	StoreBackendClickhouse = "clickhouse"
+	StoreBackendMemory     = "memory"
+)
+
+// Store is everything peruse reads and writes. The clickhouse store reads posts, likes, interactions and follows from
+// the tables photocopy fills, so the Record methods do nothing there. The memory store has no photocopy to rely on, so
+// it keeps its own copies of them from the firehose.
+type Store interface {
+	// Init creates anything the store needs and should be called before the store is used
+	Init(ctx context.Context) error
+	Close() error
+
+	RecordPost(ctx context.Context, post StoredPost) error
+	RecordInteraction(ctx context.Context, i Interaction) error
+	RecordFollow(ctx context.Context, f Follow) error
+
+	// PostsChronological returns the top level posts, and optionally the reposts, by dids with rkeys before cursor,
+	// newest first
+	PostsChronological(ctx context.Context, dids []string, cursor string, includeReposts bool) ([]ChronoPost, error)
+	// PostsInRange returns the top level posts by dids created after since and up to until, newest first
+	PostsInRange(ctx context.Context, dids []string, since, until time.Time) ([]models.Post, error)
+	LikeCount(ctx context.Context, uri string) (uint64, error)
+	// CloseBy returns the accounts closest to did, best first. did itself is never included.
+	CloseBy(ctx context.Context, did string, params CloseByParams) ([]CloseBy, error)
+	SuggestedFollows(ctx context.Context, did string, showHandles bool) ([]SuggestedFollow, error)
+
+	// InitFeedTable prepares a topic feed's table
+	InitFeedTable(ctx context.Context, table string) error
+	// InsertFeedPost may queue the post rather than write it straight away
+	InsertFeedPost(ctx context.Context, table string, item FeedDatabaseItem) error
+	// FlushFeedPosts writes every queued feed post before returning
+	FlushFeedPosts(ctx context.Context) error
+	// RankedFeedPosts ranks the last day of a feed table's posts by likes with a time decay
+	RankedFeedPosts(ctx context.Context, table string) ([]RankedFeedPost, error)
+	InsertEntityPost(ctx context.Context, row EntityPostRow) error
+	RankedEntityPosts(ctx context.Context, entityId string) ([]RankedFeedPost, error)
+
+	// ModerationEntries returns the latest entry for each subject and feed, leaving out unbans
+	ModerationEntries(ctx context.Context) ([]ModerationEntry, error)
+	WriteModerationEntry(ctx context.Context, entry ModerationEntry) error
+
+	// Labels returns the latest label from src for each subject and value
+	Labels(ctx context.Context, src string) ([]LabelRow, error)
+	WriteLabels(ctx context.Context, rows []LabelRow) error
+
+	// EntityAliases returns the latest alias for each name, leaving out deleted ones
+	EntityAliases(ctx context.Context) ([]EntityAlias, error)
+	WriteEntityAlias(ctx context.Context, alias EntityAlias) error
+
+	// UserCloseByParams returns the latest params for each user who has set their own, leaving out resets
+	// UserCloseByParams returns the did's own close by params, or nil if they haven't set any
+	UserCloseByParams(ctx context.Context, did string) (*UserCloseByParams, error)
+	WriteUserCloseByParams(ctx context.Context, row UserCloseByParams) error
+}
+
+// StoredPost is the part of a post that the chronological and close by feeds need
+type StoredPost struct {
+	Uri       string
+	Did       string
+	Rkey      string
+	ParentUri string
+	CreatedAt time.Time
+}
+
+const (
+	InteractionKindLike   = "like"
+	InteractionKindRepost = "repost"
+)
+
+// Interaction is a like or repost of a post, as it appears in photocopy's interaction table
+type Interaction struct {
+	Uri        string
+	Did        string
+	Rkey       string
+	Kind       string
+	SubjectUri string
+	SubjectDid string
+	CreatedAt  time.Time
+}
+
+type Follow struct {
+	Did       string
+	Subject   string
+	CreatedAt time.Time
+}
+
+func newStore(args *ServerArgs) (Store, error) {
+	switch args.StoreBackend {
+	case "", StoreBackendClickhouse:
+		if args.ClickhouseAddr == "" {
+			return nil, fmt.Errorf("a clickhouse address is required for the clickhouse store")
+		}
+		conn, err := openClickhouse(args)
+		if err != nil {
+			return nil, err
+		}
+		return NewClickhouseStore(conn, args.Logger, args.FeedInsert), nil
+	case StoreBackendMemory:
+		return NewMemoryStore(args.MemoryStoreRetention, args.MemoryStoreMaxRecords), nil
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", args.StoreBackend)
+	}
+}
@@ -0,0 +1,362 @@
+package peruse
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/haileyok/photocopy/clickhouse_inserter"
+	"github.com/haileyok/photocopy/models"
+)
+
+// ClickhouseStore reads photocopy's tables and keeps peruse's own tables in the same database
+type ClickhouseStore struct {
+	conn     driver.Conn
+	logger   *slog.Logger
+	migrator *Migrator
+
+	entityPostInserter *clickhouse_inserter.Inserter
+
+	feedInsertConfig FeedInsertConfig
+	feedInserter     *feedInserter
+
+	mu         sync.RWMutex
+	feedTables map[string]struct{}
+}
+
+func NewClickhouseStore(conn driver.Conn, logger *slog.Logger, feedInsertConfig FeedInsertConfig) *ClickhouseStore {
+	return &ClickhouseStore{
+		conn:             conn,
+		logger:           logger.With("component", "store"),
+		migrator:         NewMigrator(conn, logger),
+		feedInsertConfig: feedInsertConfig,
+		feedTables:       map[string]struct{}{},
+	}
+}
+
+func openClickhouse(args *ServerArgs) (driver.Conn, error) {
+	return clickhouse.Open(&clickhouse.Options{
+		Addr: []string{args.ClickhouseAddr},
+		Auth: clickhouse.Auth{
+			Database: args.ClickhouseDatabase,
+			Username: args.ClickhouseUser,
+			Password: args.ClickhousePass,
+		},
+	})
+}
+
+// Conn returns the store's connection, for the parts of peruse that only run against clickhouse
+func (cs *ClickhouseStore) Conn() driver.Conn {
+	return cs.conn
+}
+
+// Init applies any pending migrations, so that instances can be upgraded without running peruse migrate first
+func (cs *ClickhouseStore) Init(ctx context.Context) error {
+	if _, err := cs.migrator.Apply(ctx, "", Migrations); err != nil {
+		return err
+	}
+
+	inserter, err := clickhouse_inserter.New(ctx, &clickhouse_inserter.Args{
+		PrometheusCounterPrefix: "peruse_entity_post",
+		BatchSize:               100,
+		Logger:                  cs.logger,
+		Conn:                    cs.conn,
+		Query:                   "INSERT INTO peruse_entity_post (entity_id, uri, created_at, lang)",
+		RateLimit:               3,
+		Histogram:               clickhouseInsertDuration,
+	})
+	if err != nil {
+		return err
+	}
+	cs.entityPostInserter = inserter
+	cs.feedInserter = newFeedInserter(cs.conn, cs.logger, cs.feedInsertConfig)
+
+	return nil
+}
+
+// Close writes any queued rows before closing the connection. The caller's context is usually cancelled by the time
+// the store is closed, so the final writes get their own deadline.
+func (cs *ClickhouseStore) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if cs.feedInserter != nil {
+		cs.feedInserter.Close(ctx)
+	}
+	if cs.entityPostInserter != nil {
+		cs.entityPostInserter.Close(ctx)
+	}
+
+	return cs.conn.Close()
+}
+
+// photocopy writes posts, interactions and follows to clickhouse itself
+func (cs *ClickhouseStore) RecordPost(ctx context.Context, post StoredPost) error {
+	return nil
+}
+
+func (cs *ClickhouseStore) RecordInteraction(ctx context.Context, i Interaction) error {
+	return nil
+}
+
+func (cs *ClickhouseStore) RecordFollow(ctx context.Context, f Follow) error {
+	return nil
+}
+
+func (cs *ClickhouseStore) PostsChronological(ctx context.Context, dids []string, cursor string, includeReposts bool) ([]ChronoPost, error) {
+	var posts []ChronoPost
+	if !includeReposts {
+		if err := cs.conn.Select(ctx, &posts, `
+		SELECT uri, did, rkey, '' as repost_uri
+		FROM default.post
+		WHERE rkey < ?
+		AND did IN (?)
+		AND parent_uri = ''
+		ORDER BY created_at DESC
+		LIMIT 50
+		`, cursor, dids); err != nil {
+			return nil, err
+		}
+		return posts, nil
+	}
+
+	if err := cs.conn.Select(ctx, &posts, `
+		SELECT uri, did, rkey, repost_uri
+		FROM (
+			SELECT uri, did, rkey, '' as repost_uri, created_at
+			FROM default.post
+			WHERE rkey < ?
+			AND did IN (?)
+			AND parent_uri = ''
+			UNION ALL
+			SELECT subject_uri as uri, did, rkey, uri as repost_uri, created_at
+			FROM interaction
+			WHERE rkey < ?
+			AND did IN (?)
+			AND kind = 'repost'
+		)
+		ORDER BY created_at DESC
+		LIMIT 50
+		`, cursor, dids, cursor, dids); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+func (cs *ClickhouseStore) PostsInRange(ctx context.Context, dids []string, since, until time.Time) ([]models.Post, error) {
+	var posts []models.Post
+	if err := cs.conn.Select(ctx, &posts, `
+		SELECT uri, did, created_at
+		FROM default.post
+		WHERE created_at > ?
+		AND created_at <= ?
+		AND did IN (?)
+		AND parent_uri = ''
+		ORDER BY created_at DESC
+		LIMIT 2000
+		`, since, until, dids); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// HistoricalPosts returns up to limit top level posts created before until, oldest first, continuing from the post
+// at after. Posts are ordered by created_at and then uri so that paging is stable when posts share a timestamp.
+func (cs *ClickhouseStore) HistoricalPosts(ctx context.Context, after BackfillCursor, until time.Time, limit int) ([]models.Post, error) {
+	var posts []models.Post
+	if err := cs.conn.Select(ctx, &posts, `
+		SELECT uri, did, rkey, created_at, quote_uri, lang, text
+		FROM default.post
+		WHERE (created_at, uri) > (?, ?)
+		AND created_at < ?
+		AND parent_uri = ''
+		ORDER BY created_at ASC, uri ASC
+		LIMIT ?
+		`, after.CreatedAt, after.Uri, until, limit); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// EarliestFeedPost returns the created_at of the oldest post in a feed's table, and false when the table is empty
+func (cs *ClickhouseStore) EarliestFeedPost(ctx context.Context, table string) (time.Time, bool, error) {
+	if !tableNameRegex.MatchString(table) {
+		return time.Time{}, false, fmt.Errorf("invalid feed table name %q", table)
+	}
+
+	var count uint64
+	var earliest time.Time
+	if err := cs.conn.QueryRow(ctx, fmt.Sprintf("SELECT count(*), min(created_at) FROM %s", table)).Scan(&count, &earliest); err != nil {
+		return time.Time{}, false, err
+	}
+	return earliest, count > 0, nil
+}
+
+func (cs *ClickhouseStore) LikeCount(ctx context.Context, uri string) (uint64, error) {
+	var count uint64
+	if err := cs.conn.QueryRow(ctx, "SELECT count(*) FROM default.like_by_subject WHERE subject_uri = ?", uri).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (cs *ClickhouseStore) CloseBy(ctx context.Context, did string, params CloseByParams) ([]CloseBy, error) {
+	var closeBy []CloseBy
+	if err := cs.conn.Select(ctx, &closeBy, getCloseByQuery, did, int64(params.Timeframe.Seconds()), params.ExistingConnectionWeight, params.NewDiscoveryWeight, params.TopMutualLimit); err != nil {
+		return nil, err
+	}
+	return closeBy, nil
+}
+
+func (cs *ClickhouseStore) SuggestedFollows(ctx context.Context, did string, showHandles bool) ([]SuggestedFollow, error) {
+	query := getSuggestedFollowsQuery
+	if showHandles {
+		query = getSuggestedFollowsQueryWithHandle
+	}
+
+	var suggestedFollows []SuggestedFollow
+	if err := cs.conn.Select(ctx, &suggestedFollows, query, did); err != nil {
+		return nil, err
+	}
+	return suggestedFollows, nil
+}
+
+// InitFeedTable creates the table, or brings it up to date, the first time a feed using it is registered
+func (cs *ClickhouseStore) InitFeedTable(ctx context.Context, table string) error {
+	migrations, err := FeedTableMigrations(table)
+	if err != nil {
+		return err
+	}
+	if _, err := cs.migrator.Apply(ctx, table, migrations); err != nil {
+		return err
+	}
+
+	cs.mu.Lock()
+	cs.feedTables[table] = struct{}{}
+	cs.mu.Unlock()
+
+	return nil
+}
+
+func (cs *ClickhouseStore) InsertFeedPost(ctx context.Context, table string, item FeedDatabaseItem) error {
+	cs.mu.RLock()
+	_, ok := cs.feedTables[table]
+	cs.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("feed table %s was not initialized", table)
+	}
+	return cs.feedInserter.Insert(table, item)
+}
+
+func (cs *ClickhouseStore) FlushFeedPosts(ctx context.Context) error {
+	return cs.feedInserter.Flush(ctx)
+}
+
+func (cs *ClickhouseStore) RankedFeedPosts(ctx context.Context, table string) ([]RankedFeedPost, error) {
+	var posts []RankedFeedPost
+	if err := cs.conn.Select(ctx, &posts, makeRankedQuery(table)); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+func (cs *ClickhouseStore) InsertEntityPost(ctx context.Context, row EntityPostRow) error {
+	return cs.entityPostInserter.Insert(ctx, row)
+}
+
+func (cs *ClickhouseStore) RankedEntityPosts(ctx context.Context, entityId string) ([]RankedFeedPost, error) {
+	var posts []RankedFeedPost
+	if err := cs.conn.Select(ctx, &posts, makeRankedQuery("(SELECT uri, created_at, lang FROM peruse_entity_post WHERE entity_id = ?)"), entityId); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+func (cs *ClickhouseStore) ModerationEntries(ctx context.Context) ([]ModerationEntry, error) {
+	var rows []ModerationEntry
+	if err := cs.conn.Select(ctx, &rows, `
+		SELECT subject, feed, reason, created_at, deleted
+		FROM peruse_moderation FINAL
+		WHERE deleted = 0
+		`); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (cs *ClickhouseStore) WriteModerationEntry(ctx context.Context, entry ModerationEntry) error {
+	return cs.insertRows(ctx, "INSERT INTO peruse_moderation (subject, feed, reason, created_at, deleted)", &entry)
+}
+
+func (cs *ClickhouseStore) Labels(ctx context.Context, src string) ([]LabelRow, error) {
+	var rows []LabelRow
+	if err := cs.conn.Select(ctx, &rows, `
+		SELECT src, uri, val, neg, cts, exp, seq
+		FROM peruse_label FINAL
+		WHERE src = ?
+		`, src); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (cs *ClickhouseStore) WriteLabels(ctx context.Context, rows []LabelRow) error {
+	ptrs := make([]any, len(rows))
+	for i := range rows {
+		ptrs[i] = &rows[i]
+	}
+	return cs.insertRows(ctx, "INSERT INTO peruse_label (src, uri, val, neg, cts, exp, seq)", ptrs...)
+}
+
+func (cs *ClickhouseStore) EntityAliases(ctx context.Context) ([]EntityAlias, error) {
+	var rows []EntityAlias
+	if err := cs.conn.Select(ctx, &rows, `
+		SELECT alias, entity_id, created_at, deleted
+		FROM peruse_entity_alias FINAL
+		WHERE deleted = 0
+		`); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (cs *ClickhouseStore) WriteEntityAlias(ctx context.Context, alias EntityAlias) error {
+	return cs.insertRows(ctx, "INSERT INTO peruse_entity_alias (alias, entity_id, created_at, deleted)", &alias)
+}
+
+func (cs *ClickhouseStore) UserCloseByParams(ctx context.Context, did string) (*UserCloseByParams, error) {
+	var rows []UserCloseByParams
+	if err := cs.conn.Select(ctx, &rows, `
+		SELECT did, existing_connection_weight, new_discovery_weight, top_mutual_limit, timeframe_seconds, updated_at, deleted
+		FROM peruse_close_by_params FINAL
+		WHERE did = ? AND deleted = 0
+		`, did); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return &rows[0], nil
+}
+
+func (cs *ClickhouseStore) WriteUserCloseByParams(ctx context.Context, row UserCloseByParams) error {
+	return cs.insertRows(ctx, "INSERT INTO peruse_close_by_params (did, existing_connection_weight, new_discovery_weight, top_mutual_limit, timeframe_seconds, updated_at, deleted)", &row)
+}
+
+// insertRows writes rows in a single batch, for the small tables that are written to by operators rather than ingest
+func (cs *ClickhouseStore) insertRows(ctx context.Context, query string, rows ...any) error {
+	batch, err := cs.conn.PrepareBatch(ctx, query)
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if err := batch.AppendStruct(r); err != nil {
+			return err
+		}
+	}
+	return batch.Send()
+}
@@ -0,0 +1,789 @@
+package peruse
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/haileyok/photocopy/models"
+)
+
+const (
+	DefaultMemoryStoreRetention  = 48 * time.Hour
+	DefaultMemoryStoreMaxRecords = 5_000_000
+
+	// memoryStorePruneBatch is how many accounts, entities or feed tables are pruned each time the write lock is
+	// taken, so that pruning doesn't hold up the firehose
+	memoryStorePruneBatch = 1000
+)
+
+type labelKey struct {
+	src, uri, val string
+}
+
+type moderationKey struct {
+	subject, feed string
+}
+
+// errMemoryStoreFull is returned for writes that can't be dropped quietly, like moderation entries, once the memory
+// store is full
+var errMemoryStoreFull = errors.New("memory store is full")
+
+// MemoryStore keeps everything in memory, for tests and for small instances that run without clickhouse. Posts,
+// interactions, follows and feed posts older than the retention are dropped, so the close by and suggested follows
+// lookbacks are capped by it. Expired labels are dropped too, and negated labels and deleted moderation entries,
+// aliases and close by params are kept only for the retention, so that an older write arriving late can't undo them.
+// Once maxRecords rows are kept, new ones are dropped until pruning makes room. Only creates come off the firehose,
+// so deleted likes and follows are never removed.
+type MemoryStore struct {
+	retention  time.Duration
+	maxRecords int
+
+	mu                    sync.RWMutex
+	records               int // rows kept, across every map but the indexes
+	postsByDid            map[string][]StoredPost
+	interactionsByDid     map[string][]Interaction
+	interactionsBySubject map[string][]Interaction // subject did -> interactions
+	likesByUri            map[string]uint64
+	follows               map[string]map[string]time.Time        // did -> subject -> created at
+	feedPosts             map[string]map[string]FeedDatabaseItem // table -> uri -> item
+	entityPosts           map[string]map[string]FeedDatabaseItem // entity id -> uri -> item
+	moderation            map[moderationKey]ModerationEntry
+	labels                map[labelKey]LabelRow
+	aliases               map[string]EntityAlias
+	closeByParams         map[string]UserCloseByParams
+}
+
+func NewMemoryStore(retention time.Duration, maxRecords int) *MemoryStore {
+	if retention <= 0 {
+		retention = DefaultMemoryStoreRetention
+	}
+	if maxRecords <= 0 {
+		maxRecords = DefaultMemoryStoreMaxRecords
+	}
+
+	return &MemoryStore{
+		retention:             retention,
+		maxRecords:            maxRecords,
+		postsByDid:            map[string][]StoredPost{},
+		interactionsByDid:     map[string][]Interaction{},
+		interactionsBySubject: map[string][]Interaction{},
+		likesByUri:            map[string]uint64{},
+		follows:               map[string]map[string]time.Time{},
+		feedPosts:             map[string]map[string]FeedDatabaseItem{},
+		entityPosts:           map[string]map[string]FeedDatabaseItem{},
+		moderation:            map[moderationKey]ModerationEntry{},
+		labels:                map[labelKey]LabelRow{},
+		aliases:               map[string]EntityAlias{},
+		closeByParams:         map[string]UserCloseByParams{},
+	}
+}
+
+// Init starts pruning data older than the retention, until ctx is done
+func (ms *MemoryStore) Init(ctx context.Context) error {
+	go func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ms.prune(time.Now().Add(-ms.retention))
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (ms *MemoryStore) Close() error {
+	return nil
+}
+
+// prune drops everything older than before. The keys to look at are gathered under the read lock and then pruned in
+// batches, releasing the write lock between them so that writes from the firehose aren't held up for the whole pass.
+func (ms *MemoryStore) prune(before time.Time) {
+	ms.mu.RLock()
+	dids := map[string]struct{}{}
+	for did := range ms.postsByDid {
+		dids[did] = struct{}{}
+	}
+	for did := range ms.interactionsByDid {
+		dids[did] = struct{}{}
+	}
+	for did := range ms.interactionsBySubject {
+		dids[did] = struct{}{}
+	}
+	for did := range ms.follows {
+		dids[did] = struct{}{}
+	}
+	tables := make([]string, 0, len(ms.feedPosts))
+	for table := range ms.feedPosts {
+		tables = append(tables, table)
+	}
+	entityIds := make([]string, 0, len(ms.entityPosts))
+	for entityId := range ms.entityPosts {
+		entityIds = append(entityIds, entityId)
+	}
+	labelKeys := make([]labelKey, 0, len(ms.labels))
+	for key := range ms.labels {
+		labelKeys = append(labelKeys, key)
+	}
+	moderationKeys := make([]moderationKey, 0, len(ms.moderation))
+	for key := range ms.moderation {
+		moderationKeys = append(moderationKeys, key)
+	}
+	aliasKeys := make([]string, 0, len(ms.aliases))
+	for alias := range ms.aliases {
+		aliasKeys = append(aliasKeys, alias)
+	}
+	paramsDids := make([]string, 0, len(ms.closeByParams))
+	for did := range ms.closeByParams {
+		paramsDids = append(paramsDids, did)
+	}
+	ms.mu.RUnlock()
+
+	didKeys := make([]string, 0, len(dids))
+	for did := range dids {
+		didKeys = append(didKeys, did)
+	}
+
+	now := time.Now()
+	pruneInBatches(ms, didKeys, func(did string) { ms.pruneDidLocked(did, before) })
+	pruneInBatches(ms, tables, func(table string) { ms.records -= pruneItemsBefore(ms.feedPosts[table], before) })
+	pruneInBatches(ms, entityIds, func(entityId string) {
+		if items, ok := ms.entityPosts[entityId]; ok {
+			ms.records -= pruneItemsBefore(items, before)
+			if len(items) == 0 {
+				delete(ms.entityPosts, entityId)
+			}
+		}
+	})
+	pruneInBatches(ms, labelKeys, func(key labelKey) {
+		if r, ok := ms.labels[key]; ok && ((r.Exp != nil && r.Exp.Before(now)) || (r.Neg != 0 && r.Cts.Before(before))) {
+			delete(ms.labels, key)
+			ms.records--
+		}
+	})
+	pruneInBatches(ms, moderationKeys, func(key moderationKey) {
+		if e, ok := ms.moderation[key]; ok && e.Deleted != 0 && e.CreatedAt.Before(before) {
+			delete(ms.moderation, key)
+			ms.records--
+		}
+	})
+	pruneInBatches(ms, aliasKeys, func(alias string) {
+		if a, ok := ms.aliases[alias]; ok && a.Deleted != 0 && a.CreatedAt.Before(before) {
+			delete(ms.aliases, alias)
+			ms.records--
+		}
+	})
+	pruneInBatches(ms, paramsDids, func(did string) {
+		if r, ok := ms.closeByParams[did]; ok && r.Deleted != 0 && r.UpdatedAt.Before(before) {
+			delete(ms.closeByParams, did)
+			ms.records--
+		}
+	})
+
+	ms.mu.RLock()
+	memoryStoreRecords.Set(float64(ms.records))
+	ms.mu.RUnlock()
+}
+
+func pruneInBatches[K comparable](ms *MemoryStore, keys []K, prune func(key K)) {
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), memoryStorePruneBatch)]
+		keys = keys[len(batch):]
+
+		ms.mu.Lock()
+		for _, key := range batch {
+			prune(key)
+		}
+		ms.mu.Unlock()
+	}
+}
+
+func (ms *MemoryStore) pruneDidLocked(did string, before time.Time) {
+	postAt := func(p StoredPost) time.Time { return p.CreatedAt }
+	interactionAt := func(i Interaction) time.Time { return i.CreatedAt }
+
+	if posts, ok := ms.postsByDid[did]; ok {
+		pruned := pruneBefore(posts, before, postAt)
+		ms.records -= len(posts) - len(pruned)
+		if len(pruned) == 0 {
+			delete(ms.postsByDid, did)
+		} else {
+			ms.postsByDid[did] = pruned
+		}
+	}
+
+	if is, ok := ms.interactionsByDid[did]; ok {
+		pruned := pruneBefore(is, before, interactionAt)
+		for _, i := range is[:len(is)-len(pruned)] {
+			if i.Kind == InteractionKindLike {
+				if ms.likesByUri[i.SubjectUri]--; ms.likesByUri[i.SubjectUri] == 0 {
+					delete(ms.likesByUri, i.SubjectUri)
+				}
+			}
+		}
+		ms.records -= len(is) - len(pruned)
+		if len(pruned) == 0 {
+			delete(ms.interactionsByDid, did)
+		} else {
+			ms.interactionsByDid[did] = pruned
+		}
+	}
+
+	// each interaction is counted once in records, against the account that made it
+	if is, ok := ms.interactionsBySubject[did]; ok {
+		if pruned := pruneBefore(is, before, interactionAt); len(pruned) == 0 {
+			delete(ms.interactionsBySubject, did)
+		} else {
+			ms.interactionsBySubject[did] = pruned
+		}
+	}
+
+	if subjects, ok := ms.follows[did]; ok {
+		for subject, createdAt := range subjects {
+			if createdAt.Before(before) {
+				delete(subjects, subject)
+				ms.records--
+			}
+		}
+		if len(subjects) == 0 {
+			delete(ms.follows, did)
+		}
+	}
+}
+
+// pruneItemsBefore deletes the feed items created before the given time and returns how many were deleted
+func pruneItemsBefore(items map[string]FeedDatabaseItem, before time.Time) int {
+	var pruned int
+	for uri, item := range items {
+		if item.CreatedAt.Before(before) {
+			delete(items, uri)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// pruneBefore drops the items at the start of a list kept in time order that are older than before
+func pruneBefore[T any](items []T, before time.Time, at func(T) time.Time) []T {
+	i := sort.Search(len(items), func(i int) bool {
+		return !at(items[i]).Before(before)
+	})
+	if i == 0 {
+		return items
+	}
+	return append([]T(nil), items[i:]...)
+}
+
+// insertByTime appends to a list kept in time order. Events mostly arrive in order, so this is usually an append.
+func insertByTime[T any](items []T, item T, at func(T) time.Time) []T {
+	i := len(items)
+	for i > 0 && at(items[i-1]).After(at(item)) {
+		i--
+	}
+	items = append(items, item)
+	copy(items[i+1:], items[i:])
+	items[i] = item
+	return items
+}
+
+// fullLocked reports whether there's no room for another record, counting the drop if there isn't
+func (ms *MemoryStore) fullLocked(kind string) bool {
+	if ms.records < ms.maxRecords {
+		return false
+	}
+	memoryStoreDropped.WithLabelValues(kind).Inc()
+	return true
+}
+
+func (ms *MemoryStore) RecordPost(ctx context.Context, post StoredPost) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.fullLocked("post") {
+		return nil
+	}
+	ms.postsByDid[post.Did] = insertByTime(ms.postsByDid[post.Did], post, func(p StoredPost) time.Time { return p.CreatedAt })
+	ms.records++
+	return nil
+}
+
+func (ms *MemoryStore) RecordInteraction(ctx context.Context, i Interaction) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.fullLocked(i.Kind) {
+		return nil
+	}
+	at := func(i Interaction) time.Time { return i.CreatedAt }
+	ms.interactionsByDid[i.Did] = insertByTime(ms.interactionsByDid[i.Did], i, at)
+	ms.interactionsBySubject[i.SubjectDid] = insertByTime(ms.interactionsBySubject[i.SubjectDid], i, at)
+	if i.Kind == InteractionKindLike {
+		ms.likesByUri[i.SubjectUri]++
+	}
+	ms.records++
+	return nil
+}
+
+func (ms *MemoryStore) RecordFollow(ctx context.Context, f Follow) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.follows[f.Did][f.Subject]; ok {
+		ms.follows[f.Did][f.Subject] = f.CreatedAt
+		return nil
+	}
+	if ms.fullLocked("follow") {
+		return nil
+	}
+	if ms.follows[f.Did] == nil {
+		ms.follows[f.Did] = map[string]time.Time{}
+	}
+	ms.follows[f.Did][f.Subject] = f.CreatedAt
+	ms.records++
+	return nil
+}
+
+func (ms *MemoryStore) PostsChronological(ctx context.Context, dids []string, cursor string, includeReposts bool) ([]ChronoPost, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	type datedPost struct {
+		ChronoPost
+		createdAt time.Time
+	}
+
+	var posts []datedPost
+	for _, did := range dids {
+		for _, p := range ms.postsByDid[did] {
+			if p.Rkey < cursor && p.ParentUri == "" {
+				posts = append(posts, datedPost{ChronoPost{Uri: p.Uri, Did: p.Did, Rkey: p.Rkey}, p.CreatedAt})
+			}
+		}
+		if !includeReposts {
+			continue
+		}
+		for _, i := range ms.interactionsByDid[did] {
+			if i.Rkey < cursor && i.Kind == InteractionKindRepost {
+				posts = append(posts, datedPost{ChronoPost{Uri: i.SubjectUri, Did: i.Did, Rkey: i.Rkey, RepostUri: i.Uri}, i.CreatedAt})
+			}
+		}
+	}
+
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].createdAt.After(posts[j].createdAt)
+	})
+
+	chrono := make([]ChronoPost, 0, min(len(posts), 50))
+	for _, p := range posts[:min(len(posts), 50)] {
+		chrono = append(chrono, p.ChronoPost)
+	}
+	return chrono, nil
+}
+
+func (ms *MemoryStore) PostsInRange(ctx context.Context, dids []string, since, until time.Time) ([]models.Post, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var posts []models.Post
+	for _, did := range dids {
+		for _, p := range ms.postsByDid[did] {
+			if p.CreatedAt.After(since) && !p.CreatedAt.After(until) && p.ParentUri == "" {
+				posts = append(posts, models.Post{Uri: p.Uri, Did: p.Did, CreatedAt: p.CreatedAt})
+			}
+		}
+	}
+
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].CreatedAt.After(posts[j].CreatedAt)
+	})
+
+	return posts[:min(len(posts), 2000)], nil
+}
+
+func (ms *MemoryStore) LikeCount(ctx context.Context, uri string) (uint64, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.likesByUri[uri], nil
+}
+
+// topMutualsLocked returns the accounts did has liked since the given time that have also liked did, ordered by the
+// number of like pairs between them like the clickhouse queries' join
+func (ms *MemoryStore) topMutualsLocked(did string, since time.Time, limit uint64) []string {
+	likedBy := map[string]uint64{}
+	for _, i := range ms.interactionsBySubject[did] {
+		if i.Kind == InteractionKindLike {
+			likedBy[i.Did]++
+		}
+	}
+
+	counts := map[string]uint64{}
+	for _, i := range ms.interactionsByDid[did] {
+		if i.Kind != InteractionKindLike || !i.CreatedAt.After(since) {
+			continue
+		}
+		if n := likedBy[i.SubjectDid]; n > 0 {
+			counts[i.SubjectDid] += n
+		}
+	}
+
+	return topCounts(counts, limit)
+}
+
+// topCounts returns the keys with the highest counts, breaking ties by key so that results are stable
+func topCounts(counts map[string]uint64, limit uint64) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if uint64(len(keys)) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// CloseBy works the same way as getCloseByQuery
+func (ms *MemoryStore) CloseBy(ctx context.Context, did string, params CloseByParams) ([]CloseBy, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	since := time.Now().Add(-params.Timeframe)
+
+	existing := map[string]struct{}{}
+	for _, i := range ms.interactionsByDid[did] {
+		if i.CreatedAt.After(since) {
+			existing[i.SubjectDid] = struct{}{}
+		}
+	}
+	for subject := range ms.follows[did] {
+		existing[subject] = struct{}{}
+	}
+
+	type score struct {
+		count uint64
+		dids  map[string]struct{}
+	}
+	scores := map[string]*score{}
+	for _, mutual := range ms.topMutualsLocked(did, since, params.TopMutualLimit) {
+		for _, i := range ms.interactionsByDid[mutual] {
+			if i.Kind != InteractionKindLike || !i.CreatedAt.After(since) || i.SubjectDid == did {
+				continue
+			}
+			sc, ok := scores[i.SubjectDid]
+			if !ok {
+				sc = &score{dids: map[string]struct{}{}}
+				scores[i.SubjectDid] = sc
+			}
+			sc.count++
+			sc.dids[i.Did] = struct{}{}
+		}
+	}
+
+	closeBy := make([]CloseBy, 0, len(scores))
+	for suggested, sc := range scores {
+		cb := CloseBy{
+			SuggestedDid:      suggested,
+			BskyUrl:           "https://bsky.app/profile/" + suggested,
+			InteractionScore:  sc.count,
+			InteractedByCount: uint64(len(sc.dids)),
+			ConnectionType:    "new_discovery",
+			BlendedScore:      sc.count * params.NewDiscoveryWeight,
+		}
+		if _, ok := existing[suggested]; ok {
+			cb.ConnectionType = "existing_connection"
+			cb.BlendedScore = sc.count * params.ExistingConnectionWeight
+		}
+		closeBy = append(closeBy, cb)
+	}
+
+	sort.Slice(closeBy, func(i, j int) bool {
+		if closeBy[i].BlendedScore != closeBy[j].BlendedScore {
+			return closeBy[i].BlendedScore > closeBy[j].BlendedScore
+		}
+		return closeBy[i].SuggestedDid < closeBy[j].SuggestedDid
+	})
+
+	return closeBy[:min(len(closeBy), 500)], nil
+}
+
+// SuggestedFollows works the same way as getSuggestedFollowsQuery. There are no handles in memory, so showHandles
+// is ignored.
+func (ms *MemoryStore) SuggestedFollows(ctx context.Context, did string, showHandles bool) ([]SuggestedFollow, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	since := time.Now().Add(-60 * 24 * time.Hour)
+
+	liked := map[string]uint64{}
+	for _, mutual := range ms.topMutualsLocked(did, since, 40) {
+		for _, i := range ms.interactionsByDid[mutual] {
+			if i.Kind == InteractionKindLike && i.CreatedAt.After(since) {
+				liked[i.SubjectDid]++
+			}
+		}
+	}
+
+	counts := map[string]uint64{}
+	for _, follower := range topCounts(liked, 20) {
+		for subject := range ms.follows[follower] {
+			if subject == did {
+				continue
+			}
+			if _, ok := ms.follows[did][subject]; ok {
+				continue
+			}
+			counts[subject]++
+		}
+	}
+
+	var suggestions []SuggestedFollow
+	for _, subject := range topCounts(counts, uint64(len(counts))) {
+		if counts[subject] < 2 {
+			break
+		}
+		suggestions = append(suggestions, SuggestedFollow{
+			SuggestedDid:    subject,
+			BskyUrl:         "https://bsky.app/profile/" + subject,
+			FollowedByCount: counts[subject],
+		})
+	}
+
+	return suggestions[:min(len(suggestions), 100)], nil
+}
+
+func (ms *MemoryStore) InitFeedTable(ctx context.Context, table string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.feedPosts[table] == nil {
+		ms.feedPosts[table] = map[string]FeedDatabaseItem{}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) InsertFeedPost(ctx context.Context, table string, item FeedDatabaseItem) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.feedPosts[table][item.Uri]; !ok {
+		if ms.fullLocked("feed_post") {
+			return ErrFeedInsertDropped
+		}
+		ms.records++
+	}
+	if ms.feedPosts[table] == nil {
+		ms.feedPosts[table] = map[string]FeedDatabaseItem{}
+	}
+	ms.feedPosts[table][item.Uri] = item
+	return nil
+}
+
+func (ms *MemoryStore) FlushFeedPosts(ctx context.Context) error {
+	return nil
+}
+
+func (ms *MemoryStore) RankedFeedPosts(ctx context.Context, table string) ([]RankedFeedPost, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.rankLocked(ms.feedPosts[table]), nil
+}
+
+func (ms *MemoryStore) InsertEntityPost(ctx context.Context, row EntityPostRow) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.entityPosts[row.EntityId][row.Uri]; !ok {
+		if ms.fullLocked("entity_post") {
+			return nil
+		}
+		ms.records++
+	}
+	if ms.entityPosts[row.EntityId] == nil {
+		ms.entityPosts[row.EntityId] = map[string]FeedDatabaseItem{}
+	}
+	ms.entityPosts[row.EntityId][row.Uri] = FeedDatabaseItem{
+		Uri:       row.Uri,
+		CreatedAt: row.CreatedAt,
+		Lang:      row.Lang,
+	}
+	return nil
+}
+
+func (ms *MemoryStore) RankedEntityPosts(ctx context.Context, entityId string) ([]RankedFeedPost, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.rankLocked(ms.entityPosts[entityId]), nil
+}
+
+// rankLocked scores posts like makeRankedQuery does. The query's left join counts a post without likes once, so
+// like counts start at one here too.
+func (ms *MemoryStore) rankLocked(items map[string]FeedDatabaseItem) []RankedFeedPost {
+	now := time.Now()
+	since := now.Add(-24 * time.Hour)
+
+	posts := make([]RankedFeedPost, 0, len(items))
+	for _, item := range items {
+		if !item.CreatedAt.After(since) {
+			continue
+		}
+		likes := max(ms.likesByUri[item.Uri], 1)
+		hoursOld := int64(now.Sub(item.CreatedAt) / time.Hour)
+		posts = append(posts, RankedFeedPost{
+			LikeCt:     likes,
+			Uri:        item.Uri,
+			CreatedAt:  item.CreatedAt,
+			Lang:       item.Lang,
+			HoursOld:   hoursOld,
+			DecayScore: float64(likes) * math.Exp(-0.1*float64(hoursOld)),
+		})
+	}
+
+	sort.Slice(posts, func(i, j int) bool {
+		if posts[i].DecayScore != posts[j].DecayScore {
+			return posts[i].DecayScore > posts[j].DecayScore
+		}
+		return posts[i].Uri < posts[j].Uri
+	})
+
+	return posts[:min(len(posts), 5000)]
+}
+
+func (ms *MemoryStore) ModerationEntries(ctx context.Context) ([]ModerationEntry, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var entries []ModerationEntry
+	for _, e := range ms.moderation {
+		if e.Deleted == 0 {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (ms *MemoryStore) WriteModerationEntry(ctx context.Context, entry ModerationEntry) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	key := moderationKey{entry.Subject, entry.Feed}
+	prev, ok := ms.moderation[key]
+	if ok && entry.CreatedAt.Before(prev.CreatedAt) {
+		return nil
+	}
+	if !ok {
+		if ms.fullLocked("moderation") {
+			return errMemoryStoreFull
+		}
+		ms.records++
+	}
+	ms.moderation[key] = entry
+	return nil
+}
+
+func (ms *MemoryStore) Labels(ctx context.Context, src string) ([]LabelRow, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var rows []LabelRow
+	for key, r := range ms.labels {
+		if key.src == src {
+			rows = append(rows, r)
+		}
+	}
+	return rows, nil
+}
+
+func (ms *MemoryStore) WriteLabels(ctx context.Context, rows []LabelRow) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, r := range rows {
+		key := labelKey{r.Src, r.Uri, r.Val}
+		prev, ok := ms.labels[key]
+		if ok && r.Cts.Before(prev.Cts) {
+			continue
+		}
+		if !ok {
+			if ms.fullLocked("label") {
+				continue
+			}
+			ms.records++
+		}
+		ms.labels[key] = r
+	}
+	return nil
+}
+
+func (ms *MemoryStore) EntityAliases(ctx context.Context) ([]EntityAlias, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var aliases []EntityAlias
+	for _, a := range ms.aliases {
+		if a.Deleted == 0 {
+			aliases = append(aliases, a)
+		}
+	}
+	return aliases, nil
+}
+
+func (ms *MemoryStore) WriteEntityAlias(ctx context.Context, alias EntityAlias) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	prev, ok := ms.aliases[alias.Alias]
+	if ok && alias.CreatedAt.Before(prev.CreatedAt) {
+		return nil
+	}
+	if !ok {
+		if ms.fullLocked("alias") {
+			return errMemoryStoreFull
+		}
+		ms.records++
+	}
+	ms.aliases[alias.Alias] = alias
+	return nil
+}
+
+func (ms *MemoryStore) UserCloseByParams(ctx context.Context, did string) (*UserCloseByParams, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	r, ok := ms.closeByParams[did]
+	if !ok || r.Deleted != 0 {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+func (ms *MemoryStore) WriteUserCloseByParams(ctx context.Context, row UserCloseByParams) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	prev, ok := ms.closeByParams[row.Did]
+	if ok && row.UpdatedAt.Before(prev.UpdatedAt) {
+		return nil
+	}
+	if !ok {
+		if ms.fullLocked("close_by_params") {
+			return errMemoryStoreFull
+		}
+		ms.records++
+	}
+	ms.closeByParams[row.Did] = row
+	return nil
+}
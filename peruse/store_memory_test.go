@@ -0,0 +1,322 @@
+package peruse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+)
+
+func testPostUri(did string, i int) string {
+	return uriFromParts(did, "app.bsky.feed.post", fmt.Sprintf("%d", i))
+}
+
+func recordTestLike(t *testing.T, ms *MemoryStore, did, subjectUri string, createdAt time.Time) {
+	t.Helper()
+	like := newInteraction(InteractionKindLike, uriFromParts(did, "app.bsky.feed.like", subjectUri), did, "", subjectUri, createdAt)
+	if err := ms.RecordInteraction(context.Background(), like); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func recordTestFollow(t *testing.T, ms *MemoryStore, did, subject string, createdAt time.Time) {
+	t.Helper()
+	if err := ms.RecordFollow(context.Background(), Follow{Did: did, Subject: subject, CreatedAt: createdAt}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStorePrune(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore(time.Hour, 0)
+
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+
+	// enough accounts that pruning takes the lock more than once
+	for i := range memoryStorePruneBatch + 10 {
+		did := fmt.Sprintf("did:plc:author%d", i)
+		for _, createdAt := range []time.Time{old, now} {
+			if err := ms.RecordPost(ctx, StoredPost{Uri: testPostUri(did, int(createdAt.Unix())), Did: did, CreatedAt: createdAt}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	target := testPostUri("did:plc:author0", 0)
+	recordTestLike(t, ms, "did:plc:liker", target, old)
+	recordTestLike(t, ms, "did:plc:liker", target, now)
+	recordTestFollow(t, ms, "did:plc:liker", "did:plc:old", old)
+	recordTestFollow(t, ms, "did:plc:liker", "did:plc:new", now)
+
+	ms.prune(now.Add(-ms.retention))
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	// one post per author, one like and one follow are left
+	if want := memoryStorePruneBatch + 10 + 2; ms.records != want {
+		t.Errorf("expected %d records, got %d", want, ms.records)
+	}
+	for did, posts := range ms.postsByDid {
+		if len(posts) != 1 || posts[0].CreatedAt.Before(now) {
+			t.Fatalf("expected only the new post for %s, got %v", did, posts)
+		}
+	}
+	if likes := ms.likesByUri[target]; likes != 1 {
+		t.Errorf("expected the old like to be uncounted, got %d likes", likes)
+	}
+	if len(ms.interactionsBySubject["did:plc:author0"]) != 1 {
+		t.Errorf("expected the old like to be pruned by subject, got %v", ms.interactionsBySubject["did:plc:author0"])
+	}
+	if _, ok := ms.follows["did:plc:liker"]["did:plc:old"]; ok {
+		t.Error("expected the old follow to be pruned")
+	}
+	if _, ok := ms.follows["did:plc:liker"]["did:plc:new"]; !ok {
+		t.Error("expected the new follow to be kept")
+	}
+}
+
+func TestMemoryStoreMaxRecords(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore(time.Hour, 2)
+
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+
+	recordTestFollow(t, ms, "did:plc:a", "did:plc:b", old)
+	recordTestLike(t, ms, "did:plc:a", testPostUri("did:plc:b", 1), now)
+	// the store is full, so these are dropped
+	if err := ms.RecordPost(ctx, StoredPost{Uri: testPostUri("did:plc:a", 1), Did: "did:plc:a", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	recordTestFollow(t, ms, "did:plc:a", "did:plc:c", now)
+
+	if posts, _ := ms.PostsInRange(ctx, []string{"did:plc:a"}, old, now); len(posts) != 0 {
+		t.Errorf("expected the post past the cap to be dropped, got %v", posts)
+	}
+
+	// following the same account again only refreshes it
+	recordTestFollow(t, ms, "did:plc:a", "did:plc:b", old)
+
+	// pruning the old follow makes room again
+	ms.prune(now.Add(-ms.retention))
+	recordTestFollow(t, ms, "did:plc:a", "did:plc:c", now)
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.records != 2 {
+		t.Errorf("expected 2 records, got %d", ms.records)
+	}
+	if _, ok := ms.follows["did:plc:a"]["did:plc:c"]; !ok {
+		t.Error("expected the follow to be kept once there was room")
+	}
+}
+
+func newTestMemoryServer(t *testing.T) *Server {
+	t.Helper()
+
+	s, err := NewServer(ServerArgs{
+		Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+		StoreBackend:    StoreBackendMemory,
+		TrendingBackend: TrendingBackendMemory,
+		RuleFeeds:       []RuleFeedConfig{{Name: "golang", Table: "golang_post", Hashtags: []string{"golang"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.addRoutes()
+	return s
+}
+
+func TestFeedSkeletonMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := newTestMemoryServer(t)
+	ms := s.store.(*MemoryStore)
+
+	now := time.Now()
+	older := testPostUri("did:plc:author", 1)
+	liked := testPostUri("did:plc:author", 2)
+	stale := testPostUri("did:plc:author", 3)
+	for uri, createdAt := range map[string]time.Time{
+		older: now.Add(-time.Hour),
+		liked: now.Add(-2 * time.Hour),
+		// ranked feeds only look back a day
+		stale: now.Add(-48 * time.Hour),
+	} {
+		if err := ms.InsertFeedPost(ctx, "golang_post", FeedDatabaseItem{Uri: uri, CreatedAt: createdAt, Lang: "en"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recordTestLike(t, ms, "did:plc:liker1", liked, now)
+	recordTestLike(t, ms, "did:plc:liker2", liked, now)
+
+	q := url.Values{"feed": {"at://did:web:feeds.example.com/app.bsky.feed.generator/golang"}}
+	req := httptest.NewRequest(http.MethodGet, "/xrpc/app.bsky.feed.getFeedSkeleton?"+q.Encode(), nil)
+	rec := httptest.NewRecorder()
+	s.echo.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var resp FeedSkeletonResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, item := range resp.Feed {
+		got = append(got, item.Post)
+	}
+	if want := []string{liked, older}; !equalStrings(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if resp.Cursor == nil || *resp.Cursor != "2" {
+		t.Errorf("expected cursor 2, got %v", resp.Cursor)
+	}
+}
+
+func TestSuggestedFollowsMemoryStore(t *testing.T) {
+	s := newTestMemoryServer(t)
+	ms := s.store.(*MemoryStore)
+
+	const (
+		viewer = "did:plc:viewer"
+		mutual = "did:plc:mutual"
+	)
+	now := time.Now()
+
+	// the viewer and the mutual like each other, and the mutual likes two accounts that both follow the suggestion
+	recordTestLike(t, ms, viewer, testPostUri(mutual, 1), now)
+	recordTestLike(t, ms, mutual, testPostUri(viewer, 1), now)
+	for _, liked := range []string{"did:plc:liked1", "did:plc:liked2"} {
+		recordTestLike(t, ms, mutual, testPostUri(liked, 1), now)
+		recordTestFollow(t, ms, liked, "did:plc:suggested", now)
+		recordTestFollow(t, ms, liked, "did:plc:followed", now)
+	}
+	// accounts the viewer already follows, or that only one account follows, aren't suggested
+	recordTestFollow(t, ms, viewer, "did:plc:followed", now)
+	recordTestFollow(t, ms, "did:plc:liked1", "did:plc:once", now)
+
+	req := httptest.NewRequest(http.MethodGet, "/xrpc/app.peruse.graph.getSuggestedFollows", nil)
+	rec := httptest.NewRecorder()
+	e := s.echo.NewContext(req, rec)
+	e.Set("user", NewUser(viewer))
+
+	if err := s.handleGetSuggestedFollowsXrpc(e); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var resp GetSuggestedFollowsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []SuggestedFollowsResult{{Did: "did:plc:suggested", FollowedByCount: 2}}
+	if len(resp.Suggestions) != len(want) || resp.Suggestions[0] != want[0] {
+		t.Errorf("expected %v, got %v", want, resp.Suggestions)
+	}
+	if resp.Cursor != nil {
+		t.Errorf("expected no cursor, got %s", *resp.Cursor)
+	}
+}
+
+func TestMemoryStorePrunesLabelsAndTombstones(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore(time.Hour, 0)
+
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	expired := now.Add(-time.Minute)
+
+	if err := ms.WriteLabels(ctx, []LabelRow{
+		{Src: "did:plc:labeler", Uri: "at://did:plc:a", Val: "spam", Cts: old},
+		{Src: "did:plc:labeler", Uri: "at://did:plc:b", Val: "spam", Cts: old, Exp: &expired},
+		{Src: "did:plc:labeler", Uri: "at://did:plc:c", Val: "spam", Cts: old, Neg: 1},
+		{Src: "did:plc:labeler", Uri: "at://did:plc:d", Val: "spam", Cts: now, Neg: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.WriteModerationEntry(ctx, ModerationEntry{Subject: "did:plc:a", CreatedAt: old, Deleted: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.WriteEntityAlias(ctx, EntityAlias{Alias: "seattle", CreatedAt: old, Deleted: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.WriteUserCloseByParams(ctx, UserCloseByParams{Did: "did:plc:a", UpdatedAt: old}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.InsertFeedPost(ctx, "golang_post", FeedDatabaseItem{Uri: testPostUri("did:plc:a", 1), CreatedAt: old}); err != nil {
+		t.Fatal(err)
+	}
+
+	ms.prune(now.Add(-ms.retention))
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	// the live label, the recent negation and the close by params that weren't deleted are left
+	if ms.records != 3 {
+		t.Errorf("expected 3 records, got %d", ms.records)
+	}
+	var uris []string
+	for key := range ms.labels {
+		uris = append(uris, key.uri)
+	}
+	sort.Strings(uris)
+	if want := []string{"at://did:plc:a", "at://did:plc:d"}; !equalStrings(uris, want) {
+		t.Errorf("expected labels for %v, got %v", want, uris)
+	}
+	if len(ms.moderation) != 0 || len(ms.aliases) != 0 {
+		t.Errorf("expected the old deleted rows to be pruned, got %v and %v", ms.moderation, ms.aliases)
+	}
+	if len(ms.closeByParams) != 1 {
+		t.Errorf("expected the close by params to be kept, got %v", ms.closeByParams)
+	}
+}
+
+func TestMemoryStoreMaxRecordsCountsEveryRow(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStore(time.Hour, 2)
+
+	now := time.Now()
+	if err := ms.WriteLabels(ctx, []LabelRow{{Src: "did:plc:labeler", Uri: "at://did:plc:a", Val: "spam", Cts: now}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.InsertFeedPost(ctx, "golang_post", FeedDatabaseItem{Uri: testPostUri("did:plc:a", 1), CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the store is full, so new rows are refused but existing ones can still be updated
+	if err := ms.InsertFeedPost(ctx, "golang_post", FeedDatabaseItem{Uri: testPostUri("did:plc:a", 2), CreatedAt: now}); !errors.Is(err, ErrFeedInsertDropped) {
+		t.Errorf("expected the feed post to be dropped, got %v", err)
+	}
+	if err := ms.WriteModerationEntry(ctx, ModerationEntry{Subject: "did:plc:a", CreatedAt: now}); !errors.Is(err, errMemoryStoreFull) {
+		t.Errorf("expected the moderation entry to be refused, got %v", err)
+	}
+	if err := ms.WriteLabels(ctx, []LabelRow{{Src: "did:plc:labeler", Uri: "at://did:plc:a", Val: "spam", Cts: now, Neg: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.records != 2 {
+		t.Errorf("expected 2 records, got %d", ms.records)
+	}
+	if r := ms.labels[labelKey{"did:plc:labeler", "at://did:plc:a", "spam"}]; r.Neg != 1 {
+		t.Errorf("expected the label to be negated, got %v", r)
+	}
+}
@@ -0,0 +1,163 @@
+package peruse
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/haileyok/peruse/wikidata"
+)
+
+const (
+	TrendingBackendClickhouse = "clickhouse"
+	TrendingBackendMemory     = "memory"
+	TrendingBackendNone       = "none"
+
+	// trendingBaseline is how far before a window the baseline rate is measured over
+	trendingBaseline = 7 * 24 * time.Hour
+
+	// an entity needs at least this many mentions in a window, at trendingSpikeRatio times its baseline rate, to be
+	// considered spiking. the minimum keeps entities that are almost never mentioned from spiking on a couple of posts
+	trendingMinSpikeCount = 5
+	trendingSpikeRatio    = 3.0
+)
+
+// TrendingWindows are the sliding windows that trending counts are reported over
+var TrendingWindows = []time.Duration{time.Hour, 6 * time.Hour, 24 * time.Hour}
+
+// TrendingStore counts entity mentions in the posts each feed includes
+type TrendingStore interface {
+	Init(ctx context.Context) error
+	Record(ctx context.Context, feed string, mentions []EntityMention, at time.Time) error
+	// Counts returns the mentions of each entity in the window ending at now, along with its mentions over the
+	// trendingBaseline before the window
+	Counts(ctx context.Context, feed string, now time.Time, window time.Duration) ([]EntityCount, error)
+	// Close writes out any mentions that are still buffered
+	Close(ctx context.Context) error
+}
+
+type EntityMention struct {
+	EntityId string
+	Text     string
+}
+
+type EntityCount struct {
+	EntityId      string `ch:"entity_id"`
+	Text          string `ch:"display_text"`
+	Count         uint64 `ch:"count"`
+	BaselineCount uint64 `ch:"baseline_count"`
+}
+
+// NewTrendingStore creates the given backend. With no backend set, mentions are counted in clickhouse if that is where
+// the server stores everything else, and in memory otherwise.
+func NewTrendingStore(backend string, s *Server) (TrendingStore, error) {
+	cs, isClickhouse := s.store.(*ClickhouseStore)
+	if backend == "" {
+		backend = TrendingBackendMemory
+		if isClickhouse {
+			backend = TrendingBackendClickhouse
+		}
+	}
+
+	switch backend {
+	case TrendingBackendClickhouse:
+		if !isClickhouse {
+			return nil, fmt.Errorf("the clickhouse trending backend needs the clickhouse store")
+		}
+		return newClickhouseTrendingStore(cs.Conn(), s.logger), nil
+	case TrendingBackendMemory:
+		return newMemoryTrendingStore(), nil
+	case TrendingBackendNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown trending backend %q", backend)
+	}
+}
+
+// entityMentions dedupes the entities found in a post, so that an entity mentioned several times counts once
+func entityMentions(items []wikidata.EntityMatch) []EntityMention {
+	seen := map[string]struct{}{}
+	var mentions []EntityMention
+	for _, item := range items {
+		if item.EntityId == "" {
+			continue
+		}
+		if _, ok := seen[item.EntityId]; ok {
+			continue
+		}
+		seen[item.EntityId] = struct{}{}
+		mentions = append(mentions, EntityMention{
+			EntityId: item.EntityId,
+			Text:     item.Text,
+		})
+	}
+	return mentions
+}
+
+type TrendingEntity struct {
+	EntityId string `json:"entityId"`
+	Text     string `json:"text"`
+	Count    uint64 `json:"count"`
+	// Expected is how many mentions the baseline rate predicts for the window
+	Expected float64 `json:"expected"`
+	Ratio    float64 `json:"ratio"`
+	// Score is how many standard deviations above the expected count the window is, treating mentions as a poisson
+	// process. Entities are ranked by it.
+	Score    float64 `json:"score"`
+	Spiking  bool    `json:"spiking"`
+	Baseline uint64  `json:"baselineCount"`
+}
+
+type TrendingWindow struct {
+	Window   string           `json:"window"`
+	Entities []TrendingEntity `json:"entities"`
+}
+
+// rankTrending scores each entity's count in a window against its baseline rate and ranks by score
+func rankTrending(counts []EntityCount, window time.Duration, limit int) []TrendingEntity {
+	scale := window.Seconds() / trendingBaseline.Seconds()
+
+	entities := make([]TrendingEntity, 0, len(counts))
+	for _, c := range counts {
+		if c.Count == 0 {
+			continue
+		}
+
+		expected := float64(c.BaselineCount) * scale
+		ratio := float64(c.Count) / math.Max(expected, 1)
+		score := (float64(c.Count) - expected) / math.Sqrt(expected+1)
+
+		entities = append(entities, TrendingEntity{
+			EntityId: c.EntityId,
+			Text:     c.Text,
+			Count:    c.Count,
+			Expected: math.Round(expected*100) / 100,
+			Ratio:    math.Round(ratio*100) / 100,
+			Score:    math.Round(score*100) / 100,
+			Spiking:  c.Count >= trendingMinSpikeCount && ratio >= trendingSpikeRatio,
+			Baseline: c.BaselineCount,
+		})
+	}
+
+	sort.Slice(entities, func(i, j int) bool {
+		if entities[i].Score != entities[j].Score {
+			return entities[i].Score > entities[j].Score
+		}
+		return entities[i].EntityId < entities[j].EntityId
+	})
+
+	if len(entities) > limit {
+		entities = entities[:limit]
+	}
+
+	return entities
+}
+
+func formatTrendingWindow(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return d.String()
+}
@@ -0,0 +1,97 @@
+package peruse
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/haileyok/photocopy/clickhouse_inserter"
+)
+
+type EntityMentionRow struct {
+	Feed      string    `ch:"feed"`
+	EntityId  string    `ch:"entity_id"`
+	Text      string    `ch:"text"`
+	CreatedAt time.Time `ch:"created_at"`
+}
+
+// clickhouseTrendingStore keeps every mention in the peruse_entity_mention table and counts them at query time
+type clickhouseTrendingStore struct {
+	conn     driver.Conn
+	logger   *slog.Logger
+	inserter *clickhouse_inserter.Inserter
+}
+
+func newClickhouseTrendingStore(conn driver.Conn, logger *slog.Logger) *clickhouseTrendingStore {
+	return &clickhouseTrendingStore{
+		conn:   conn,
+		logger: logger.With("component", "trending"),
+	}
+}
+
+func (ts *clickhouseTrendingStore) Init(ctx context.Context) error {
+	inserter, err := clickhouse_inserter.New(ctx, &clickhouse_inserter.Args{
+		PrometheusCounterPrefix: "peruse_entity_mention",
+		BatchSize:               100,
+		Logger:                  ts.logger,
+		Conn:                    ts.conn,
+		Query:                   "INSERT INTO peruse_entity_mention (feed, entity_id, text, created_at)",
+		RateLimit:               3,
+		Histogram:               clickhouseInsertDuration,
+	})
+	if err != nil {
+		return err
+	}
+	ts.inserter = inserter
+
+	return nil
+}
+
+func (ts *clickhouseTrendingStore) Close(ctx context.Context) error {
+	if ts.inserter == nil {
+		return nil
+	}
+	return ts.inserter.Close(ctx)
+}
+
+func (ts *clickhouseTrendingStore) Record(ctx context.Context, feed string, mentions []EntityMention, at time.Time) error {
+	for _, m := range mentions {
+		if err := ts.inserter.Insert(ctx, EntityMentionRow{
+			Feed:      feed,
+			EntityId:  m.EntityId,
+			Text:      m.Text,
+			CreatedAt: at,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ts *clickhouseTrendingStore) Counts(ctx context.Context, feed string, now time.Time, window time.Duration) ([]EntityCount, error) {
+	windowStart := now.Add(-window)
+	baselineStart := windowStart.Add(-trendingBaseline)
+
+	var counts []EntityCount
+	start := time.Now()
+	err := ts.conn.Select(ctx, &counts, `
+		SELECT
+			entity_id,
+			argMax(text, created_at) AS display_text,
+			countIf(created_at >= ?) AS count,
+			countIf(created_at < ?) AS baseline_count
+		FROM peruse_entity_mention
+		WHERE feed = ? AND created_at >= ? AND created_at <= ?
+		GROUP BY entity_id
+		HAVING count > 0
+		ORDER BY count DESC
+		LIMIT 1000
+		`, windowStart, windowStart, feed, baselineStart, now)
+	observeQuery("trending_counts", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,198 @@
+package peruse
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+const (
+	cmsWidth = 512
+	cmsDepth = 4
+
+	// enough hourly buckets for the longest window and the baseline before it, plus the partial current hour
+	memoryTrendingBuckets = 24 + 7*24 + 1
+
+	// the sketch can only estimate counts for keys it is asked about, so the most recently mentioned entities are kept
+	// as candidates to ask about
+	memoryTrendingCandidates = 10_000
+)
+
+// countMinSketch estimates counts in fixed memory. Estimates are never below the true count, and are only above it
+// when keys collide in every row.
+type countMinSketch struct {
+	counts [cmsDepth][cmsWidth]uint32
+}
+
+func cmsIndexes(key string) [cmsDepth]uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+
+	// double hashing gives each row its own index from a single hash
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	var idx [cmsDepth]uint32
+	for i := range idx {
+		idx[i] = (h1 + uint32(i)*h2) % cmsWidth
+	}
+	return idx
+}
+
+func (c *countMinSketch) add(key string) {
+	for row, col := range cmsIndexes(key) {
+		if c.counts[row][col] < math.MaxUint32 {
+			c.counts[row][col]++
+		}
+	}
+}
+
+// merge adds other's counts into c. The merged sketch estimates the combined counts at least as closely as adding up
+// the estimates of each sketch would.
+func (c *countMinSketch) merge(other *countMinSketch) {
+	for row := range c.counts {
+		for col, n := range other.counts[row] {
+			c.counts[row][col] = uint32(min(uint64(c.counts[row][col])+uint64(n), math.MaxUint32))
+		}
+	}
+}
+
+// estimate takes the key's indexes rather than the key, so that a key is only hashed once for every sketch it is
+// looked up in
+func (c *countMinSketch) estimate(idx [cmsDepth]uint32) uint32 {
+	est := uint32(math.MaxUint32)
+	for row, col := range idx {
+		est = min(est, c.counts[row][col])
+	}
+	return est
+}
+
+type trendingBucket struct {
+	hour   int64
+	sketch *countMinSketch
+}
+
+type feedTrending struct {
+	buckets    [memoryTrendingBuckets]trendingBucket
+	candidates *lru.Cache[string, string] // entity id -> most recent text
+}
+
+// memoryTrendingStore keeps an hourly count-min sketch per feed in a ring covering the baseline, for running without
+// writing every mention to clickhouse. Counts are lost on restart.
+type memoryTrendingStore struct {
+	mu    sync.Mutex
+	feeds map[string]*feedTrending
+}
+
+func newMemoryTrendingStore() *memoryTrendingStore {
+	return &memoryTrendingStore{
+		feeds: map[string]*feedTrending{},
+	}
+}
+
+func (ts *memoryTrendingStore) Init(ctx context.Context) error {
+	return nil
+}
+
+func (ts *memoryTrendingStore) Record(ctx context.Context, feed string, mentions []EntityMention, at time.Time) error {
+	hour := at.Unix() / 3600
+	if time.Now().Unix()/3600-hour >= memoryTrendingBuckets {
+		return nil
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ft, ok := ts.feeds[feed]
+	if !ok {
+		candidates, _ := lru.New[string, string](memoryTrendingCandidates)
+		ft = &feedTrending{
+			candidates: candidates,
+		}
+		ts.feeds[feed] = ft
+	}
+
+	b := &ft.buckets[hour%memoryTrendingBuckets]
+	if b.sketch == nil || b.hour != hour {
+		if b.sketch != nil && b.hour > hour {
+			// the slot already holds a newer hour, so this mention is too old to keep
+			return nil
+		}
+		b.hour = hour
+		b.sketch = &countMinSketch{}
+	}
+
+	for _, m := range mentions {
+		b.sketch.add(m.EntityId)
+		ft.candidates.Add(m.EntityId, m.Text)
+	}
+
+	return nil
+}
+
+func (ts *memoryTrendingStore) Close(ctx context.Context) error {
+	return nil
+}
+
+// Counts approximates a sliding window over hourly buckets by counting the oldest bucket in proportion to how much of
+// it still falls inside the window. The hours in the window and in the baseline are each merged into one sketch while
+// holding the lock, so that only three sketches are kept for the request however long the window is, and every
+// candidate is estimated from them after the lock is released.
+func (ts *memoryTrendingStore) Counts(ctx context.Context, feed string, now time.Time, window time.Duration) ([]EntityCount, error) {
+	nowHour := now.Unix() / 3600
+	elapsed := float64(now.Unix()%3600) / 3600
+	windowHours := int64(window / time.Hour)
+	baselineHours := int64(trendingBaseline / time.Hour)
+
+	// the window is the full hours through the current one plus part of the hour before them, and the baseline is the
+	// hours before that
+	partialHour := nowHour - windowHours
+	firstHour := partialHour - baselineHours
+
+	var windowSketch, partialSketch, baselineSketch countMinSketch
+
+	ts.mu.Lock()
+	ft, ok := ts.feeds[feed]
+	if !ok {
+		ts.mu.Unlock()
+		return nil, nil
+	}
+	ids := ft.candidates.Keys()
+	texts := make([]string, len(ids))
+	for i, id := range ids {
+		texts[i], _ = ft.candidates.Peek(id)
+	}
+	for h := firstHour; h <= nowHour; h++ {
+		b := ft.buckets[h%memoryTrendingBuckets]
+		if b.sketch == nil || b.hour != h {
+			continue
+		}
+		switch {
+		case h > partialHour:
+			windowSketch.merge(b.sketch)
+		case h == partialHour:
+			partialSketch = *b.sketch
+		default:
+			baselineSketch.merge(b.sketch)
+		}
+	}
+	ts.mu.Unlock()
+
+	counts := make([]EntityCount, 0, len(ids))
+	for i, id := range ids {
+		idx := cmsIndexes(id)
+		count := float64(windowSketch.estimate(idx)) + float64(partialSketch.estimate(idx))*(1-elapsed)
+
+		counts = append(counts, EntityCount{
+			EntityId:      id,
+			Text:          texts[i],
+			Count:         uint64(math.Round(count)),
+			BaselineCount: uint64(baselineSketch.estimate(idx)),
+		})
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,51 @@
+package peruse
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryTrendingCounts(t *testing.T) {
+	ctx := context.Background()
+	ts := newMemoryTrendingStore()
+
+	now := time.Now().Truncate(time.Hour).Add(30 * time.Minute)
+	record := func(id string, n int, at time.Time) {
+		for range n {
+			if err := ts.Record(ctx, "seattle", []EntityMention{{EntityId: id, Text: id}}, at); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	record("Q1", 3, now)
+	// half of the hour before the window's full hours still falls inside it
+	record("Q1", 4, now.Add(-time.Hour))
+	record("Q1", 10, now.Add(-5*time.Hour))
+	record("Q2", 1, now)
+	// past the baseline
+	record("Q2", 7, now.Add(-trendingBaseline-2*time.Hour))
+
+	counts, err := ts.Counts(ctx, "seattle", now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]EntityCount{
+		"Q1": {EntityId: "Q1", Text: "Q1", Count: 5, BaselineCount: 10},
+		"Q2": {EntityId: "Q2", Text: "Q2", Count: 1, BaselineCount: 0},
+	}
+	if len(counts) != len(want) {
+		t.Fatalf("expected %d counts, got %v", len(want), counts)
+	}
+	for _, c := range counts {
+		if c != want[c.EntityId] {
+			t.Errorf("expected %+v, got %+v", want[c.EntityId], c)
+		}
+	}
+
+	if counts, _ := ts.Counts(ctx, "boston", now, time.Hour); len(counts) != 0 {
+		t.Errorf("expected no counts for a feed without mentions, got %v", counts)
+	}
+}
@@ -40,6 +40,14 @@ func (um *UserManager) getUser(did string) *User {
 	return u
 }
 
+// evictUser drops a user and everything cached for them. Returns whether the user was present.
+func (um *UserManager) evictUser(did string) bool {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	return um.users.Remove(did)
+}
+
 type User struct {
 	mu sync.Mutex
 
@@ -48,8 +56,9 @@ type User struct {
 	following          []string
 	followingExpiresAt time.Time
 
-	closeBy          []CloseBy
-	closeByExpiresAt time.Time
+	closeBy            []CloseBy
+	closeByExpiresAt   time.Time
+	closeByFetchedWith CloseByParams
 
 	suggestedFollows          []SuggestedFollow
 	suggestedFollowsExpiresAt time.Time
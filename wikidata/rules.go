@@ -2,32 +2,23 @@ package wikidata
 
 import (
 	"context"
-
-	"github.com/haileyok/photocopy/nervana"
 )
 
-func ShouldInclude(ctx context.Context, relevantEntities map[string]Entity, responseEntities []nervana.NervanaItem) bool {
-	// filter down to the relevant entities
-	var filteredEntities []nervana.NervanaItem
+// ShouldInclude reports whether the entities found in a post match a feed. A single match of anything other than a
+// person includes the post wherever in the post it was found. People need stronger evidence, since a single mention
+// has too many false positives, so they are only included once their matches add up to two by source weight.
+func ShouldInclude(ctx context.Context, relevantEntities map[string]Entity, responseEntities []EntityMatch) bool {
+	var humanScore float64
 	for _, e := range responseEntities {
-		_, exists := relevantEntities[e.EntityId]
+		entity, exists := relevantEntities[e.EntityId]
 		if !exists {
 			continue
 		}
-		filteredEntities = append(filteredEntities, e)
-	}
-
-	if len(filteredEntities) == 0 {
-		return false
-	}
-
-	// If an entity is a person and there is only a single entity, ignore it. Too many false positives
-	for _, e := range filteredEntities {
-		entity := relevantEntities[e.EntityId]
-		if entity.InstanceOf == EntityIdHuman && len(filteredEntities) < 2 {
-			return false
+		if entity.InstanceOf != EntityIdHuman {
+			return true
 		}
+		humanScore += e.Weight()
 	}
 
-	return true
+	return humanScore >= 2
 }
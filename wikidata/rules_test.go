@@ -0,0 +1,53 @@
+package wikidata
+
+import (
+	"context"
+	"testing"
+
+	"github.com/haileyok/photocopy/nervana"
+)
+
+func TestShouldInclude(t *testing.T) {
+	const (
+		wrigleyField = "Q49186"
+		cubs         = "Q246386"
+		player       = "Q1000"
+		otherPlayer  = "Q1001"
+		unrelated    = "Q90"
+	)
+	relevant := map[string]Entity{
+		wrigleyField: {Entity: wrigleyField, InstanceOf: "Q483110"},
+		cubs:         {Entity: cubs, InstanceOf: "Q13027888"},
+		player:       {Entity: player, InstanceOf: EntityIdHuman},
+		otherPlayer:  {Entity: otherPlayer, InstanceOf: EntityIdHuman},
+	}
+	match := func(id string, src Source) EntityMatch {
+		return EntityMatch{NervanaItem: nervana.NervanaItem{EntityId: id}, Source: src}
+	}
+
+	tests := []struct {
+		name    string
+		matches []EntityMatch
+		want    bool
+	}{
+		{"text only", []EntityMatch{match(cubs, SourceText)}, true},
+		{"alt text only", []EntityMatch{match(wrigleyField, SourceAltText)}, true},
+		{"link description only", []EntityMatch{match(wrigleyField, SourceLinkDescription)}, true},
+		{"link title only", []EntityMatch{match(cubs, SourceLinkTitle)}, true},
+		{"hashtag only", []EntityMatch{match(cubs, SourceHashtag)}, true},
+		{"no matches", nil, false},
+		{"unrelated entity", []EntityMatch{match(unrelated, SourceText)}, false},
+		{"single person in text", []EntityMatch{match(player, SourceText)}, false},
+		{"two people in text", []EntityMatch{match(player, SourceText), match(otherPlayer, SourceText)}, true},
+		{"person in text and alt text", []EntityMatch{match(player, SourceText), match(otherPlayer, SourceAltText)}, false},
+		{"person with a place", []EntityMatch{match(player, SourceText), match(wrigleyField, SourceAltText)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ShouldInclude(context.Background(), relevant, tt.matches); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package wikidata
+
+import "github.com/haileyok/photocopy/nervana"
+
+// Source is the part of a post that an entity was found in
+type Source string
+
+const (
+	SourceText            Source = "text"
+	SourceLinkTitle       Source = "link_title"
+	SourceLinkDescription Source = "link_description"
+	SourceAltText         Source = "alt_text"
+	SourceHashtag         Source = "hashtag"
+)
+
+// SourceWeights is how much a match of a person from each source counts towards the evidence ShouldInclude needs for
+// people. A post's own text counts fully, while link descriptions and alt text are more likely to mention people in
+// passing.
+var SourceWeights = map[Source]float64{
+	SourceText:            1,
+	SourceLinkTitle:       1,
+	SourceLinkDescription: 0.5,
+	SourceAltText:         0.75,
+	SourceHashtag:         1,
+}
+
+// EntityMatch is an entity returned by nervana, tagged with where in the post it was found
+type EntityMatch struct {
+	nervana.NervanaItem
+	Source Source
+}
+
+func (m EntityMatch) Weight() float64 {
+	if w, ok := SourceWeights[m.Source]; ok {
+		return w
+	}
+	return 1
+}